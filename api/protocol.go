@@ -10,6 +10,30 @@ Flags:
 		- 0x5: Greeting to users in the topic
 		- 0x6: Farewell to users in the topic
 		- 0x7: Same as 0x4, but for response to greeting in the topic
+		- 0x8: Handshake with protocol version and capabilities of the peer
+		- 0x9: Response to the handshake (ack)
+		- 0xA: Receipt that messages were delivered to the peer
+		- 0xB: Receipt that messages were read by the user
+		- 0xC: Edit of previously sent message
+		- 0xD: Redaction (deletion) of previously sent message
+		- 0xE: Reaction to the message (add or remove)
+		- 0xF: Offer of the file, which can be downloaded from the sender
+		- 0x10: Acceptance of the file offer
+		- 0x11: Refusal of the file offer
+		- 0x12: Fragment of the message, which is too large to be sent at once
+		- 0x13: Compressed message
+		- 0x14: End-to-end encrypted message
+		- 0x15: Sender key of encrypted topic (is sent only inside of end-to-end encrypted message)
+		- 0x16: Request of missing sender key
+		- 0x17: Message encrypted with sender key
+		- 0x18: Message encrypted in double ratchet session
+		- 0x19: Rotation of identity key
+		- 0x1A: Revocation of compromised identity key
+		- 0x1B: Request to compare safety numbers
+		- 0x1C: Confirmation that safety numbers match
+		- 0x1D: Invite token, which member presents in private topic
+		- 0x100-0x1FF: Ephemeral signals (typing, presence), they are never delivered as text messages
+		- 0x1000 and above: Application-defined messages
 */
 const (
 	FlagGenericMessage   int = 0x0
@@ -20,21 +44,358 @@ const (
 	FlagGreeting         int = 0x5
 	FlagFarewell         int = 0x6
 	FlagGreetingRespond  int = 0x7
+	FlagHandshake        int = 0x8
+	FlagHandshakeRespond int = 0x9
+	FlagDeliveryReceipt  int = 0xA
+	FlagReadReceipt      int = 0xB
+	FlagEdit             int = 0xC
+	FlagRedact           int = 0xD
+	FlagReaction         int = 0xE
+	FlagFileOffer        int = 0xF
+	FlagFileAccept       int = 0x10
+	FlagFileDecline      int = 0x11
+	FlagFragment         int = 0x12
+	FlagCompressed       int = 0x13
+	FlagEncrypted        int = 0x14
+	FlagSenderKey        int = 0x15
+	FlagSenderKeyRequest int = 0x16
+	FlagGroupEncrypted   int = 0x17
+	FlagRatchet          int = 0x18
+	FlagKeyRotation      int = 0x19
+	FlagKeyRevocation    int = 0x1A
+	FlagVerifyRequest    int = 0x1B
+	FlagVerifyConfirm    int = 0x1C
+	FlagTopicInvite      int = 0x1D
+
+	FlagSignalMin      int = 0x100
+	FlagTypingStarted  int = 0x100
+	FlagTypingStopped  int = 0x101
+	FlagPresenceActive int = 0x102
+	FlagPresenceIdle   int = 0x103
+	FlagSignalMax      int = 0x1FF
+
+	// FlagUserDefined is the first flag which applications may use for their own message types
+	FlagUserDefined int = 0x1000
 
 	ProtocolString string = "/moonshard/2.0.0"
+	// FileTransferProtocol is libp2p stream protocol for downloading offered files
+	FileTransferProtocol string = "/moonshard/file/1.0.0"
+	// LegacyProtocolString is the pubsub protocol of v1 nodes, we keep speaking it while the network is being upgraded
+	LegacyProtocolString string = "/moonshard/1.0.0"
+
+	// ProtocolVersion is the version of the message format, which this node speaks
+	ProtocolVersion int = 2
+	// MinProtocolVersion is the oldest version of the message format we still accept
+	MinProtocolVersion int = 1
+	// MaxCompatibleProtocolVersion is the newest version we handle. Newer versions may change the message format,
+	// so their messages are only forwarded, and handshakes of newer peers negotiate our version
+	MaxCompatibleProtocolVersion int = ProtocolVersion
+	// LegacyProtocolVersion is assumed for messages without version (v1 nodes don't send it)
+	LegacyProtocolVersion int = 1
 )
 
+/*
+Capabilities are optional features announced in the handshake.
+Feature is used with a peer only if the peer has announced corresponding capability,
+otherwise we downgrade to the behaviour of v1 protocol.
+*/
+const (
+	CapabilityHandshake string = "handshake"
+	// CapabilityCodecPrefix is followed by the name of wire codec, which peer is able to decode
+	CapabilityCodecPrefix string = "codec/"
+	CapabilityProtobuf    string = CapabilityCodecPrefix + "protobuf"
+	CapabilityReceipts    string = "receipts"
+	CapabilitySignals     string = "signals"
+	CapabilityEdits       string = "edits"
+	CapabilityReactions   string = "reactions"
+	CapabilityThreads     string = "threads"
+	CapabilityFiles       string = "files"
+	CapabilityContent     string = "content"
+	CapabilityFragments   string = "fragments"
+	// CapabilityCompressionPrefix is followed by the name of compression, which peer is able to decompress
+	CapabilityCompressionPrefix string = "compression/"
+	CapabilityGzip              string = CapabilityCompressionPrefix + CompressionGzip
+	CapabilityEncryption        string = "encryption"
+	CapabilityGroupEncryption   string = "group-encryption"
+	CapabilityRatchet           string = "ratchet"
+)
+
+// DefaultCapabilities is the list of capabilities which this node announces
+var DefaultCapabilities = []string{
+	CapabilityHandshake,
+	CapabilityProtobuf,
+	CapabilityReceipts,
+	CapabilitySignals,
+	CapabilityEdits,
+	CapabilityReactions,
+	CapabilityThreads,
+	CapabilityFiles,
+	CapabilityContent,
+	CapabilityFragments,
+	CapabilityGzip,
+	CapabilityEncryption,
+	CapabilityGroupEncryption,
+	CapabilityRatchet,
+}
+
+// Content types of generic messages
+const (
+	ContentTypePlain      string = "text/plain"
+	ContentTypeMarkdown   string = "text/markdown"
+	ContentTypeJSON       string = "application/json"
+	ContentTypeAttachment string = "application/vnd.moonshard.attachment+json"
+)
+
+/*
+Protobuf field numbers (schema for other clients is in p2chat.proto, messages are encoded without framing):
+		- 1-15: fields of BaseMessage (envelope), they are shared by every message type
+		- 16 and above: fields of specific message type
+*/
+
+// Message is implemented by every message type of our protocol (all of them embed BaseMessage)
+type Message interface {
+	Base() *BaseMessage
+}
+
 // BaseMessage is the basic message format of our protocol
 type BaseMessage struct {
-	Body         string `json:"body"`
-	To           string `json:"to"`
-	Flag         int    `json:"flag"`
-	FromMatrixID string `json:"fromMatrixID"`
+	Body         string   `json:"body" protobuf:"bytes,1,opt,name=body"`
+	To           string   `json:"to" protobuf:"bytes,2,opt,name=to"`
+	Flag         int      `json:"flag" protobuf:"varint,3,opt,name=flag"`
+	FromMatrixID string   `json:"fromMatrixID" protobuf:"bytes,4,opt,name=fromMatrixID"`
+	Version      int      `json:"version,omitempty" protobuf:"varint,5,opt,name=version"`
+	Capabilities []string `json:"capabilities,omitempty" protobuf:"bytes,6,rep,name=capabilities"`
+	// ID is generated by the sender and unique for the sender
+	ID string `json:"id,omitempty" protobuf:"bytes,7,opt,name=id"`
+	// Timestamp is the send time in Unix milliseconds
+	Timestamp int64 `json:"timestamp,omitempty" protobuf:"varint,8,opt,name=timestamp"`
+	// ReplyTo is the ID of the message which this message answers
+	ReplyTo string `json:"replyTo,omitempty" protobuf:"bytes,9,opt,name=replyTo"`
+	// ThreadRoot is the ID of the first message of the thread
+	ThreadRoot string `json:"threadRoot,omitempty" protobuf:"bytes,10,opt,name=threadRoot"`
+	// ContentType is MIME type of the Payload. Body always keeps plain text fallback for clients which don't know the type
+	ContentType string `json:"contentType,omitempty" protobuf:"bytes,11,opt,name=contentType"`
+	Payload     string `json:"payload,omitempty" protobuf:"bytes,12,opt,name=payload"`
+}
+
+// Base returns the envelope of the message
+func (m *BaseMessage) Base() *BaseMessage {
+	return m
+}
+
+// MessageHeader is the part of the envelope which is needed to route the message before decoding it completely
+type MessageHeader struct {
+	To      string `json:"to" protobuf:"bytes,2,opt,name=to"`
+	Flag    int    `json:"flag" protobuf:"varint,3,opt,name=flag"`
+	Version int    `json:"version,omitempty" protobuf:"varint,5,opt,name=version"`
 }
 
 // GetTopicsRespondMessage is the format of the message to answer of request for topics
 // Flag: 0x2
 type GetTopicsRespondMessage struct {
 	BaseMessage
-	Topics []string `json:"topics"`
+	Topics []string `json:"topics" protobuf:"bytes,16,rep,name=topics"`
+}
+
+// ReceiptMessage acknowledges delivery or reading of messages, it is sent to the author of the messages
+// Flag: 0xA, 0xB
+type ReceiptMessage struct {
+	BaseMessage
+	MessageIDs []string `json:"messageIDs" protobuf:"bytes,16,rep,name=messageIDs"`
+}
+
+// SignalMessage is short-lived signal, which expires if the sender doesn't renew it
+// Flag: 0x100-0x1FF
+type SignalMessage struct {
+	BaseMessage
+	// TTL is the lifetime of the signal in milliseconds
+	TTL int64 `json:"ttl" protobuf:"varint,16,opt,name=ttl"`
+}
+
+// EditMessage replaces body of the message or redacts it, only author of the message is allowed to do it
+// Flag: 0xC, 0xD
+type EditMessage struct {
+	BaseMessage
+	// TargetID is the ID of edited message
+	TargetID string `json:"targetID" protobuf:"bytes,16,opt,name=targetID"`
+}
+
+// ReactionMessage adds (or removes) reaction of the sender to the message
+// Flag: 0xE
+type ReactionMessage struct {
+	BaseMessage
+	TargetID string `json:"targetID" protobuf:"bytes,16,opt,name=targetID"`
+	// Key of the reaction, usually an emoji
+	Key    string `json:"key" protobuf:"bytes,17,opt,name=key"`
+	Remove bool   `json:"remove,omitempty" protobuf:"varint,18,opt,name=remove"`
+}
+
+// FileOfferMessage announces the file, which receivers may download over FileTransferProtocol
+// Flag: 0xF
+type FileOfferMessage struct {
+	BaseMessage
+	FileID string `json:"fileID" protobuf:"bytes,16,opt,name=fileID"`
+	Name   string `json:"name" protobuf:"bytes,17,opt,name=name"`
+	Size   int64  `json:"size" protobuf:"varint,18,opt,name=size"`
+	// Hash is hex-encoded SHA-256 of the file contents
+	Hash     string `json:"hash" protobuf:"bytes,19,opt,name=hash"`
+	MimeType string `json:"mimeType" protobuf:"bytes,20,opt,name=mimeType"`
+}
+
+// FileResponseMessage accepts or declines the file offer
+// Flag: 0x10, 0x11
+type FileResponseMessage struct {
+	BaseMessage
+	FileID string `json:"fileID" protobuf:"bytes,16,opt,name=fileID"`
+}
+
+// FileRequest is sent by receiver at the beginning of the FileTransferProtocol stream
+type FileRequest struct {
+	FileID string `json:"fileID"`
+	// Offset to resume the download from
+	Offset int64 `json:"offset"`
+}
+
+// Attachment is the payload of ContentTypeAttachment, it refers to the file offered with FlagFileOffer
+type Attachment struct {
+	FileID   string `json:"fileID"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Hash     string `json:"hash"`
+	MimeType string `json:"mimeType"`
+}
+
+// FragmentMessage carries part of encoded message, receiver concatenates data of all fragments and handles the result
+// Flag: 0x12
+type FragmentMessage struct {
+	BaseMessage
+	// MessageID is the ID of the fragmented message
+	MessageID string `json:"messageID" protobuf:"bytes,16,opt,name=messageID"`
+	Index     int    `json:"index" protobuf:"varint,17,opt,name=index"`
+	Count     int    `json:"count" protobuf:"varint,18,opt,name=count"`
+	Data      []byte `json:"data" protobuf:"bytes,19,opt,name=data"`
+}
+
+// Compression algorithms of CompressedMessage
+const (
+	CompressionGzip string = "gzip"
+)
+
+// CompressedMessage carries compressed encoded message, receiver decompresses data and handles the result
+// Flag: 0x13
+type CompressedMessage struct {
+	BaseMessage
+	Compression string `json:"compression" protobuf:"bytes,16,opt,name=compression"`
+	Data        []byte `json:"data" protobuf:"bytes,17,opt,name=data"`
+}
+
+// HandshakeMessage announces keys of the peer along with its capabilities
+// Flag: 0x8, 0x9
+type HandshakeMessage struct {
+	BaseMessage
+	// IdentityKey is marshalled public key of libp2p identity of the peer
+	IdentityKey []byte `json:"identityKey,omitempty" protobuf:"bytes,16,opt,name=identityKey"`
+	// EncryptionKey is X25519 public key, which is used for end-to-end encryption
+	EncryptionKey []byte `json:"encryptionKey,omitempty" protobuf:"bytes,17,opt,name=encryptionKey"`
+	// KeySignature is the signature of EncryptionKey made by identity key
+	KeySignature []byte `json:"keySignature,omitempty" protobuf:"bytes,18,opt,name=keySignature"`
+	// PreKey is X25519 public key, which peers use to start double ratchet session with us
+	PreKey []byte `json:"preKey,omitempty" protobuf:"bytes,19,opt,name=preKey"`
+	// PreKeySignature is the signature of PreKey made by identity key
+	PreKeySignature []byte `json:"preKeySignature,omitempty" protobuf:"bytes,20,opt,name=preKeySignature"`
+}
+
+// EncryptedMessage carries encoded message, which is sealed with NaCl box for the peer in To
+// Flag: 0x14
+type EncryptedMessage struct {
+	BaseMessage
+	Nonce      []byte `json:"nonce" protobuf:"bytes,16,opt,name=nonce"`
+	Ciphertext []byte `json:"ciphertext" protobuf:"bytes,17,opt,name=ciphertext"`
+}
+
+// SenderKeyMessage distributes symmetric key, which the sender uses for messages in the topic.
+// Request of the key doesn't carry Key
+// Flag: 0x15, 0x16
+type SenderKeyMessage struct {
+	BaseMessage
+	KeyID string `json:"keyID" protobuf:"bytes,16,opt,name=keyID"`
+	Key   []byte `json:"key,omitempty" protobuf:"bytes,17,opt,name=key"`
+}
+
+// GroupEncryptedMessage carries encoded message, which is sealed with NaCl secretbox using sender key KeyID
+// Flag: 0x17
+type GroupEncryptedMessage struct {
+	BaseMessage
+	KeyID      string `json:"keyID" protobuf:"bytes,16,opt,name=keyID"`
+	Nonce      []byte `json:"nonce" protobuf:"bytes,17,opt,name=nonce"`
+	Ciphertext []byte `json:"ciphertext" protobuf:"bytes,18,opt,name=ciphertext"`
+}
+
+// RatchetMessage carries encoded message, which is encrypted in double ratchet session with the peer in To.
+// Initiator of the session attaches its ephemeral key and used prekey until it gets the reply
+// Flag: 0x18
+type RatchetMessage struct {
+	BaseMessage
+	RatchetKey   []byte `json:"ratchetKey" protobuf:"bytes,16,opt,name=ratchetKey"`
+	PreviousSent int    `json:"previousSent" protobuf:"varint,17,opt,name=previousSent"`
+	Index        int    `json:"index" protobuf:"varint,18,opt,name=index"`
+	Ciphertext   []byte `json:"ciphertext" protobuf:"bytes,19,opt,name=ciphertext"`
+	EphemeralKey []byte `json:"ephemeralKey,omitempty" protobuf:"bytes,20,opt,name=ephemeralKey"`
+	PreKey       []byte `json:"preKey,omitempty" protobuf:"bytes,21,opt,name=preKey"`
+}
+
+// IdentityMessage carries Matrix ID claim of the sender. Claim is signed by libp2p identity of the sender
+// and optionally countersigned by its Matrix key. Unsigned claims come from peers which don't support it
+// Flag: 0x4, 0x7
+type IdentityMessage struct {
+	BaseMessage
+	// IdentityKey is marshalled public key of libp2p identity, which has signed the claim
+	IdentityKey    []byte `json:"identityKey,omitempty" protobuf:"bytes,16,opt,name=identityKey"`
+	ClaimTimestamp int64  `json:"claimTimestamp,omitempty" protobuf:"varint,17,opt,name=claimTimestamp"`
+	ClaimSignature []byte `json:"claimSignature,omitempty" protobuf:"bytes,18,opt,name=claimSignature"`
+	// MatrixKey is marshalled public key, which belongs to the Matrix account
+	MatrixKey       []byte `json:"matrixKey,omitempty" protobuf:"bytes,19,opt,name=matrixKey"`
+	MatrixSignature []byte `json:"matrixSignature,omitempty" protobuf:"bytes,20,opt,name=matrixSignature"`
+}
+
+// KeyRotationMessage announces that the peer moves to the new identity. Both keys sign the rotation,
+// so the old key vouches for the new peer ID and the new key proves it's controlled by the same node
+// Flag: 0x19
+type KeyRotationMessage struct {
+	BaseMessage
+	// OldKey and NewKey are marshalled public keys of libp2p identities
+	OldKey       []byte `json:"oldKey" protobuf:"bytes,16,opt,name=oldKey"`
+	NewKey       []byte `json:"newKey" protobuf:"bytes,17,opt,name=newKey"`
+	OldSignature []byte `json:"oldSignature" protobuf:"bytes,18,opt,name=oldSignature"`
+	NewSignature []byte `json:"newSignature" protobuf:"bytes,19,opt,name=newSignature"`
+}
+
+// KeyRevocationMessage announces that identity key is compromised, it's signed by the revoked key itself
+// Flag: 0x1A
+type KeyRevocationMessage struct {
+	BaseMessage
+	RevokedKey []byte `json:"revokedKey" protobuf:"bytes,16,opt,name=revokedKey"`
+	Reason     string `json:"reason,omitempty" protobuf:"bytes,17,opt,name=reason"`
+	Signature  []byte `json:"signature" protobuf:"bytes,18,opt,name=signature"`
+}
+
+// VerificationMessage is sent when the user has compared safety number with the peer
+// Flag: 0x1B, 0x1C
+type VerificationMessage struct {
+	BaseMessage
+	// Fingerprint is the hash of safety number, as it's computed by the sender
+	Fingerprint []byte `json:"fingerprint,omitempty" protobuf:"bytes,16,opt,name=fingerprint"`
+}
+
+// TopicInviteMessage presents invite token of the member of private topic, the token is signed by the topic creator
+// Flag: 0x1D
+type TopicInviteMessage struct {
+	BaseMessage
+	Topic string `json:"topic" protobuf:"bytes,16,opt,name=topic"`
+	// CreatorKey is marshalled public key of the topic creator, which has signed the token
+	CreatorKey []byte `json:"creatorKey" protobuf:"bytes,17,opt,name=creatorKey"`
+	Member     string `json:"member" protobuf:"bytes,18,opt,name=member"`
+	// Expires is the time when the token expires (unix ms), zero if it doesn't expire
+	Expires   int64  `json:"expires,omitempty" protobuf:"varint,19,opt,name=expires"`
+	Signature []byte `json:"signature" protobuf:"bytes,20,opt,name=signature"`
 }
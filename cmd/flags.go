@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
 )
 
 type config struct {
@@ -9,6 +11,12 @@ type config struct {
 	ProtocolID       string
 	listenHost       string
 	listenPort       int
+	sessionsDir      string
+	identityFile     string
+	keyType          string
+	pinsFile         string
+	blocklistFile    string
+	retiredFile      string
 }
 
 func parseFlags() *config {
@@ -16,8 +24,14 @@ func parseFlags() *config {
 
 	flag.StringVar(&c.RendezvousString, "rendezvous", "moonshard", "Unique string to identify group of nodes. Share this with your friends to let them connect with you")
 	flag.StringVar(&c.listenHost, "wrapped_host", "0.0.0.0", "The bootstrap node wrapped_host listen address\n")
-	flag.StringVar(&c.ProtocolID, "pid", "/moonshard/1.0.0", "Sets a protocol id for stream headers")
+	flag.StringVar(&c.ProtocolID, "pid", api.ProtocolString, "Sets a protocol id for stream headers")
 	flag.IntVar(&c.listenPort, "port", 4001, "node listen port")
+	flag.StringVar(&c.identityFile, "identity", "", "File with the node key, it's created if doesn't exist. New key is generated on every start if it's not set")
+	flag.StringVar(&c.keyType, "keytype", "ed25519", "Type of the node key, which is created in identity file (ed25519 or rsa)")
+	flag.StringVar(&c.pinsFile, "pins", "", "File where identities of contacts are pinned on first use, they are kept only in memory if it's not set")
+	flag.StringVar(&c.blocklistFile, "blocklist", "", "File where blocked peers and Matrix IDs are stored, they are kept only in memory if it's not set")
+	flag.StringVar(&c.retiredFile, "retired", "", "File where rotated and revoked keys of peers are stored, they are kept only in memory if it's not set")
+	flag.StringVar(&c.sessionsDir, "sessions", "", "Directory where encrypted sessions are stored, sessions are disabled if it's not set")
 
 	flag.Parse()
 	return c
@@ -4,13 +4,14 @@ import (
 	"bufio"
 	"context"
 	"crypto/rand"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 
 	"io"
 	"os"
+	"strings"
 	"sync"
 
 	"time"
@@ -26,6 +27,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/protocol"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/multiformats/go-multiaddr"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // TODO: Update Readme & checkout and replace better comments
@@ -84,7 +86,7 @@ func readSub(subscription *pubsub.Subscription, incomingMessagesChan chan pubsub
 // Subscribes to a topic and then get messages ..
 func newTopic(topic string) {
 	ctx := globalCtx
-	subscription, err := pubSub.Subscribe(topic)
+	subscription, err := handler.JoinTopic(topic)
 	if err != nil {
 		log.Println("Error occurred when subscribing to topic", err)
 		return
@@ -100,8 +102,8 @@ func newTopic(topic string) {
 		case msg := <-incomingMessages:
 			{
 				handler.HandleIncomingMessage(serviceTopic, msg, func(textMessage pkg.TextMessage) {
-					log.Printf("%s \x1b[32m%s\x1b[0m> ", textMessage.From, textMessage.Body)
-				})
+					log.Printf("%s \x1b[32m%s\x1b[0m> ", textMessage.FromPeerID, textMessage.Body)
+				}, handleMatch, handleUnmatch)
 			}
 		}
 	}
@@ -129,21 +131,7 @@ func writeTopic(topic string) {
 			log.Println("Error reading from stdin", err)
 			return
 		}
-		message := &api.BaseMessage{
-			Body: text,
-			Flag: api.FlagGenericMessage,
-		}
-
-		sendData, err := json.Marshal(message)
-		if err != nil {
-			log.Println("Error occurred when marshalling message object")
-			continue
-		}
-		err = pubSub.Publish(topic, sendData)
-		if err != nil {
-			log.Println("Error occurred when publishing", err)
-			return
-		}
+		handler.SendMessage(topic, text)
 	}
 }
 
@@ -164,10 +152,7 @@ func main() {
 	globalCtx = ctx
 	globalCtxCancel = ctxCancel
 
-	r := rand.Reader
-
-	// Creates a new RSA key pair for this wrapped_host.
-	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+	prvKey, err := loadIdentity(cfg)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -192,7 +177,13 @@ func main() {
 
 	myself = host
 
-	pb, err := pubsub.NewFloodsubWithProtocols(context.Background(), host, []protocol.ID{protocol.ID(cfg.ProtocolID)}, pubsub.WithMessageSigning(true), pubsub.WithStrictSignatureVerification(true))
+	// Speaking legacy protocol as well, so v1 nodes stay reachable during the upgrade
+	protocols := []protocol.ID{protocol.ID(cfg.ProtocolID)}
+	if cfg.ProtocolID != api.LegacyProtocolString {
+		protocols = append(protocols, protocol.ID(api.LegacyProtocolString))
+	}
+
+	pb, err := pubsub.NewFloodsubWithProtocols(context.Background(), host, protocols, pubsub.WithMessageSigning(true), pubsub.WithStrictSignatureVerification(true))
 	if err != nil {
 		log.Println("Error occurred when create PubSub")
 		log.Fatalln(err)
@@ -201,7 +192,32 @@ func main() {
 	// Set global PubSub object
 	pubSub = pb
 
+	// NOTE:  here we use Randezvous string as 'topic' by default .. topic != service tag
+	serviceTopic = cfg.RendezvousString
 	handler = pkg.NewHandler(pb, serviceTopic, host.ID(), &networkTopics)
+	if err = handler.SetIdentityKey(prvKey); err != nil {
+		log.Fatalln(err)
+	}
+	if cfg.pinsFile != "" {
+		if err = handler.EnableIdentityPinStore(cfg.pinsFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if cfg.blocklistFile != "" {
+		if err = handler.EnableBlocklist(cfg.blocklistFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if cfg.retiredFile != "" {
+		if err = handler.EnableRetiredKeyStore(cfg.retiredFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if cfg.sessionsDir != "" {
+		if err = handler.EnableSessions(cfg.sessionsDir); err != nil {
+			log.Fatalln(err)
+		}
+	}
 
 	// Randezvous string = service tag
 	// Disvover all peers with our service (all ms devices)
@@ -210,9 +226,7 @@ func main() {
 		panic(err)
 	}
 
-	// NOTE:  here we use Randezvous string as 'topic' by default .. topic != service tag
-	subscription, err := pb.Subscribe(cfg.RendezvousString)
-	serviceTopic = cfg.RendezvousString
+	subscription, err := handler.JoinTopic(serviceTopic)
 	if err != nil {
 		log.Println("Error occurred when subscribing to topic", err)
 		return
@@ -228,6 +242,7 @@ func main() {
 		ctxCancel()
 	}()
 	go readSub(subscription, incomingMessages)
+	go handler.SendHandshake()
 	go getNetworkTopics()
 
 MainLoop:
@@ -240,9 +255,9 @@ MainLoop:
 				handler.HandleIncomingMessage(serviceTopic, msg, func(textMessage pkg.TextMessage) {
 					// Green console colour: 	\x1b[32m
 					// Reset console colour: 	\x1b[0m
-					log.Printf("%s > \x1b[32m%s\x1b[0m", textMessage.From, textMessage.Body)
+					log.Printf("%s > \x1b[32m%s\x1b[0m", textMessage.FromPeerID, textMessage.Body)
 					log.Print("> ")
-				})
+				}, handleMatch, handleUnmatch)
 			}
 		case newPeer := <-peerChan:
 			{
@@ -256,6 +271,7 @@ MainLoop:
 				}
 				log.Println("Connected to:", newPeer)
 				log.Println("> ")
+				go handler.SendHandshake()
 			}
 		}
 	}
@@ -267,6 +283,46 @@ MainLoop:
 }
 
 func getNetworkTopics() {
-	ctx := globalCtx
-	handler.RequestNetworkTopics(ctx)
+	handler.RequestNetworkTopics()
+}
+
+func handleMatch(topic string, peerID string, matrixID string) {
+	log.Printf("%s (%s) joined topic %s\n", peerID, matrixID, topic)
+}
+
+func handleUnmatch(topic string, peerID string, matrixID string) {
+	log.Printf("%s (%s) left topic %s\n", peerID, matrixID, topic)
+}
+
+// Loads node key from identity file, or creates a new RSA key pair if the file is not set
+func loadIdentity(cfg *config) (crypto.PrivKey, error) {
+	if cfg.identityFile == "" {
+		prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+		return prvKey, err
+	}
+
+	keyTypes := map[string]int{"ed25519": crypto.Ed25519, "rsa": crypto.RSA}
+	keyType, ok := keyTypes[strings.ToLower(cfg.keyType)]
+	if !ok {
+		return nil, fmt.Errorf("unknown key type %s", cfg.keyType)
+	}
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return pkg.LoadOrCreateIdentity(cfg.identityFile, keyType, passphrase)
+}
+
+// Reads passphrase of identity file from P2CHAT_PASSPHRASE environment variable or from the terminal
+func readPassphrase() ([]byte, error) {
+	if passphrase := os.Getenv("P2CHAT_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("passphrase is not set, use P2CHAT_PASSPHRASE environment variable")
+	}
+	fmt.Print("Passphrase of identity file: ")
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return passphrase, err
 }
@@ -36,8 +36,7 @@ var (
 
 // Creates mock host object
 func createHost() (context.Context, host.Host, error) {
-	ctx, _ /* cancel */ := context.WithCancel(context.Background())
-	// defer cancel()
+	ctx := context.Background()
 
 	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
 	if err != nil {
@@ -75,15 +74,18 @@ func TestCreateHosts(t *testing.T) {
 
 func TestMDNS(t *testing.T) {
 	for i := 0; i < numberOfNodes; i++ {
-		pb, err := pubsub.NewFloodsubWithProtocols(context.Background(), testHosts[i], []protocol.ID{protocol.ID("/moonshard/1.0.0")}, pubsub.WithMessageSigning(true), pubsub.WithStrictSignatureVerification(true))
+		pb, err := pubsub.NewFloodsubWithProtocols(context.Background(), testHosts[i], []protocol.ID{protocol.ID(api.ProtocolString)}, pubsub.WithMessageSigning(true), pubsub.WithStrictSignatureVerification(true))
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		testPubsubs = append(testPubsubs, pb)
-		testHandlers = append(testHandlers, pkg.NewHandler(pb, serviceTag, &networkTopics))
+		testHandlers = append(testHandlers, pkg.NewHandler(pb, serviceTag, testHosts[i].ID(), &networkTopics))
 
-		peerChan = pkg.InitMDNS(testContexts[i], testHosts[i], serviceTag)
+		peerChan, err = pkg.InitMDNS(testContexts[i], testHosts[i], serviceTag)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		subscription, err := pb.Subscribe(serviceTag)
 		if err != nil {
@@ -110,8 +112,8 @@ func TestMDNS(t *testing.T) {
 
 // Checks whether all nodes are connected to each other
 func TestGetPeers(t *testing.T) {
-	for _, handler := range testHandlers {
-		if len(handler.GetPeers(serviceTag)) != numberOfNodes-1 {
+	for i := range testHandlers {
+		if len(testHandlers[i].GetPeers(serviceTag)) != numberOfNodes-1 {
 			t.Fatal("Not all nodes are connected to each other.")
 		}
 	}
@@ -12,4 +12,5 @@ require (
 	github.com/libp2p/go-libp2p-swarm v0.1.0
 	github.com/multiformats/go-multiaddr v0.0.4
 	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2
+	golang.org/x/crypto v0.0.0-20190618222545-ea8f1a30c443
 )
@@ -0,0 +1,199 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// BlockMode tells what happens with messages of the blocked peer
+type BlockMode int
+
+const (
+	// BlockHard rejects all messages of the peer, they are not handled and not forwarded to other peers
+	BlockHard BlockMode = iota
+	// BlockMute hides messages of the peer from the user, but protocol messages are still handled and forwarded
+	BlockMute
+)
+
+// BlockEntry is the blocked peer ID or Matrix ID
+type BlockEntry struct {
+	PeerID   peer.ID   `json:"peerID,omitempty"`
+	MatrixID string    `json:"matrixID,omitempty"`
+	Mode     BlockMode `json:"mode"`
+	Reason   string    `json:"reason,omitempty"`
+	// Created is the time when the entry was added (unix ms)
+	Created int64 `json:"created"`
+}
+
+// blocklist holds blocked peers, which are persisted in path.
+// Pubsub blacklist can't be undone, so messages are filtered by handler instead
+type blocklist struct {
+	mu        sync.RWMutex
+	path      string
+	peers     map[peer.ID]*BlockEntry
+	matrixIDs map[string]*BlockEntry
+}
+
+func newBlocklist() *blocklist {
+	return &blocklist{
+		peers:     make(map[peer.ID]*BlockEntry),
+		matrixIDs: make(map[string]*BlockEntry),
+	}
+}
+
+// Must be called with locked mutex
+func (b *blocklist) add(entry *BlockEntry) {
+	if entry.PeerID != "" {
+		b.peers[entry.PeerID] = entry
+	} else {
+		b.matrixIDs[entry.MatrixID] = entry
+	}
+}
+
+// Must be called with locked mutex
+func (b *blocklist) entries() []BlockEntry {
+	entries := make([]BlockEntry, 0, len(b.peers)+len(b.matrixIDs))
+	for _, entry := range b.peers {
+		entries = append(entries, *entry)
+	}
+	for _, entry := range b.matrixIDs {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// Must be called with locked mutex
+func (b *blocklist) save() {
+	if b.path == "" {
+		return
+	}
+	if err := writeJSONFile(b.path, b.entries()); err != nil {
+		log.Println("Failed to save blocklist: " + err.Error())
+	}
+}
+
+// Loads blocklist from the file and saves it there on every change
+func (h *Handler) EnableBlocklist(path string) error {
+	var entries []BlockEntry
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &entries)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	h.blocks.mu.Lock()
+	defer h.blocks.mu.Unlock()
+	for i := range entries {
+		if entries[i].PeerID == "" && entries[i].MatrixID == "" {
+			continue
+		}
+		h.blocks.add(&entries[i])
+	}
+	h.blocks.path = path
+	h.blocks.save()
+	return nil
+}
+
+// Blocks the peer, replacing previous mode of its block
+func (h *Handler) BlockPeer(peerID peer.ID, mode BlockMode, reason string) error {
+	if peerID == "" {
+		return errors.New("peer ID is empty")
+	}
+	if peerID == h.peerID {
+		return errors.New("can't block ourselves")
+	}
+	h.blocks.mu.Lock()
+	defer h.blocks.mu.Unlock()
+	h.blocks.add(&BlockEntry{PeerID: peerID, Mode: mode, Reason: reason, Created: nowMillis()})
+	h.blocks.save()
+	return nil
+}
+
+// Blocks every peer, which claims the Matrix ID or is known under it
+func (h *Handler) BlockMatrixID(matrixID string, mode BlockMode, reason string) error {
+	if matrixID == "" {
+		return errors.New("matrix ID is empty")
+	}
+	h.blocks.mu.Lock()
+	defer h.blocks.mu.Unlock()
+	h.blocks.add(&BlockEntry{MatrixID: matrixID, Mode: mode, Reason: reason, Created: nowMillis()})
+	h.blocks.save()
+	return nil
+}
+
+// Removes the peer from blocklist, its messages are accepted again
+func (h *Handler) UnblockPeer(peerID peer.ID) {
+	h.blocks.mu.Lock()
+	defer h.blocks.mu.Unlock()
+	delete(h.blocks.peers, peerID)
+	h.blocks.save()
+}
+
+// Removes the Matrix ID from blocklist
+func (h *Handler) UnblockMatrixID(matrixID string) {
+	h.blocks.mu.Lock()
+	defer h.blocks.mu.Unlock()
+	delete(h.blocks.matrixIDs, matrixID)
+	h.blocks.save()
+}
+
+// Returns copy of blocklist
+func (h *Handler) GetBlocklist() []BlockEntry {
+	h.blocks.mu.RLock()
+	defer h.blocks.mu.RUnlock()
+	return h.blocks.entries()
+}
+
+// Returns mode of the block, which applies to the peer by its ID or by its Matrix ID.
+// Hard block wins, if there are several
+func (h *Handler) IsBlocked(peerID peer.ID) (BlockMode, bool) {
+	return h.blockMode(peerID, "")
+}
+
+// Checks the peer, Matrix ID we know for it and Matrix ID claimed in the message
+func (h *Handler) blockMode(peerID peer.ID, claimedMatrixID string) (BlockMode, bool) {
+	h.mu.RLock()
+	knownMatrixID := h.identityMap[peer.ID(peerID.String())]
+	h.mu.RUnlock()
+
+	h.blocks.mu.RLock()
+	defer h.blocks.mu.RUnlock()
+	blocked := false
+	mode := BlockMute
+	for _, entry := range []*BlockEntry{h.blocks.peers[peerID], h.blocks.matrixIDs[knownMatrixID], h.blocks.matrixIDs[claimedMatrixID]} {
+		if entry == nil {
+			continue
+		}
+		blocked = true
+		if entry.Mode == BlockHard {
+			mode = BlockHard
+		}
+	}
+	return mode, blocked
+}
+
+// Returns whether the message is shown to the user, so it's dropped if the sender is muted
+func isMutedFlag(flag int) bool {
+	switch flag {
+	case api.FlagGenericMessage, api.FlagEdit, api.FlagRedact, api.FlagReaction, api.FlagFileOffer:
+		return true
+	}
+	return flag >= api.FlagSignalMin && flag <= api.FlagSignalMax || flag >= api.FlagUserDefined
+}
+
+// Checks whether message of the peer must be dropped
+func (h *Handler) isBlockedMessage(peerID peer.ID, message *api.BaseMessage) bool {
+	mode, blocked := h.blockMode(peerID, message.FromMatrixID)
+	return blocked && (mode == BlockHard || isMutedFlag(message.Flag))
+}
@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestBlocklist(t *testing.T) {
+	handler := newTestHandler(t)
+	_, spammer := newTestPeer(t)
+	_, noisy := newTestPeer(t)
+	var received []TextMessage
+	deliver := func(from peer.ID, message *api.BaseMessage) {
+		message.ID = newMessageID()
+		handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, from, JSONCodec, message), func(textMessage TextMessage) {
+			received = append(received, textMessage)
+		}, nil, nil)
+	}
+	text := func(matrixID string) *api.BaseMessage {
+		return &api.BaseMessage{Flag: api.FlagGenericMessage, Body: "hello", FromMatrixID: matrixID, To: handler.peerID.String()}
+	}
+
+	if err := handler.BlockPeer(spammer, BlockHard, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.BlockPeer(noisy, BlockMute, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.BlockMatrixID("@spammer:moonshard", BlockHard, ""); err != nil {
+		t.Fatal(err)
+	}
+	deliver(spammer, text(""))
+	deliver(noisy, text(""))
+	if len(received) != 0 {
+		t.Fatal("message of blocked peer is delivered")
+	}
+
+	data, err := JSONCodec.Marshal(&api.BaseMessage{Flag: api.FlagHandshake})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = handler.checkData(spammer, data); err == nil {
+		t.Fatal("message of hard blocked peer is forwarded")
+	}
+	if _, err = handler.checkData(noisy, data); err != nil {
+		t.Fatal("message of muted peer is not forwarded: " + err.Error())
+	}
+	_, other := newTestPeer(t)
+	deliver(other, text("@spammer:moonshard"))
+	if len(received) != 0 {
+		t.Fatal("message with blocked Matrix ID is delivered")
+	}
+
+	handler.UnblockPeer(noisy)
+	deliver(noisy, text(""))
+	if len(received) != 1 {
+		t.Fatal("message of unblocked peer is not delivered")
+	}
+}
+
+func TestBlocklistPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2chat-blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocklist.json")
+
+	handler := newTestHandler(t)
+	_, spammer := newTestPeer(t)
+	if err = handler.EnableBlocklist(path); err != nil {
+		t.Fatal(err)
+	}
+	handler.BlacklistPeer(spammer)
+	if err = handler.BlockMatrixID("@spammer:moonshard", BlockMute, "spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestHandler(t)
+	if err = restarted.EnableBlocklist(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.GetBlocklist()) != 2 {
+		t.Fatal("blocklist is not persisted")
+	}
+	if mode, blocked := restarted.IsBlocked(spammer); !blocked || mode != BlockHard {
+		t.Fatal("blacklisted peer is not reapplied on startup")
+	}
+	restarted.UnblockMatrixID("@spammer:moonshard")
+	if len(restarted.GetBlocklist()) != 1 {
+		t.Fatal("Matrix ID is not unblocked")
+	}
+}
@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+// Codec encodes and decodes messages of our protocol on the wire
+type Codec interface {
+	// Name of the codec, peers announce it as capability with api.CapabilityCodecPrefix
+	Name() string
+	Marshal(message interface{}) ([]byte, error)
+	Unmarshal(data []byte, message interface{}) error
+}
+
+var (
+	// JSONCodec is the default codec, every node (including v1 nodes) is able to decode it
+	JSONCodec Codec = jsonCodec{}
+	// ProtobufCodec is compact binary codec, which is used only if all receivers support it
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(message interface{}) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonCodec) Unmarshal(data []byte, message interface{}) error {
+	return json.Unmarshal(data, message)
+}
+
+// jsonMarker is the first byte of JSON data, it can't be used as marker of another codec.
+// It has group wire type, so it never starts protobuf data
+const jsonMarker byte = '{'
+
+// codecRegistry holds codecs, which can be detected by the marker byte their data starts with.
+// Protobuf data is not marked, so it is readable by standard protobuf decoders
+var codecRegistry = struct {
+	mu       sync.RWMutex
+	byMarker map[byte]Codec
+	byName   map[string]Codec
+}{
+	byMarker: map[byte]Codec{jsonMarker: JSONCodec},
+	byName:   map[string]Codec{JSONCodec.Name(): JSONCodec, ProtobufCodec.Name(): ProtobufCodec},
+}
+
+// markedCodec prefixes data of custom codec with its marker
+type markedCodec struct {
+	marker byte
+	codec  Codec
+}
+
+func (c markedCodec) Name() string {
+	return c.codec.Name()
+}
+
+func (c markedCodec) Marshal(message interface{}) ([]byte, error) {
+	data, err := c.codec.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{c.marker}, data...), nil
+}
+
+func (c markedCodec) Unmarshal(data []byte, message interface{}) error {
+	if len(data) == 0 || data[0] != c.marker {
+		return fmt.Errorf("data is not encoded with %s codec", c.codec.Name())
+	}
+	return c.codec.Unmarshal(data[1:], message)
+}
+
+// Registers custom codec, its data is prefixed with the marker so receivers can detect it.
+// Marker must not be the first byte of protobuf data, i.e. its low 3 bits must be 3, 4, 6 or 7.
+// Receivers must register the codec with the same marker
+func RegisterCodec(marker byte, codec Codec) error {
+	if isProtobufKeyByte(marker) {
+		return fmt.Errorf("marker %#x may be mistaken for protobuf data", marker)
+	}
+	codecRegistry.mu.Lock()
+	defer codecRegistry.mu.Unlock()
+	if _, ok := codecRegistry.byMarker[marker]; ok {
+		return fmt.Errorf("marker %#x is already taken", marker)
+	}
+	if _, ok := codecRegistry.byName[codec.Name()]; ok {
+		return errors.New("codec " + codec.Name() + " is already registered")
+	}
+	registered := markedCodec{marker: marker, codec: codec}
+	codecRegistry.byMarker[marker] = registered
+	codecRegistry.byName[codec.Name()] = registered
+	return nil
+}
+
+// Returns capabilities of custom codecs, they are announced along with the capabilities of the handler
+func customCodecCapabilities() []string {
+	codecRegistry.mu.RLock()
+	defer codecRegistry.mu.RUnlock()
+	capabilities := []string{}
+	for name, codec := range codecRegistry.byName {
+		if _, ok := codec.(markedCodec); ok {
+			capabilities = append(capabilities, api.CapabilityCodecPrefix+name)
+		}
+	}
+	return capabilities
+}
+
+// Detects codec of incoming data by its first byte: JSON and custom codecs are marked, protobuf is not
+func codecForData(data []byte) Codec {
+	if len(data) == 0 {
+		return JSONCodec
+	}
+	codecRegistry.mu.RLock()
+	defer codecRegistry.mu.RUnlock()
+	if codec, ok := codecRegistry.byMarker[data[0]]; ok {
+		return codec
+	}
+	if isProtobufKeyByte(data[0]) {
+		return ProtobufCodec
+	}
+	return JSONCodec
+}
+
+// Sets preferred codec for the topic. It is used only when every receiver announced support of it, JSON otherwise.
+// Codec must be registered, so receivers are able to detect it
+func (h *Handler) SetTopicCodec(topic string, codec Codec) error {
+	codecRegistry.mu.RLock()
+	registered, ok := codecRegistry.byName[codec.Name()]
+	codecRegistry.mu.RUnlock()
+	if !ok {
+		return errors.New("codec " + codec.Name() + " is not registered")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.topicCodecs[topic] = registered
+	return nil
+}
+
+// Returns codec which is going to be used for message to the topic (and to specific peer, if `to` is set)
+func (h *Handler) codecFor(topic string, to string) Codec {
+	h.mu.RLock()
+	codec, ok := h.topicCodecs[topic]
+	h.mu.RUnlock()
+	if !ok || codec.Name() == JSONCodec.Name() {
+		return JSONCodec
+	}
+
+	if h.receiversSupport(topic, to, api.CapabilityCodecPrefix+codec.Name()) {
+		return codec
+	}
+	return JSONCodec
+}
@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	message := &api.GetTopicsRespondMessage{
+		BaseMessage: api.BaseMessage{
+			To:           "QmPeer",
+			Flag:         api.FlagTopicsResponse,
+			FromMatrixID: "@alice:moonshard",
+			Version:      api.ProtocolVersion,
+			Capabilities: []string{api.CapabilityHandshake, ""},
+		},
+		Topics: []string{"moonshard", "random"},
+	}
+
+	for _, codec := range []Codec{JSONCodec, ProtobufCodec} {
+		data, err := codec.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codecForData(data).Name() != codec.Name() {
+			t.Fatalf("%s: codec is not detected by data", codec.Name())
+		}
+
+		decoded := &api.GetTopicsRespondMessage{}
+		if err = codec.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(message, decoded) {
+			t.Fatalf("%s: decoded message %+v doesn't match original %+v", codec.Name(), decoded, message)
+		}
+
+		header := &api.MessageHeader{}
+		if err = codec.Unmarshal(data, header); err != nil {
+			t.Fatal(err)
+		}
+		if header.To != message.To || header.Flag != message.Flag || header.Version != message.Version {
+			t.Fatalf("%s: wrong header %+v", codec.Name(), header)
+		}
+	}
+}
+
+func TestProtobufIsCompact(t *testing.T) {
+	message := &api.BaseMessage{
+		Body:    "hello",
+		Flag:    api.FlagGenericMessage,
+		Version: api.ProtocolVersion,
+	}
+	jsonData, _ := JSONCodec.Marshal(message)
+	protobufData, _ := ProtobufCodec.Marshal(message)
+	if len(protobufData) >= len(jsonData) {
+		t.Fatalf("protobuf encoding (%d bytes) is not smaller than JSON (%d bytes)", len(protobufData), len(jsonData))
+	}
+}
+
+func TestProtobufMalformedData(t *testing.T) {
+	message := &api.BaseMessage{}
+	if err := ProtobufCodec.Unmarshal([]byte{0x0a, 0x10, 'a'}, message); err == nil {
+		t.Fatal("truncated data is decoded without error")
+	}
+}
+
+// testReversedCodec is JSON with reversed bytes, so it can't be mistaken for JSON
+type testReversedCodec struct{}
+
+func (testReversedCodec) Name() string {
+	return "reversed"
+}
+
+func (testReversedCodec) Marshal(message interface{}) ([]byte, error) {
+	data, err := JSONCodec.Marshal(message)
+	return reverseBytes(data), err
+}
+
+func (testReversedCodec) Unmarshal(data []byte, message interface{}) error {
+	return JSONCodec.Unmarshal(reverseBytes(append([]byte{}, data...)), message)
+}
+
+func reverseBytes(data []byte) []byte {
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+	return data
+}
+
+func TestCustomCodec(t *testing.T) {
+	alice, bob := newTestKeyedHandler(t), newTestKeyedHandler(t)
+	if err := alice.SetTopicCodec("moonshard", testReversedCodec{}); err == nil {
+		t.Fatal("codec which is not registered is accepted")
+	}
+	if err := RegisterCodec(jsonMarker, testReversedCodec{}); err == nil {
+		t.Fatal("marker of built-in codec is taken")
+	}
+	if err := RegisterCodec(0x42, testReversedCodec{}); err == nil {
+		t.Fatal("marker which may start protobuf data is taken")
+	}
+	if err := RegisterCodec(0x43, testReversedCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetTopicCodec("moonshard", testReversedCodec{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob announces the codec in the handshake, so Alice uses it for messages to Bob
+	sendTestHandshake(t, bob, alice)
+	codec := alice.codecFor("moonshard", bob.peerID.String())
+	if codec.Name() != "reversed" {
+		t.Fatal("custom codec is not negotiated")
+	}
+	message := &api.BaseMessage{Flag: api.FlagGenericMessage, Body: "hello", To: bob.peerID.String(), ID: newMessageID()}
+	data, err := codec.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codecForData(data).Name() != "reversed" {
+		t.Fatal("custom codec is not detected by data")
+	}
+	var received []TextMessage
+	msg := pubsub.Message{Message: &pb.Message{From: []byte(alice.peerID), Data: data}}
+	bob.HandleIncomingMessage("moonshard", msg, func(textMessage TextMessage) {
+		received = append(received, textMessage)
+	}, nil, nil)
+	if len(received) != 1 || received[0].Body != "hello" {
+		t.Fatal("message encoded with custom codec is not decoded")
+	}
+}
+
+func TestProtobufIsStandard(t *testing.T) {
+	message := &api.BaseMessage{Body: "hi", Flag: api.FlagTopicsRequest}
+	data, err := ProtobufCodec.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// body = 1 (length-delimited), flag = 3 (varint), as described in api/p2chat.proto
+	expected := []byte{0x0a, 0x02, 'h', 'i', 0x18, byte(api.FlagTopicsRequest)}
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatalf("protobuf encoding %x doesn't match standard encoding %x", data, expected)
+	}
+}
+
+var protoSchemaField = regexp.MustCompile(`^\s*(?:repeated\s+)?\w+\s+(\w+)\s*=\s*(\d+);`)
+
+// Returns fields (name => number) of messages described in api/p2chat.proto
+func readProtoSchema(t *testing.T) map[string]map[string]uint64 {
+	data, err := ioutil.ReadFile(filepath.Join("..", "api", "p2chat.proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := make(map[string]map[string]uint64)
+	var fields map[string]uint64
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "message ") {
+			fields = make(map[string]uint64)
+			schema[strings.Fields(line)[1]] = fields
+		} else if match := protoSchemaField.FindStringSubmatch(line); match != nil && fields != nil {
+			number, _ := strconv.ParseUint(match[2], 10, 64)
+			fields[match[1]] = number
+		}
+	}
+	return schema
+}
+
+func TestProtoSchemaMatchesTags(t *testing.T) {
+	schema := readProtoSchema(t)
+	messages := []api.Message{
+		&api.BaseMessage{}, &api.GetTopicsRespondMessage{}, &api.ReceiptMessage{}, &api.SignalMessage{},
+		&api.EditMessage{}, &api.ReactionMessage{}, &api.FileOfferMessage{}, &api.FileResponseMessage{},
+		&api.FragmentMessage{}, &api.CompressedMessage{}, &api.HandshakeMessage{}, &api.EncryptedMessage{},
+		&api.SenderKeyMessage{}, &api.GroupEncryptedMessage{}, &api.RatchetMessage{}, &api.IdentityMessage{},
+		&api.KeyRotationMessage{}, &api.KeyRevocationMessage{}, &api.VerificationMessage{}, &api.TopicInviteMessage{},
+	}
+	if len(schema) != len(messages) {
+		t.Fatalf("schema describes %d messages, but there are %d message types", len(schema), len(messages))
+	}
+	for _, message := range messages {
+		messageType := reflect.TypeOf(message).Elem()
+		fields, ok := schema[messageType.Name()]
+		if !ok {
+			t.Fatalf("%s is not described in the schema", messageType.Name())
+		}
+		tagged := protoFields(messageType)
+		if len(tagged) != len(fields) {
+			t.Fatalf("%s: schema has %d fields, but %d are tagged", messageType.Name(), len(fields), len(tagged))
+		}
+		for _, field := range tagged {
+			tag := messageType.FieldByIndex(field.index).Tag.Get("protobuf")
+			name := tag[strings.Index(tag, "name=")+len("name="):]
+			if fields[name] != field.number {
+				t.Fatalf("%s: field %s is %d in the schema, but %d in the tag", messageType.Name(), name, fields[name], field.number)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+// DefaultCompressionThreshold is the size of encoded message, above which it is compressed
+const DefaultCompressionThreshold = 1024
+
+// Sets the size of encoded message, above which it is compressed. Zero or negative size disables compression
+func (h *Handler) SetCompressionThreshold(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.compressAbove = size
+}
+
+// Wraps encoded message into compressed one, if it's large enough and receivers are able to decompress it.
+// Returns original data if compression isn't possible or doesn't make the message smaller
+func (h *Handler) compress(topic string, codec Codec, base *api.BaseMessage, sendData []byte) []byte {
+	h.mu.RLock()
+	threshold := h.compressAbove
+	h.mu.RUnlock()
+	if threshold <= 0 || len(sendData) <= threshold || !h.receiversSupport(topic, base.To, api.CapabilityGzip) {
+		return sendData
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(sendData); err != nil {
+		log.Println(err.Error())
+		return sendData
+	}
+	if err := writer.Close(); err != nil {
+		log.Println(err.Error())
+		return sendData
+	}
+
+	compressed := &api.CompressedMessage{
+		BaseMessage: api.BaseMessage{
+			To:           base.To,
+			Flag:         api.FlagCompressed,
+			FromMatrixID: base.FromMatrixID,
+			Version:      api.ProtocolVersion,
+			ID:           newMessageID(),
+			Timestamp:    base.Timestamp,
+		},
+		Compression: api.CompressionGzip,
+		Data:        buf.Bytes(),
+	}
+	compressedData, err := codec.Marshal(compressed)
+	if err != nil {
+		log.Println(err.Error())
+		return sendData
+	}
+	if len(compressedData) >= len(sendData) {
+		return sendData
+	}
+	return compressedData
+}
+
+// Decompresses data, refusing to produce more than maxReassembledSize bytes
+func decompress(compression string, data []byte) ([]byte, error) {
+	if compression != api.CompressionGzip {
+		return nil, errors.New("unsupported compression " + compression)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, maxReassembledSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxReassembledSize {
+		return nil, errors.New("decompressed message is too large")
+	}
+	return decompressed, nil
+}
+
+func newCompressedMessage() api.Message {
+	return &api.CompressedMessage{}
+}
+
+// Getting compressed message, handling it after decompression
+func handleCompressed(h *Handler, ctx *MessageContext, message api.Message) {
+	compressed := message.(*api.CompressedMessage)
+	data, err := decompress(compressed.Compression, compressed.Data)
+	if err != nil {
+		log.Printf("Dropping compressed message from %s: %s\n", ctx.FromPeerID.String(), err.Error())
+		return
+	}
+	h.handleInnerData(ctx, data)
+}
@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+func TestCompression(t *testing.T) {
+	sender, receiver := newTestHandler(t), newTestHandler(t)
+	sender.peerInfo[receiver.peerID] = newPeerInfo(api.ProtocolVersion, api.DefaultCapabilities)
+	body := strings.Repeat("compressible ", 1000)
+
+	for _, codec := range []Codec{JSONCodec, ProtobufCodec} {
+		message := &api.BaseMessage{
+			Body:      body,
+			To:        receiver.peerID.String(),
+			Flag:      api.FlagGenericMessage,
+			Version:   api.ProtocolVersion,
+			ID:        newMessageID(),
+			Timestamp: nowMillis(),
+		}
+		data, err := codec.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed := sender.compress("moonshard", codec, message, data)
+		if len(compressed) >= len(data) {
+			t.Fatalf("%s: message is not compressed", codec.Name())
+		}
+
+		var received *TextMessage
+		msg := pubsub.Message{Message: &pb.Message{From: []byte(sender.peerID), Data: compressed}}
+		receiver.HandleIncomingMessage("moonshard", msg, func(textMessage TextMessage) {
+			received = &textMessage
+		}, nil, nil)
+		if received == nil || received.Body != body || received.ID != message.ID {
+			t.Fatalf("%s: compressed message is not delivered", codec.Name())
+		}
+	}
+
+	// Compression is not used for peers which haven't announced it
+	delete(sender.peerInfo, receiver.peerID)
+	message := &api.BaseMessage{Body: body, To: receiver.peerID.String()}
+	data, _ := JSONCodec.Marshal(message)
+	if compressed := sender.compress("moonshard", JSONCodec, message, data); len(compressed) != len(data) {
+		t.Fatal("message is compressed for peer without the capability")
+	}
+}
+
+func TestWrapperDepth(t *testing.T) {
+	sender, receiver := newTestHandler(t), newTestHandler(t)
+	for wrappers := 1; wrappers <= maxWrapperDepth+1; wrappers++ {
+		message := &api.BaseMessage{
+			Body:      "hello",
+			To:        receiver.peerID.String(),
+			Flag:      api.FlagGenericMessage,
+			Version:   api.ProtocolVersion,
+			ID:        newMessageID(),
+			Timestamp: nowMillis(),
+		}
+		data, err := JSONCodec.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < wrappers; i++ {
+			var buf bytes.Buffer
+			writer := gzip.NewWriter(&buf)
+			writer.Write(data)
+			writer.Close()
+			compressed := &api.CompressedMessage{
+				BaseMessage: api.BaseMessage{To: message.To, Flag: api.FlagCompressed, Version: api.ProtocolVersion, ID: newMessageID()},
+				Compression: api.CompressionGzip,
+				Data:        buf.Bytes(),
+			}
+			if data, err = JSONCodec.Marshal(compressed); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		received := false
+		msg := pubsub.Message{Message: &pb.Message{From: []byte(sender.peerID), Data: data}}
+		receiver.HandleIncomingMessage("moonshard", msg, func(textMessage TextMessage) {
+			received = true
+		}, nil, nil)
+		if received != (wrappers <= maxWrapperDepth) {
+			t.Fatalf("message carried by %d wrappers: delivered = %t", wrappers, received)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+// Content is typed content of the text message, application switches on its concrete type.
+// Every content has plain text fallback, which is sent in the body for clients which don't know the type
+type Content interface {
+	ContentType() string
+}
+
+// PlainContent is regular text, it is also used for unknown or malformed content types
+type PlainContent struct {
+	Text string `json:"text"`
+}
+
+// MarkdownContent is text with markdown markup, its source is readable as plain text as well
+type MarkdownContent struct {
+	Markdown string `json:"markdown"`
+}
+
+// JSONContent is structured application data
+type JSONContent struct {
+	Fallback string          `json:"fallback"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// AttachmentContent refers to the file, which is offered in the same topic
+type AttachmentContent struct {
+	Fallback string `json:"fallback"`
+	api.Attachment
+}
+
+func (PlainContent) ContentType() string {
+	return api.ContentTypePlain
+}
+
+func (MarkdownContent) ContentType() string {
+	return api.ContentTypeMarkdown
+}
+
+func (JSONContent) ContentType() string {
+	return api.ContentTypeJSON
+}
+
+func (AttachmentContent) ContentType() string {
+	return api.ContentTypeAttachment
+}
+
+// Returns body (plain text fallback) and payload of the content
+func encodeContent(content Content) (string, string, error) {
+	switch c := content.(type) {
+	case PlainContent:
+		return c.Text, "", nil
+	case MarkdownContent:
+		return c.Markdown, "", nil
+	case JSONContent:
+		if !json.Valid(c.Data) {
+			return "", "", fmt.Errorf("content is not valid JSON")
+		}
+		return c.Fallback, string(c.Data), nil
+	case AttachmentContent:
+		payload, err := json.Marshal(c.Attachment)
+		if err != nil {
+			return "", "", err
+		}
+		fallback := c.Fallback
+		if fallback == "" {
+			fallback = fmt.Sprintf("[file] %s (%d bytes)", c.Name, c.Size)
+		}
+		return fallback, string(payload), nil
+	}
+	return "", "", fmt.Errorf("unknown content type %T", content)
+}
+
+// Decodes content of incoming message, falling back to plain text if the type is unknown or payload is broken
+func decodeContent(message *api.BaseMessage) Content {
+	switch message.ContentType {
+	case api.ContentTypeMarkdown:
+		return MarkdownContent{Markdown: message.Body}
+	case api.ContentTypeJSON:
+		if json.Valid([]byte(message.Payload)) {
+			return JSONContent{Fallback: message.Body, Data: json.RawMessage(message.Payload)}
+		}
+	case api.ContentTypeAttachment:
+		attachment := api.Attachment{}
+		if err := json.Unmarshal([]byte(message.Payload), &attachment); err == nil && attachment.FileID != "" {
+			return AttachmentContent{Fallback: message.Body, Attachment: attachment}
+		}
+	}
+	return PlainContent{Text: message.Body}
+}
+
+// Sends message with typed content to the topic, returns ID of the sent message
+func (h *Handler) SendContent(topic string, content Content) (string, error) {
+	body, payload, err := encodeContent(content)
+	if err != nil {
+		return "", err
+	}
+	message := &api.BaseMessage{
+		Body:         body,
+		To:           "",
+		Flag:         api.FlagGenericMessage,
+		FromMatrixID: h.matrixID,
+		ContentType:  content.ContentType(),
+		Payload:      payload,
+	}
+
+	h.sendTextMessage(topic, message)
+	return message.ID, nil
+}
+
+// Offers the file to the topic and sends message with attachment, which refers to it. Returns ID of the message
+func (h *Handler) SendAttachment(topic string, path string) (string, error) {
+	fileID, err := h.OfferFile(topic, path, "")
+	if err != nil {
+		return "", err
+	}
+
+	h.files.mu.Lock()
+	offer := h.files.outgoing[fileID].offer
+	h.files.mu.Unlock()
+	return h.SendContent(topic, AttachmentContent{
+		Attachment: api.Attachment{
+			FileID:   offer.FileID,
+			Name:     offer.Name,
+			Size:     offer.Size,
+			Hash:     offer.Hash,
+			MimeType: offer.MimeType,
+		},
+	})
+}
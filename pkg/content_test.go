@@ -0,0 +1,41 @@
+package pkg
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+func TestContentRoundTrip(t *testing.T) {
+	contents := []Content{
+		PlainContent{Text: "hello"},
+		MarkdownContent{Markdown: "**hello**"},
+		JSONContent{Fallback: "poll", Data: json.RawMessage(`{"question":"lunch?"}`)},
+		AttachmentContent{Fallback: "cat.png", Attachment: api.Attachment{FileID: "1", Name: "cat.png", Size: 42}},
+	}
+	for _, content := range contents {
+		body, payload, err := encodeContent(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := &api.BaseMessage{Body: body, ContentType: content.ContentType(), Payload: payload}
+		if decoded := decodeContent(message); !reflect.DeepEqual(decoded, content) {
+			t.Fatalf("decoded content %#v doesn't match original %#v", decoded, content)
+		}
+	}
+}
+
+func TestContentFallback(t *testing.T) {
+	messages := []*api.BaseMessage{
+		{Body: "hello", ContentType: "application/x-unknown", Payload: "???"},
+		{Body: "hello", ContentType: api.ContentTypeJSON, Payload: "{broken"},
+		{Body: "hello"},
+	}
+	for _, message := range messages {
+		if content := decodeContent(message); content != (PlainContent{Text: "hello"}) {
+			t.Fatalf("message %+v is decoded as %#v instead of plain text", message, content)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DefaultDedupWindow is how long handler remembers IDs of delivered messages
+const DefaultDedupWindow = 10 * time.Minute
+
+// Generates random ID for outgoing message
+func newMessageID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Returns current time in the format of api.BaseMessage.Timestamp
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// seenCache remembers message IDs for some window of time
+type seenCache struct {
+	mu          sync.Mutex
+	window      time.Duration
+	seen        map[string]time.Time
+	lastCleanup time.Time
+}
+
+func newSeenCache(window time.Duration) *seenCache {
+	return &seenCache{
+		window:      window,
+		seen:        make(map[string]time.Time),
+		lastCleanup: time.Now(),
+	}
+}
+
+// Marks message as seen and returns whether it has already been seen within the window
+func (c *seenCache) markSeen(from peer.ID, id string) bool {
+	// IDs are unique only per sender, so peer can't suppress messages of others by reusing their IDs
+	key := from.String() + "/" + id
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastCleanup) > c.window {
+		for seenKey, seenAt := range c.seen {
+			if now.Sub(seenAt) > c.window {
+				delete(c.seen, seenKey)
+			}
+		}
+		c.lastCleanup = now
+	}
+
+	if seenAt, ok := c.seen[key]; ok && now.Sub(seenAt) <= c.window {
+		return true
+	}
+	c.seen[key] = now
+	return false
+}
+
+func (c *seenCache) setWindow(window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.window = window
+}
+
+// Sets how long delivered message IDs are remembered to drop duplicates
+func (h *Handler) SetDedupWindow(window time.Duration) {
+	h.seenMessages.setWindow(window)
+}
+
+// Sets protocol version, ID and timestamp of outgoing message, unless they are already set
+func stampMessage(base *api.BaseMessage) {
+	base.Version = api.ProtocolVersion
+	if base.ID == "" {
+		base.ID = newMessageID()
+	}
+	if base.Timestamp == 0 {
+		base.Timestamp = nowMillis()
+	}
+}
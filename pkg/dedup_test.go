@@ -0,0 +1,29 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestSeenCache(t *testing.T) {
+	cache := newSeenCache(time.Hour)
+	alice, bob := peer.ID("alice"), peer.ID("bob")
+
+	if cache.markSeen(alice, "1") {
+		t.Fatal("new message is reported as duplicate")
+	}
+	if !cache.markSeen(alice, "1") {
+		t.Fatal("duplicate is not detected")
+	}
+	if cache.markSeen(bob, "1") {
+		t.Fatal("message of another sender with the same ID is reported as duplicate")
+	}
+
+	cache.setWindow(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if cache.markSeen(alice, "1") {
+		t.Fatal("message is remembered after the window has passed")
+	}
+}
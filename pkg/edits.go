@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"errors"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+// EditEvent is emitted when author of the message changes its body
+type EditEvent struct {
+	Topic      string
+	FromPeerID string
+	MessageID  string
+	Body       string
+	// Timestamp of the edit
+	Timestamp int64
+}
+
+// RedactEvent is emitted when author of the message deletes it
+type RedactEvent struct {
+	Topic      string
+	FromPeerID string
+	MessageID  string
+}
+
+var errNotOurMessage = errors.New("message is not found or is not sent by us")
+
+// Replaces body of our previously sent message
+func (h *Handler) EditMessage(topic string, messageID string, body string) error {
+	if err := h.requireSupport(topic, "", api.CapabilityEdits); err != nil {
+		return err
+	}
+	ok := h.history.update(topic, h.peerID, messageID, func(entry *historyEntry) {
+		entry.message.Body = body
+	})
+	if !ok {
+		return errNotOurMessage
+	}
+	h.sendEdit(topic, api.FlagEdit, messageID, body)
+	return nil
+}
+
+// Deletes our previously sent message
+func (h *Handler) RedactMessage(topic string, messageID string) error {
+	if err := h.requireSupport(topic, "", api.CapabilityEdits); err != nil {
+		return err
+	}
+	ok := h.history.update(topic, h.peerID, messageID, func(entry *historyEntry) {
+		entry.redacted = true
+	})
+	if !ok {
+		return errNotOurMessage
+	}
+	h.sendEdit(topic, api.FlagRedact, messageID, "")
+	return nil
+}
+
+func (h *Handler) sendEdit(topic string, flag int, messageID string, body string) {
+	editMessage := &api.EditMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         body,
+			To:           "",
+			Flag:         flag,
+			FromMatrixID: h.matrixID,
+		},
+		TargetID: messageID,
+	}
+
+	h.sendMessageToTopic(topic, editMessage)
+}
+
+func newEditMessage() api.Message {
+	return &api.EditMessage{}
+}
+
+// Getting edit or redaction, applying it only if the sender (verified by pubsub signature) is the author of the message
+func handleEdit(h *Handler, ctx *MessageContext, message api.Message) {
+	editMessage := message.(*api.EditMessage)
+	ok := h.history.update(ctx.Topic, ctx.FromPeerID, editMessage.TargetID, func(entry *historyEntry) {
+		if editMessage.Flag == api.FlagRedact {
+			entry.redacted = true
+		} else {
+			entry.message.Body = editMessage.Body
+		}
+	})
+	if !ok {
+		return // Unknown message or the sender is not its author
+	}
+
+	if editMessage.Flag == api.FlagRedact {
+		h.emitEvent(&RedactEvent{
+			Topic:      ctx.Topic,
+			FromPeerID: ctx.FromPeerID.String(),
+			MessageID:  editMessage.TargetID,
+		})
+		return
+	}
+	h.emitEvent(&EditEvent{
+		Topic:      ctx.Topic,
+		FromPeerID: ctx.FromPeerID.String(),
+		MessageID:  editMessage.TargetID,
+		Body:       editMessage.Body,
+		Timestamp:  editMessage.Timestamp,
+	})
+}
@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+func TestEditOnlyByAuthor(t *testing.T) {
+	handler := newTestHandler(t)
+	_, author := newTestPeer(t)
+	_, stranger := newTestPeer(t)
+	var events []Event
+	handler.SetEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+
+	original := &api.BaseMessage{Body: "helo", Flag: api.FlagGenericMessage, ID: newMessageID()}
+	handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, author, JSONCodec, original), func(TextMessage) {}, nil, nil)
+
+	edit := &api.EditMessage{
+		BaseMessage: api.BaseMessage{Body: "hacked", Flag: api.FlagEdit, ID: newMessageID()},
+		TargetID:    original.ID,
+	}
+	handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, stranger, JSONCodec, edit), nil, nil, nil)
+	if len(events) != 0 {
+		t.Fatal("edit from another peer is accepted")
+	}
+
+	edit.ID = newMessageID()
+	edit.Body = "hello"
+	handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, author, JSONCodec, edit), nil, nil, nil)
+	if len(events) != 1 {
+		t.Fatal("edit from author is rejected")
+	}
+	if event := events[0].(*EditEvent); event.MessageID != original.ID || event.Body != "hello" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if message, _ := handler.GetMessage(original.ID); message.Body != "hello" {
+		t.Fatal("edit is not applied to the history")
+	}
+
+	redact := &api.EditMessage{
+		BaseMessage: api.BaseMessage{Flag: api.FlagRedact, ID: newMessageID()},
+		TargetID:    original.ID,
+	}
+	handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, author, ProtobufCodec, redact), nil, nil, nil)
+	if _, ok := events[1].(*RedactEvent); !ok {
+		t.Fatal("redaction is not delivered")
+	}
+	if _, ok := handler.GetMessage(original.ID); ok {
+		t.Fatal("redacted message is still in the history")
+	}
+}
@@ -0,0 +1,289 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Signed payloads start with the prefix of their context, so the signature made for one context can't be reused in another.
+// Prefixes must be unique
+const (
+	// Encryption key announced in the handshake
+	encryptionKeyPrefix = "p2chat encryption key:"
+	// Prekey of ratchet sessions
+	preKeyPrefix = "p2chat signed prekey:"
+	// Matrix ID claim, it's signed by both libp2p and Matrix keys
+	identityClaimPrefix = "p2chat identity claim:"
+	// Invite to private topic, it's signed by the topic creator
+	topicInvitePrefix = "p2chat topic invite:"
+	// Key rotation and revocation announcements
+	keyRotationPrefix   = "p2chat key rotation:"
+	keyRevocationPrefix = "p2chat key revocation:"
+)
+
+// keyring holds our keys and keys which peers announced in the handshake.
+// Lock order is sessions -> keys: keyring may be locked while sessions are locked, but not the other way round
+type keyring struct {
+	mu           sync.RWMutex
+	identityKey  crypto.PrivKey
+	privateKey   *[32]byte
+	publicKey    *[32]byte
+	keySignature []byte
+	identityKeys map[peer.ID]crypto.PubKey
+	peerKeys     map[peer.ID]*[32]byte
+	preKeys      map[peer.ID][]byte
+}
+
+func newKeyring() *keyring {
+	return &keyring{
+		identityKeys: make(map[peer.ID]crypto.PubKey),
+		peerKeys:     make(map[peer.ID]*[32]byte),
+		preKeys:      make(map[peer.ID][]byte),
+	}
+}
+
+// Returns encryption key of the peer, nil if the peer haven't announced it
+func (k *keyring) peerKey(peerID peer.ID) *[32]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.peerKeys[peerID]
+}
+
+// Returns signed prekey of the peer, nil if the peer haven't announced it
+func (k *keyring) peerPreKey(peerID peer.ID) []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.preKeys[peerID]
+}
+
+// Sets private key of our libp2p identity. Encryption key is derived from it and announced in the handshake
+func (h *Handler) SetIdentityKey(identityKey crypto.PrivKey) error {
+	peerID, err := peer.IDFromPrivateKey(identityKey)
+	if err != nil {
+		return err
+	}
+	if peerID != h.peerID {
+		return errors.New("identity key doesn't match peer ID of the handler")
+	}
+	rawKey, err := crypto.MarshalPrivateKey(identityKey)
+	if err != nil {
+		return err
+	}
+
+	privateKey, publicKey := new([32]byte), new([32]byte)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, rawKey, nil, []byte(encryptionKeyPrefix)), privateKey[:]); err != nil {
+		return err
+	}
+	curve25519.ScalarBaseMult(publicKey, privateKey)
+	signature, err := identityKey.Sign(append([]byte(encryptionKeyPrefix), publicKey[:]...))
+	if err != nil {
+		return err
+	}
+
+	h.keys.mu.Lock()
+	h.keys.identityKey = identityKey
+	h.keys.privateKey = privateKey
+	h.keys.publicKey = publicKey
+	h.keys.keySignature = signature
+	h.keys.mu.Unlock()
+	h.signIdentityClaim()
+	return nil
+}
+
+// Creates handshake message, announcing our keys if identity key is set
+func (h *Handler) newHandshake(flag int, toPeerID string) *api.HandshakeMessage {
+	handshake := &api.HandshakeMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			To:           toPeerID,
+			Flag:         flag,
+			FromMatrixID: h.matrixID,
+			Capabilities: append(append([]string{}, h.capabilities...), customCodecCapabilities()...),
+		},
+	}
+
+	// Prekey is read before locking the keyring, sessions mutex is never taken while keyring is locked
+	preKey, preKeySignature := h.currentPreKey()
+	h.keys.mu.RLock()
+	if h.keys.identityKey == nil {
+		h.keys.mu.RUnlock()
+		return handshake
+	}
+	identityKey, err := crypto.MarshalPublicKey(h.keys.identityKey.GetPublic())
+	if err != nil {
+		h.keys.mu.RUnlock()
+		log.Println(err.Error())
+		return handshake
+	}
+	handshake.IdentityKey = identityKey
+	handshake.EncryptionKey = h.keys.publicKey[:]
+	handshake.KeySignature = h.keys.keySignature
+	h.keys.mu.RUnlock()
+	handshake.PreKey, handshake.PreKeySignature = preKey, preKeySignature
+	return handshake
+}
+
+// Remembers keys announced in the handshake, if they are signed by the identity of the sender
+func (h *Handler) updatePeerKeys(peerID peer.ID, handshake *api.HandshakeMessage) {
+	if len(handshake.IdentityKey) == 0 {
+		return // Peer doesn't support encryption
+	}
+	identityKey, err := crypto.UnmarshalPublicKey(handshake.IdentityKey)
+	if err != nil {
+		log.Println("Malformed identity key from " + peerID.String())
+		return
+	}
+	if !peerID.MatchesPublicKey(identityKey) {
+		log.Println("Identity key doesn't match peer ID of " + peerID.String())
+		return
+	}
+	if len(handshake.EncryptionKey) != 32 {
+		log.Println("Malformed encryption key from " + peerID.String())
+		return
+	}
+	ok, err := identityKey.Verify(append([]byte(encryptionKeyPrefix), handshake.EncryptionKey...), handshake.KeySignature)
+	if err != nil || !ok {
+		log.Println("Invalid signature of encryption key from " + peerID.String())
+		return
+	}
+
+	var preKey []byte
+	if len(handshake.PreKey) == 32 {
+		ok, err = identityKey.Verify(append([]byte(preKeyPrefix), handshake.PreKey...), handshake.PreKeySignature)
+		if err == nil && ok {
+			preKey = handshake.PreKey
+		} else {
+			log.Println("Invalid signature of prekey from " + peerID.String())
+		}
+	}
+
+	encryptionKey := new([32]byte)
+	copy(encryptionKey[:], handshake.EncryptionKey)
+	h.keys.mu.Lock()
+	defer h.keys.mu.Unlock()
+	h.keys.identityKeys[peerID] = identityKey
+	h.keys.peerKeys[peerID] = encryptionKey
+	if preKey != nil {
+		h.keys.preKeys[peerID] = preKey
+	}
+}
+
+// Sends text message, which only the peer is able to read. Returns ID of the message
+func (h *Handler) SendDirect(peerID peer.ID, body string) (string, error) {
+	message := &api.BaseMessage{
+		Body:         body,
+		To:           peerID.String(),
+		Flag:         api.FlagGenericMessage,
+		FromMatrixID: h.matrixID,
+	}
+	encrypted, err := h.encryptDirect(peerID, h.codecFor(h.serviceTopic, message.To), message)
+	if err != nil {
+		return "", err
+	}
+
+	h.sendMessageToServiceTopic(encrypted)
+	h.history.add(h.peerID, TextMessage{
+		Topic:        h.serviceTopic,
+		Body:         message.Body,
+		FromPeerID:   h.peerID.String(),
+		FromMatrixID: h.matrixID,
+		ID:           message.ID,
+		Timestamp:    message.Timestamp,
+		Encrypted:    true,
+	})
+	return message.ID, nil
+}
+
+// Encrypts message for the peer in double ratchet session if both peers support it, sealing it with the static keys otherwise
+func (h *Handler) encryptDirect(toPeerID peer.ID, codec Codec, message api.Message) (api.Message, error) {
+	if h.usesSession(toPeerID) {
+		return h.encryptInSession(toPeerID, codec, message)
+	}
+	return h.encrypt(toPeerID, codec, message)
+}
+
+// Encodes message and seals it for the peer
+func (h *Handler) encrypt(toPeerID peer.ID, codec Codec, message api.Message) (*api.EncryptedMessage, error) {
+	h.keys.mu.RLock()
+	privateKey := h.keys.privateKey
+	h.keys.mu.RUnlock()
+	if privateKey == nil {
+		return nil, errors.New("identity key is not set")
+	}
+	peerKey := h.keys.peerKey(toPeerID)
+	if peerKey == nil {
+		return nil, errors.New("encryption key of the peer is unknown")
+	}
+
+	base := message.Base()
+	stampMessage(base)
+	data, err := codec.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := new([24]byte)
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return &api.EncryptedMessage{
+		BaseMessage: api.BaseMessage{
+			To:           toPeerID.String(),
+			Flag:         api.FlagEncrypted,
+			FromMatrixID: base.FromMatrixID,
+			Timestamp:    base.Timestamp,
+		},
+		Nonce:      nonce[:],
+		Ciphertext: box.Seal(nil, data, nonce, peerKey, privateKey),
+	}, nil
+}
+
+func newEncryptedMessage() api.Message {
+	return &api.EncryptedMessage{}
+}
+
+// Getting encrypted message, handling it after decryption
+func handleEncrypted(h *Handler, ctx *MessageContext, message api.Message) {
+	encrypted := message.(*api.EncryptedMessage)
+	h.keys.mu.RLock()
+	privateKey := h.keys.privateKey
+	h.keys.mu.RUnlock()
+	peerKey := h.keys.peerKey(ctx.FromPeerID)
+	if privateKey == nil || peerKey == nil || len(encrypted.Nonce) != 24 {
+		log.Println("Unable to decrypt message from " + ctx.FromPeerID.String())
+		return
+	}
+
+	nonce := new([24]byte)
+	copy(nonce[:], encrypted.Nonce)
+	data, ok := box.Open(nil, encrypted.Ciphertext, nonce, peerKey, privateKey)
+	if !ok {
+		log.Println("Failed to decrypt message from " + ctx.FromPeerID.String())
+		return
+	}
+
+	h.handleDecrypted(ctx, data)
+}
+
+// Handles decrypted direct message, it must be addressed to us as well
+func (h *Handler) handleDecrypted(ctx *MessageContext, data []byte) {
+	header := &api.MessageHeader{}
+	if err := codecForData(data).Unmarshal(data, header); err != nil || header.To != h.peerID.String() {
+		log.Println("Dropping encrypted message which is not addressed to us from " + ctx.FromPeerID.String())
+		return
+	}
+	innerCtx := *ctx
+	innerCtx.Encrypted = true
+	h.handleInnerData(&innerCtx, data)
+}
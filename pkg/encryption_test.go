@@ -0,0 +1,52 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+func TestDirectMessageEncryption(t *testing.T) {
+	alice, bob, eve := newTestKeyedHandler(t), newTestKeyedHandler(t), newTestKeyedHandler(t)
+	if _, err := alice.encrypt(bob.peerID, JSONCodec, &api.BaseMessage{}); err == nil {
+		t.Fatal("message is encrypted without knowing the key of the peer")
+	}
+
+	// Exchanging keys
+	sendTestHandshake(t, alice, bob)
+	sendTestHandshake(t, bob, alice)
+	sendTestHandshake(t, alice, eve)
+
+	for _, codec := range []Codec{JSONCodec, ProtobufCodec} {
+		message := &api.BaseMessage{Body: "secret", To: bob.peerID.String(), Flag: api.FlagGenericMessage}
+		encrypted, err := alice.encrypt(bob.peerID, codec, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var received *TextMessage
+		handleTextMessage := func(textMessage TextMessage) {
+			received = &textMessage
+		}
+		eve.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, codec, encrypted), handleTextMessage, nil, nil)
+		if received != nil {
+			t.Fatalf("%s: message is decrypted by another peer", codec.Name())
+		}
+		bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, codec, encrypted), handleTextMessage, nil, nil)
+		if received == nil || received.Body != "secret" || !received.Encrypted {
+			t.Fatalf("%s: encrypted message is not delivered", codec.Name())
+		}
+	}
+}
+
+func TestForgedEncryptionKey(t *testing.T) {
+	alice, bob, mallory := newTestKeyedHandler(t), newTestKeyedHandler(t), newTestKeyedHandler(t)
+
+	// Mallory announces own encryption key on behalf of Alice
+	handshake := mallory.newHandshake(api.FlagHandshakeRespond, bob.peerID.String())
+	handshake.Timestamp = nowMillis()
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, JSONCodec, handshake), nil, nil, nil)
+	if bob.keys.peerKey(alice.peerID) != nil {
+		t.Fatal("encryption key signed by another identity is accepted")
+	}
+}
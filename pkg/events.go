@@ -0,0 +1,21 @@
+package pkg
+
+// Event is a notification for the application about anything except regular text messages.
+// Concrete types of events are declared next to the features which emit them (e.g. *ReceiptEvent)
+type Event interface{}
+
+// Sets callback which receives events of the handler
+func (h *Handler) SetEventHandler(handleEvent func(Event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handleEvent = handleEvent
+}
+
+func (h *Handler) emitEvent(event Event) {
+	h.mu.RLock()
+	handleEvent := h.handleEvent
+	h.mu.RUnlock()
+	if handleEvent != nil {
+		handleEvent(event)
+	}
+}
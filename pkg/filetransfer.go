@@ -0,0 +1,586 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+const (
+	// fileChunkSize is the size of a single chunk in the transfer stream
+	fileChunkSize = 64 * 1024
+	// maxFileRequestSize limits the request at the beginning of the stream
+	maxFileRequestSize = 4096
+	// partialFileSuffix is added to files which are not downloaded completely yet
+	partialFileSuffix = ".part"
+	// fileOfferTimeout is how long offers are kept, if they are neither accepted nor declined
+	fileOfferTimeout = 24 * time.Hour
+	// maxIncomingOffers is how many pending offers we keep, new offers are dropped above it
+	maxIncomingOffers = 1000
+	// fileStreamTimeout is how long the transfer waits for the other side to read or write
+	fileStreamTimeout = time.Minute
+)
+
+// FileOfferEvent is emitted when peer offers us a file
+type FileOfferEvent struct {
+	Topic        string
+	FromPeerID   string
+	FromMatrixID string
+	FileID       string
+	Name         string
+	Size         int64
+	Hash         string
+	MimeType     string
+}
+
+// FileResponseEvent is emitted when peer accepts or declines our file offer
+type FileResponseEvent struct {
+	Topic      string
+	FromPeerID string
+	FileID     string
+	Accepted   bool
+}
+
+// FileProgressEvent is emitted while file is being downloaded (or uploaded) and once the transfer is finished
+type FileProgressEvent struct {
+	FileID string
+	// PeerID is the other side of the transfer
+	PeerID      string
+	Transferred int64
+	Size        int64
+	// Upload is set on the side of the sender
+	Upload bool
+	Done   bool
+	// Path of the downloaded file, it is set when download is done
+	Path string
+	Err  error
+}
+
+type outgoingFile struct {
+	path  string
+	offer api.FileOfferMessage
+}
+
+type incomingFile struct {
+	topic      string
+	fromPeerID peer.ID
+	offer      api.FileOfferMessage
+	// received is the time of the offer (or of accepting it), the offer expires after fileOfferTimeout
+	received time.Time
+}
+
+// Offers are kept per sender, so one peer can't replace the offer of another
+type fileKey struct {
+	fromPeerID peer.ID
+	fileID     string
+}
+
+// timeoutStream refreshes deadline before every read and write, so stalled peer doesn't hold the transfer forever
+type timeoutStream struct {
+	network.Stream
+}
+
+func (s timeoutStream) Read(p []byte) (int, error) {
+	s.SetReadDeadline(time.Now().Add(fileStreamTimeout))
+	return s.Stream.Read(p)
+}
+
+func (s timeoutStream) Write(p []byte) (int, error) {
+	s.SetWriteDeadline(time.Now().Add(fileStreamTimeout))
+	return s.Stream.Write(p)
+}
+
+// fileTransfer keeps offered files and serves FileTransferProtocol streams
+type fileTransfer struct {
+	mu       sync.Mutex
+	host     host.Host
+	dir      string
+	outgoing map[string]*outgoingFile
+	incoming map[fileKey]*incomingFile
+	// Downloads which are in progress, so the same file isn't downloaded twice at once
+	active map[fileKey]bool
+}
+
+func newFileTransfer() *fileTransfer {
+	return &fileTransfer{
+		outgoing: make(map[string]*outgoingFile),
+		incoming: make(map[fileKey]*incomingFile),
+		active:   make(map[fileKey]bool),
+	}
+}
+
+// Returns pending offer of the file. Must be called with locked mutex
+func (f *fileTransfer) findIncoming(fileID string, now time.Time) (fileKey, *incomingFile) {
+	for key, incoming := range f.incoming {
+		if key.fileID == fileID && (f.active[key] || now.Sub(incoming.received) < fileOfferTimeout) {
+			return key, incoming
+		}
+	}
+	return fileKey{}, nil
+}
+
+// Drops offers, which haven't been accepted in time. Must be called with locked mutex
+func (f *fileTransfer) expireOffers(now time.Time) {
+	for key, incoming := range f.incoming {
+		if !f.active[key] && now.Sub(incoming.received) >= fileOfferTimeout {
+			delete(f.incoming, key)
+		}
+	}
+}
+
+// Enables file transfer: files offered to us are downloaded into downloadDir,
+// and our offered files are served to other peers over the host
+func (h *Handler) EnableFileTransfer(thishost host.Host, downloadDir string) error {
+	if err := os.MkdirAll(downloadDir, 0700); err != nil {
+		return err
+	}
+
+	h.files.mu.Lock()
+	h.files.host = thishost
+	h.files.dir = downloadDir
+	h.files.mu.Unlock()
+
+	thishost.SetStreamHandler(protocol.ID(api.FileTransferProtocol), h.handleFileStream)
+	return nil
+}
+
+// Offers the file to the topic (or only to specific peer, if `to` is set). Returns ID of the offered file
+func (h *Handler) OfferFile(topic string, path string, to string) (string, error) {
+	if !h.fileTransferEnabled() {
+		return "", errors.New("file transfer is not enabled")
+	}
+	if err := h.requireSupport(topic, to, api.CapabilityFiles); err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	offer := &api.FileOfferMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			To:           to,
+			Flag:         api.FlagFileOffer,
+			FromMatrixID: h.matrixID,
+		},
+		FileID:   newMessageID(),
+		Name:     filepath.Base(path),
+		Size:     size,
+		Hash:     hex.EncodeToString(hash.Sum(nil)),
+		MimeType: mime.TypeByExtension(filepath.Ext(path)),
+	}
+	if offer.MimeType == "" {
+		offer.MimeType = "application/octet-stream"
+	}
+
+	h.files.mu.Lock()
+	h.files.outgoing[offer.FileID] = &outgoingFile{path: path, offer: *offer}
+	h.files.mu.Unlock()
+
+	h.sendMessageToTopic(topic, offer)
+	return offer.FileID, nil
+}
+
+// Stops serving the offered file
+func (h *Handler) RevokeFileOffer(fileID string) {
+	h.files.mu.Lock()
+	defer h.files.mu.Unlock()
+	delete(h.files.outgoing, fileID)
+}
+
+// Accepts the file offer and starts (or resumes) downloading the file. Progress is reported with FileProgressEvent
+func (h *Handler) AcceptFile(fileID string) error {
+	if !h.fileTransferEnabled() {
+		return errors.New("file transfer is not enabled")
+	}
+
+	h.files.mu.Lock()
+	key, incoming := h.files.findIncoming(fileID, time.Now())
+	if incoming != nil && h.files.active[key] {
+		h.files.mu.Unlock()
+		return errors.New("file is already being downloaded")
+	}
+	if incoming != nil {
+		h.files.active[key] = true
+		incoming.received = time.Now()
+	}
+	h.files.mu.Unlock()
+	if incoming == nil {
+		return errors.New("file offer is not found")
+	}
+
+	h.sendFileResponse(incoming, api.FlagFileAccept)
+	go h.downloadFile(incoming)
+	return nil
+}
+
+// Declines the file offer
+func (h *Handler) DeclineFile(fileID string) {
+	h.files.mu.Lock()
+	key, incoming := h.files.findIncoming(fileID, time.Now())
+	delete(h.files.incoming, key)
+	h.files.mu.Unlock()
+	if incoming != nil {
+		h.sendFileResponse(incoming, api.FlagFileDecline)
+	}
+}
+
+func (h *Handler) fileTransferEnabled() bool {
+	h.files.mu.Lock()
+	defer h.files.mu.Unlock()
+	return h.files.host != nil
+}
+
+func (h *Handler) sendFileResponse(incoming *incomingFile, flag int) {
+	respond := &api.FileResponseMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			To:           incoming.fromPeerID.String(),
+			Flag:         flag,
+			FromMatrixID: h.matrixID,
+		},
+		FileID: incoming.offer.FileID,
+	}
+
+	h.sendMessageToTopic(incoming.topic, respond)
+}
+
+func (h *Handler) downloadFile(incoming *incomingFile) {
+	offer := incoming.offer
+	path, err := h.receiveFile(incoming, func(transferred int64) {
+		h.emitEvent(&FileProgressEvent{
+			FileID:      offer.FileID,
+			PeerID:      incoming.fromPeerID.String(),
+			Transferred: transferred,
+			Size:        offer.Size,
+		})
+	})
+
+	key := fileKey{fromPeerID: incoming.fromPeerID, fileID: offer.FileID}
+	h.files.mu.Lock()
+	delete(h.files.active, key)
+	if err == nil {
+		delete(h.files.incoming, key)
+	}
+	h.files.mu.Unlock()
+
+	event := &FileProgressEvent{
+		FileID: offer.FileID,
+		PeerID: incoming.fromPeerID.String(),
+		Size:   offer.Size,
+		Done:   true,
+		Path:   path,
+		Err:    err,
+	}
+	if err == nil {
+		event.Transferred = offer.Size
+	}
+	h.emitEvent(event)
+}
+
+// Downloads file into partial file, resuming from its current size, and verifies the hash when it's complete
+func (h *Handler) receiveFile(incoming *incomingFile, progress func(int64)) (string, error) {
+	offer := incoming.offer
+	h.files.mu.Lock()
+	thishost, dir := h.files.host, h.files.dir
+	h.files.mu.Unlock()
+
+	partialPath := filepath.Join(dir, offer.FileID+partialFileSuffix)
+	partial, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer partial.Close()
+	offset, err := partial.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if offset > offer.Size {
+		// Partial file is broken, starting from scratch
+		if err = partial.Truncate(0); err != nil {
+			return "", err
+		}
+		offset, _ = partial.Seek(0, io.SeekStart)
+	}
+
+	if offset < offer.Size {
+		rawStream, err := thishost.NewStream(context.Background(), incoming.fromPeerID, protocol.ID(api.FileTransferProtocol))
+		if err != nil {
+			return "", err
+		}
+		defer rawStream.Close()
+		stream := timeoutStream{rawStream}
+
+		request, err := json.Marshal(&api.FileRequest{FileID: offer.FileID, Offset: offset})
+		if err != nil {
+			return "", err
+		}
+		writer := bufio.NewWriter(stream)
+		if err = writeFrame(writer, request); err != nil {
+			return "", err
+		}
+
+		reader := bufio.NewReader(stream)
+		buf := make([]byte, fileChunkSize)
+		for {
+			chunk, err := readFrame(reader, buf)
+			if err != nil {
+				return "", err
+			}
+			if len(chunk) == 0 {
+				break // End of the file
+			}
+			if offset+int64(len(chunk)) > offer.Size {
+				return "", errors.New("peer has sent more data than offered")
+			}
+			if _, err = partial.Write(chunk); err != nil {
+				return "", err
+			}
+			offset += int64(len(chunk))
+			progress(offset)
+		}
+	}
+	if offset != offer.Size {
+		return "", fmt.Errorf("transfer is interrupted at %d of %d bytes", offset, offer.Size)
+	}
+
+	if err = verifyFileHash(partialPath, offer.Hash); err != nil {
+		// The data is broken, resuming it makes no sense
+		os.Remove(partialPath)
+		return "", err
+	}
+
+	path := filepath.Join(dir, filepath.Base(offer.Name))
+	if _, err = os.Stat(path); err == nil || filepath.Base(offer.Name) == "." {
+		path = filepath.Join(dir, offer.FileID+"-"+filepath.Base(offer.Name))
+	}
+	if err = os.Rename(partialPath, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func verifyFileHash(path string, expected string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != expected {
+		return errors.New("hash of the downloaded file doesn't match the offer")
+	}
+	return nil
+}
+
+// Serves request for the offered file
+func (h *Handler) handleFileStream(rawStream network.Stream) {
+	defer rawStream.Close()
+	stream := timeoutStream{rawStream}
+	remotePeerID := stream.Conn().RemotePeer()
+
+	reader := bufio.NewReader(stream)
+	requestData, err := readFrame(reader, make([]byte, maxFileRequestSize))
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	request := &api.FileRequest{}
+	if err = json.Unmarshal(requestData, request); err != nil {
+		stream.Reset()
+		return
+	}
+
+	h.files.mu.Lock()
+	outgoing, ok := h.files.outgoing[request.FileID]
+	h.files.mu.Unlock()
+	if !ok || (outgoing.offer.To != "" && outgoing.offer.To != remotePeerID.String()) ||
+		request.Offset < 0 || request.Offset > outgoing.offer.Size {
+		log.Println("Rejecting file request from " + remotePeerID.String())
+		stream.Reset()
+		return
+	}
+
+	err = h.sendFile(stream, outgoing, request.Offset, func(transferred int64) {
+		h.emitEvent(&FileProgressEvent{
+			FileID:      request.FileID,
+			PeerID:      remotePeerID.String(),
+			Transferred: transferred,
+			Size:        outgoing.offer.Size,
+			Upload:      true,
+		})
+	})
+	event := &FileProgressEvent{
+		FileID: request.FileID,
+		PeerID: remotePeerID.String(),
+		Size:   outgoing.offer.Size,
+		Upload: true,
+		Done:   true,
+		Err:    err,
+	}
+	if err != nil {
+		stream.Reset()
+	} else {
+		event.Transferred = outgoing.offer.Size
+	}
+	h.emitEvent(event)
+}
+
+func (h *Handler) sendFile(stream io.Writer, outgoing *outgoingFile, offset int64, progress func(int64)) error {
+	file, err := os.Open(outgoing.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(stream)
+	buf := make([]byte, fileChunkSize)
+	remaining := outgoing.offer.Size - offset
+	for remaining > 0 {
+		n, err := file.Read(buf)
+		if int64(n) > remaining {
+			n = int(remaining)
+		}
+		if n > 0 {
+			if err := writeFrame(writer, buf[:n]); err != nil {
+				return err
+			}
+			remaining -= int64(n)
+			progress(outgoing.offer.Size - remaining)
+		}
+		if err == io.EOF {
+			return errors.New("file has been truncated since it was offered")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Empty frame marks the end of the file
+	return writeFrame(writer, nil)
+}
+
+// Frames are prefixed with their length as uvarint
+func writeFrame(writer *bufio.Writer, data []byte) error {
+	if _, err := writer.Write(appendVarint(nil, uint64(len(data)))); err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// Reads frame into buf, frames larger than buf are rejected
+func readFrame(reader *bufio.Reader, buf []byte) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(buf)) {
+		return nil, errors.New("frame is too large")
+	}
+	if _, err = io.ReadFull(reader, buf[:length]); err != nil {
+		return nil, err
+	}
+	return buf[:length], nil
+}
+
+func newFileOfferMessage() api.Message {
+	return &api.FileOfferMessage{}
+}
+
+func newFileResponseMessage() api.Message {
+	return &api.FileResponseMessage{}
+}
+
+// Getting file offer, remembering it until the application accepts or declines it
+func handleFileOffer(h *Handler, ctx *MessageContext, message api.Message) {
+	offer := message.(*api.FileOfferMessage)
+	// File ID is used in the name of partial file, so it must be exactly what newMessageID generates
+	if id, err := hex.DecodeString(offer.FileID); err != nil || len(id) != 16 || offer.Size < 0 {
+		return
+	}
+
+	now := time.Now()
+	key := fileKey{fromPeerID: ctx.FromPeerID, fileID: offer.FileID}
+	h.files.mu.Lock()
+	h.files.expireOffers(now)
+	if otherKey, other := h.files.findIncoming(offer.FileID, now); other != nil && otherKey != key {
+		h.files.mu.Unlock()
+		log.Println("Rejecting file offer from " + ctx.FromPeerID.String() + ", the file is already offered by another peer")
+		return
+	}
+	if _, ok := h.files.incoming[key]; !ok && len(h.files.incoming) >= maxIncomingOffers {
+		h.files.mu.Unlock()
+		log.Println("Too many pending file offers, dropping offer from " + ctx.FromPeerID.String())
+		return
+	}
+	h.files.incoming[key] = &incomingFile{
+		topic:      ctx.Topic,
+		fromPeerID: ctx.FromPeerID,
+		offer:      *offer,
+		received:   now,
+	}
+	h.files.mu.Unlock()
+
+	h.emitEvent(&FileOfferEvent{
+		Topic:        ctx.Topic,
+		FromPeerID:   ctx.FromPeerID.String(),
+		FromMatrixID: offer.FromMatrixID,
+		FileID:       offer.FileID,
+		Name:         offer.Name,
+		Size:         offer.Size,
+		Hash:         offer.Hash,
+		MimeType:     offer.MimeType,
+	})
+}
+
+// Getting response to our file offer
+func handleFileResponse(h *Handler, ctx *MessageContext, message api.Message) {
+	respond := message.(*api.FileResponseMessage)
+	h.files.mu.Lock()
+	_, ok := h.files.outgoing[respond.FileID]
+	h.files.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	h.emitEvent(&FileResponseEvent{
+		Topic:      ctx.Topic,
+		FromPeerID: ctx.FromPeerID.String(),
+		FileID:     respond.FileID,
+		Accepted:   respond.Flag == api.FlagFileAccept,
+	})
+}
@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestFileTransferResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tempDir, err := ioutil.TempDir("", "p2chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	senderHost, sender := newTestNetworkHandler(t, ctx)
+	receiverHost, receiver := newTestNetworkHandler(t, ctx)
+	if err = receiverHost.Connect(ctx, peer.AddrInfo{ID: senderHost.ID(), Addrs: senderHost.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	if err = sender.EnableFileTransfer(senderHost, filepath.Join(tempDir, "sender")); err != nil {
+		t.Fatal(err)
+	}
+	if err = receiver.EnableFileTransfer(receiverHost, filepath.Join(tempDir, "receiver")); err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*fileChunkSize+100)
+	rand.Read(content)
+	path := filepath.Join(tempDir, "photo.jpg")
+	if err = ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Sender learns that the receiver supports file transfer
+	sendTestHandshake(t, receiver, sender)
+	fileID, err := sender.OfferFile("moonshard", path, receiverHost.ID().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Offer is delivered over pubsub, here we pass it to receiver directly
+	hash := sha256.Sum256(content)
+	offer := &api.FileOfferMessage{
+		BaseMessage: api.BaseMessage{Flag: api.FlagFileOffer, To: receiverHost.ID().String(), ID: newMessageID()},
+		FileID:      fileID,
+		Name:        "photo.jpg",
+		Size:        int64(len(content)),
+		Hash:        hex.EncodeToString(hash[:]),
+		MimeType:    "image/jpeg",
+	}
+	events := make(chan Event, 100)
+	receiver.SetEventHandler(func(event Event) {
+		events <- event
+	})
+	receiver.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, senderHost.ID(), JSONCodec, offer), nil, nil, nil)
+	if event, ok := (<-events).(*FileOfferEvent); !ok || event.FileID != fileID {
+		t.Fatal("file offer is not delivered")
+	}
+
+	// Pretending that the previous download was interrupted
+	partialPath := filepath.Join(tempDir, "receiver", fileID+partialFileSuffix)
+	if err = ioutil.WriteFile(partialPath, content[:fileChunkSize+10], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = receiver.AcceptFile(fileID); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			progress, ok := event.(*FileProgressEvent)
+			if !ok || !progress.Done {
+				continue
+			}
+			if progress.Err != nil {
+				t.Fatal(progress.Err)
+			}
+			downloaded, err := ioutil.ReadFile(progress.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(downloaded, content) {
+				t.Fatal("downloaded file doesn't match the original")
+			}
+			return
+		case <-timeout:
+			t.Fatal("file is not downloaded in time")
+		}
+	}
+}
+
+func TestFileOffers(t *testing.T) {
+	receiver := newTestHandler(t)
+	_, alicePeerID := newTestPeer(t)
+	_, malloryPeerID := newTestPeer(t)
+	var offers []*FileOfferEvent
+	receiver.SetEventHandler(func(event Event) {
+		if offer, ok := event.(*FileOfferEvent); ok {
+			offers = append(offers, offer)
+		}
+	})
+	fileID := newMessageID()
+	offer := func(from peer.ID, name string) {
+		message := &api.FileOfferMessage{
+			BaseMessage: api.BaseMessage{Flag: api.FlagFileOffer, ID: newMessageID(), Timestamp: nowMillis()},
+			FileID:      fileID,
+			Name:        name,
+			Size:        100,
+		}
+		receiver.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, from, JSONCodec, message), nil, nil, nil)
+	}
+
+	offer(alicePeerID, "photo.jpg")
+	offer(malloryPeerID, "malware.exe")
+	if len(offers) != 1 || offers[0].FromPeerID != alicePeerID.String() {
+		t.Fatal("offer of the file is replaced by another peer")
+	}
+	receiver.files.mu.Lock()
+	_, incoming := receiver.files.findIncoming(fileID, time.Now())
+	receiver.files.mu.Unlock()
+	if incoming == nil || incoming.fromPeerID != alicePeerID || incoming.offer.Name != "photo.jpg" {
+		t.Fatal("offer of the file is replaced by another peer")
+	}
+
+	// Offer expires, if it's not accepted in time
+	receiver.files.mu.Lock()
+	incoming.received = time.Now().Add(-fileOfferTimeout)
+	receiver.files.mu.Unlock()
+	offer(malloryPeerID, "malware.exe")
+	receiver.files.mu.Lock()
+	_, incoming = receiver.files.findIncoming(fileID, time.Now())
+	pending := len(receiver.files.incoming)
+	receiver.files.mu.Unlock()
+	if pending != 1 || incoming == nil || incoming.fromPeerID != malloryPeerID {
+		t.Fatal("expired offer is kept")
+	}
+}
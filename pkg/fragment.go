@@ -0,0 +1,228 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// DefaultFragmentSize is the size of encoded message, above which it is sent in fragments
+	DefaultFragmentSize = 32 * 1024
+	// DefaultReassemblyTimeout is how long we wait for missing fragments of the message
+	DefaultReassemblyTimeout = 30 * time.Second
+	// DefaultReassemblyMemory limits total size of fragments, which are buffered for reassembly
+	DefaultReassemblyMemory = 16 * 1024 * 1024
+	// maxReassembledSize limits size of single reassembled message
+	maxReassembledSize = 4 * 1024 * 1024
+	// minFragmentChunk is the smallest data chunk of the fragment, which we send
+	minFragmentChunk = 1024
+	// maxFragmentCount limits number of fragments of single message
+	maxFragmentCount = maxReassembledSize / minFragmentChunk
+	// fragmentSlotSize is the memory, which is taken by slot of every expected fragment
+	fragmentSlotSize = int(unsafe.Sizeof([]byte(nil)))
+	// maxPendingPerPeer limits number of messages which are reassembled from single peer at once
+	maxPendingPerPeer = 8
+	// fragmentOverhead is reserved for the envelope of the fragment
+	fragmentOverhead = 512
+)
+
+type reassemblyBuffer struct {
+	from      peer.ID
+	fragments [][]byte
+	received  int
+	size      int
+	reserved  int
+	timer     *time.Timer
+}
+
+// reassembler collects fragments of messages until all of them are received
+type reassembler struct {
+	mu          sync.Mutex
+	timeout     time.Duration
+	memoryLimit int
+	used        int
+	buffers     map[string]*reassemblyBuffer
+	pending     map[peer.ID]int
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{
+		timeout:     DefaultReassemblyTimeout,
+		memoryLimit: DefaultReassemblyMemory,
+		buffers:     make(map[string]*reassemblyBuffer),
+		pending:     make(map[peer.ID]int),
+	}
+}
+
+// Adds fragment, returns data of the whole message when the last fragment is received
+func (r *reassembler) add(from peer.ID, fragment *api.FragmentMessage) ([]byte, error) {
+	if fragment.MessageID == "" || fragment.Count <= 1 || fragment.Count > maxFragmentCount ||
+		fragment.Index < 0 || fragment.Index >= fragment.Count || fragment.Count > maxReassembledSize/len(fragment.Data)+1 {
+		return nil, errors.New("malformed fragment")
+	}
+	key := from.String() + "/" + fragment.MessageID
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	buffer, ok := r.buffers[key]
+	if !ok {
+		if r.pending[from] >= maxPendingPerPeer {
+			return nil, errors.New("too many messages are being reassembled from the peer")
+		}
+		// Slots of the fragments are charged before they are allocated
+		reserved := fragment.Count * fragmentSlotSize
+		if r.used+reserved > r.memoryLimit {
+			return nil, errors.New("reassembly memory limit is exceeded")
+		}
+		buffer = &reassemblyBuffer{
+			from:      from,
+			fragments: make([][]byte, fragment.Count),
+			reserved:  reserved,
+		}
+		buffer.timer = time.AfterFunc(r.timeout, func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.buffers[key] == buffer {
+				r.remove(key, buffer)
+			}
+		})
+		r.buffers[key] = buffer
+		r.pending[from]++
+		r.used += reserved
+	}
+
+	if len(buffer.fragments) != fragment.Count {
+		r.remove(key, buffer)
+		return nil, errors.New("fragment count doesn't match previous fragments")
+	}
+	if buffer.fragments[fragment.Index] != nil {
+		return nil, nil // Duplicate
+	}
+	if buffer.size+len(fragment.Data) > maxReassembledSize || r.used+len(fragment.Data) > r.memoryLimit {
+		r.remove(key, buffer)
+		return nil, errors.New("reassembly memory limit is exceeded")
+	}
+	buffer.fragments[fragment.Index] = fragment.Data
+	buffer.received++
+	buffer.size += len(fragment.Data)
+	r.used += len(fragment.Data)
+
+	if buffer.received < len(buffer.fragments) {
+		return nil, nil
+	}
+	r.remove(key, buffer)
+	return bytes.Join(buffer.fragments, nil), nil
+}
+
+// Drops buffer and releases its memory. Must be called with locked mutex
+func (r *reassembler) remove(key string, buffer *reassemblyBuffer) {
+	buffer.timer.Stop()
+	delete(r.buffers, key)
+	r.used -= buffer.size + buffer.reserved
+	r.pending[buffer.from]--
+	if r.pending[buffer.from] <= 0 {
+		delete(r.pending, buffer.from)
+	}
+}
+
+// Sets the size of encoded message, above which it is sent in fragments
+func (h *Handler) SetFragmentSize(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fragmentSize = size
+}
+
+// Sets how long fragments are kept waiting for the rest of the message and how much memory they may take
+func (h *Handler) SetReassemblyLimits(timeout time.Duration, memoryLimit int) {
+	h.fragments.mu.Lock()
+	defer h.fragments.mu.Unlock()
+	h.fragments.timeout = timeout
+	h.fragments.memoryLimit = memoryLimit
+}
+
+// Checks whether the message is too large and its receivers are able to reassemble it
+func (h *Handler) needsFragmentation(topic string, to string, sendData []byte) bool {
+	h.mu.RLock()
+	fragmentSize := h.fragmentSize
+	h.mu.RUnlock()
+	if len(sendData) <= fragmentSize {
+		return false
+	}
+	return h.receiversSupport(topic, to, api.CapabilityFragments)
+}
+
+func (h *Handler) sendFragments(topic string, codec Codec, base *api.BaseMessage, sendData []byte) {
+	h.mu.RLock()
+	chunkSize := h.fragmentSize - fragmentOverhead
+	h.mu.RUnlock()
+	if codec.Name() == JSONCodec.Name() {
+		chunkSize = chunkSize * 3 / 4 // JSON encodes bytes with base64
+	}
+	if chunkSize < minFragmentChunk {
+		log.Println("Fragment size is too small")
+		return
+	}
+
+	count := (len(sendData) + chunkSize - 1) / chunkSize
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(sendData) {
+			end = len(sendData)
+		}
+		fragment := &api.FragmentMessage{
+			BaseMessage: api.BaseMessage{
+				Body:         "",
+				To:           base.To,
+				Flag:         api.FlagFragment,
+				FromMatrixID: base.FromMatrixID,
+				Version:      api.ProtocolVersion,
+				ID:           newMessageID(),
+				Timestamp:    base.Timestamp,
+			},
+			MessageID: base.ID,
+			Index:     i,
+			Count:     count,
+			Data:      sendData[i*chunkSize : end],
+		}
+		fragmentData, err := codec.Marshal(fragment)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		h.publish(topic, fragmentData)
+	}
+}
+
+func newFragmentMessage() api.Message {
+	return &api.FragmentMessage{}
+}
+
+// Getting fragment, handling the whole message when it's reassembled
+func handleFragment(h *Handler, ctx *MessageContext, message api.Message) {
+	fragment := message.(*api.FragmentMessage)
+	if ctx.depth > 0 {
+		// Fragments are reassembled per sender, so they can't be mixed with fragments carried by other messages
+		log.Println("Dropping fragment carried inside of another message from " + ctx.FromPeerID.String())
+		return
+	}
+	if len(fragment.Data) == 0 {
+		return
+	}
+	data, err := h.fragments.add(ctx.FromPeerID, fragment)
+	if err != nil {
+		log.Printf("Dropping fragment from %s: %s\n", ctx.FromPeerID.String(), err.Error())
+		return
+	}
+	if data == nil {
+		return // Waiting for the rest of fragments
+	}
+
+	h.handleInnerData(ctx, data)
+}
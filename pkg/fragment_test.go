@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestReassembler(t *testing.T) {
+	r := newReassembler()
+	alice := peer.ID("alice")
+
+	first := &api.FragmentMessage{MessageID: "1", Index: 1, Count: 2, Data: []byte("world")}
+	second := &api.FragmentMessage{MessageID: "1", Index: 0, Count: 2, Data: []byte("hello ")}
+	data, err := r.add(alice, first)
+	if err != nil || data != nil {
+		t.Fatalf("message is reassembled before all fragments are received: %q, %v", data, err)
+	}
+	data, err = r.add(alice, second)
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("wrong reassembled message: %q, %v", data, err)
+	}
+	if r.used != 0 || len(r.buffers) != 0 {
+		t.Fatal("buffer is not released after reassembly")
+	}
+
+	if _, err = r.add(alice, &api.FragmentMessage{MessageID: "2", Index: 2, Count: 2, Data: []byte("x")}); err == nil {
+		t.Fatal("fragment with index out of range is accepted")
+	}
+
+	r.timeout = time.Millisecond
+	if _, err = r.add(alice, &api.FragmentMessage{MessageID: "3", Index: 0, Count: 2, Data: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.used != 0 || len(r.buffers) != 0 || len(r.pending) != 0 {
+		t.Fatal("incomplete message is not dropped after timeout")
+	}
+}
+
+func TestReassemblerMemoryLimit(t *testing.T) {
+	r := newReassembler()
+	r.memoryLimit = 4
+	alice := peer.ID("alice")
+
+	if _, err := r.add(alice, &api.FragmentMessage{MessageID: "1", Index: 0, Count: 2, Data: []byte("hello")}); err == nil {
+		t.Fatal("memory limit is not enforced")
+	}
+	if r.used != 0 || len(r.buffers) != 0 {
+		t.Fatal("buffer is not released after exceeding the limit")
+	}
+
+	// Tiny fragments can't claim huge number of slots
+	r = newReassembler()
+	if _, err := r.add(alice, &api.FragmentMessage{MessageID: "2", Index: 0, Count: maxFragmentCount + 1, Data: []byte("x")}); err == nil {
+		t.Fatal("fragment count above the limit is accepted")
+	}
+	r.memoryLimit = maxFragmentCount * fragmentSlotSize
+	if _, err := r.add(alice, &api.FragmentMessage{MessageID: "3", Index: 0, Count: maxFragmentCount, Data: []byte("x")}); err == nil {
+		t.Fatal("slots of the fragments aren't charged")
+	}
+	if _, err := r.add(alice, &api.FragmentMessage{MessageID: "4", Index: 0, Count: 2, Data: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if r.used != 2*fragmentSlotSize+1 {
+		t.Fatalf("wrong memory usage %d", r.used)
+	}
+}
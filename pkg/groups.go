@@ -0,0 +1,438 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Flags of messages which are sent in plaintext even in encrypted topics, they are needed to find members and exchange keys
+var groupPlainFlags = map[int]bool{
+	api.FlagTopicsRequest:    true,
+	api.FlagTopicsResponse:   true,
+	api.FlagIdentityRequest:  true,
+	api.FlagIdentityResponse: true,
+	api.FlagGreeting:         true,
+	api.FlagGreetingRespond:  true,
+	api.FlagFarewell:         true,
+	api.FlagHandshake:        true,
+	api.FlagHandshakeRespond: true,
+	api.FlagEncrypted:        true,
+	api.FlagRatchet:          true,
+	api.FlagSenderKeyRequest: true,
+	api.FlagGroupEncrypted:   true,
+	api.FlagTopicInvite:      true,
+}
+
+const (
+	// keyRequestTimeout is how long we wait for the requested sender key before requesting it again
+	keyRequestTimeout = time.Minute
+	// maxKeyRequests is the number of pending requests of sender keys, unknown keys aren't requested above it
+	maxKeyRequests = 1000
+	// keyShareInterval is how often the member may request our sender key
+	keyShareInterval = 10 * time.Second
+)
+
+type senderKey struct {
+	id  string
+	key *[32]byte
+}
+
+func newSenderKey() (*senderKey, error) {
+	key := new([32]byte)
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	return &senderKey{id: newMessageID(), key: key}, nil
+}
+
+// Keys of the member, previous one is kept for messages which were sent before rotation
+type memberKeys struct {
+	current  *senderKey
+	previous *senderKey
+}
+
+func (m *memberKeys) get(id string) *[32]byte {
+	if m.current != nil && m.current.id == id {
+		return m.current.key
+	}
+	if m.previous != nil && m.previous.id == id {
+		return m.previous.key
+	}
+	return nil
+}
+
+// Our state in encrypted topic
+type groupSession struct {
+	own     *senderKey
+	removed map[peer.ID]bool
+}
+
+// groupKeys holds sender keys of encrypted topics
+type groupKeys struct {
+	mu       sync.RWMutex
+	sessions map[string]*groupSession
+	members  map[string]*memberKeys
+	// Keys which we have requested and haven't received yet, they map to the time of request
+	requested map[string]time.Time
+	// Members map to the time when they have requested our sender key last time
+	shared map[string]time.Time
+}
+
+func newGroupKeys() *groupKeys {
+	return &groupKeys{
+		sessions:  make(map[string]*groupSession),
+		members:   make(map[string]*memberKeys),
+		requested: make(map[string]time.Time),
+		shared:    make(map[string]time.Time),
+	}
+}
+
+// Remembers request of the key, returns false if the key is already requested or there are too many pending requests.
+// Must be called with locked mutex
+func (g *groupKeys) request(requestID string, now time.Time) bool {
+	if requested, ok := g.requested[requestID]; ok && now.Sub(requested) < keyRequestTimeout {
+		return false
+	}
+	if len(g.requested) >= maxKeyRequests {
+		for id, requested := range g.requested {
+			if now.Sub(requested) >= keyRequestTimeout {
+				delete(g.requested, id)
+			}
+		}
+		if len(g.requested) >= maxKeyRequests {
+			return false
+		}
+	}
+	g.requested[requestID] = now
+	return true
+}
+
+// Checks whether the member may get our sender key on request, so repeated requests don't make us flood the topic.
+// Must be called with locked mutex
+func (g *groupKeys) allowShare(memberID string, now time.Time) bool {
+	if shared, ok := g.shared[memberID]; ok && now.Sub(shared) < keyShareInterval {
+		return false
+	}
+	for id, shared := range g.shared {
+		if now.Sub(shared) >= keyShareInterval {
+			delete(g.shared, id)
+		}
+	}
+	g.shared[memberID] = now
+	return true
+}
+
+func memberKey(topic string, peerID peer.ID) string {
+	return topic + "/" + peerID.String()
+}
+
+// Starts encrypting our messages in the topic and sends our sender key to members of the topic.
+// Members must have announced their encryption keys in the handshake, identity key must be set.
+// Messages aren't sent while there are peers in the topic, which don't support group encryption
+func (h *Handler) EnableTopicEncryption(topic string) error {
+	own, err := h.startGroupSession(topic)
+	if err != nil || own == nil {
+		return err
+	}
+	h.distributeSenderKey(topic, own, h.groupMembers(topic, ""))
+	return nil
+}
+
+// Creates our sender key in the topic, returns nil key if the topic is already encrypted
+func (h *Handler) startGroupSession(topic string) (*senderKey, error) {
+	h.keys.mu.RLock()
+	hasIdentity := h.keys.identityKey != nil
+	h.keys.mu.RUnlock()
+	if !hasIdentity {
+		return nil, errors.New("identity key is not set")
+	}
+	own, err := newSenderKey()
+	if err != nil {
+		return nil, err
+	}
+
+	h.groups.mu.Lock()
+	defer h.groups.mu.Unlock()
+	if _, ok := h.groups.sessions[topic]; ok {
+		return nil, nil
+	}
+	h.groups.sessions[topic] = &groupSession{own: own, removed: make(map[peer.ID]bool)}
+	return own, nil
+}
+
+// Stops encrypting our messages in the topic. Private topics are always encrypted
+func (h *Handler) DisableTopicEncryption(topic string) {
+	if h.IsPrivateTopic(topic) {
+		return
+	}
+	h.groups.mu.Lock()
+	defer h.groups.mu.Unlock()
+	delete(h.groups.sessions, topic)
+}
+
+// Checks whether our messages in the topic are encrypted
+func (h *Handler) IsTopicEncrypted(topic string) bool {
+	h.groups.mu.RLock()
+	defer h.groups.mu.RUnlock()
+	_, ok := h.groups.sessions[topic]
+	return ok
+}
+
+// Replaces our sender key in the topic and sends the new one to members
+func (h *Handler) RotateSenderKey(topic string) error {
+	return h.rotateSenderKey(topic, "")
+}
+
+// Removes member from encrypted topic: the peer doesn't receive our sender keys anymore and our key is rotated
+func (h *Handler) RemoveMember(topic string, peerID peer.ID) error {
+	h.groups.mu.Lock()
+	session, ok := h.groups.sessions[topic]
+	if ok {
+		session.removed[peerID] = true
+	}
+	delete(h.groups.members, memberKey(topic, peerID))
+	h.groups.mu.Unlock()
+	if !ok {
+		return errors.New("topic is not encrypted")
+	}
+	return h.rotateSenderKey(topic, peerID)
+}
+
+// Replaces our sender key, the new key isn't sent to `excluded` peer
+func (h *Handler) rotateSenderKey(topic string, excluded peer.ID) error {
+	own, err := newSenderKey()
+	if err != nil {
+		return err
+	}
+	h.groups.mu.Lock()
+	session, ok := h.groups.sessions[topic]
+	if ok {
+		session.own = own
+	}
+	h.groups.mu.Unlock()
+	if !ok {
+		return errors.New("topic is not encrypted")
+	}
+
+	h.distributeSenderKey(topic, own, h.groupMembers(topic, excluded))
+	return nil
+}
+
+// Returns peers of the topic, which are able to receive our sender key
+func (h *Handler) groupMembers(topic string, excluded peer.ID) []peer.ID {
+	h.groups.mu.RLock()
+	session, ok := h.groups.sessions[topic]
+	h.groups.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	members := []peer.ID{}
+	for _, peerID := range h.GetPeers(topic) {
+		h.groups.mu.RLock()
+		removed := session.removed[peerID]
+		h.groups.mu.RUnlock()
+		if removed || peerID == excluded || !h.isTopicMember(topic, peerID) || !h.PeerSupports(peerID, api.CapabilityGroupEncryption) {
+			continue
+		}
+		members = append(members, peerID)
+	}
+	return members
+}
+
+// Sends sender key to every peer through end-to-end encrypted message
+func (h *Handler) distributeSenderKey(topic string, own *senderKey, peers []peer.ID) {
+	for _, peerID := range peers {
+		message := &api.SenderKeyMessage{
+			BaseMessage: api.BaseMessage{
+				Body:         "",
+				To:           peerID.String(),
+				Flag:         api.FlagSenderKey,
+				FromMatrixID: h.matrixID,
+			},
+			KeyID: own.id,
+			Key:   own.key[:],
+		}
+		encrypted, err := h.encryptDirect(peerID, h.codecFor(topic, message.To), message)
+		if err != nil {
+			log.Printf("Unable to send sender key to %s: %s\n", peerID.String(), err.Error())
+			continue
+		}
+		h.sendMessageToTopic(topic, encrypted)
+	}
+}
+
+// Sends our current sender key to the peer, if the topic is encrypted and the peer is neither removed nor outsider of private topic
+func (h *Handler) shareSenderKey(topic string, peerID peer.ID) {
+	if !h.isTopicMember(topic, peerID) {
+		return
+	}
+	h.groups.mu.RLock()
+	session, ok := h.groups.sessions[topic]
+	var own *senderKey
+	if ok && !session.removed[peerID] {
+		own = session.own
+	}
+	h.groups.mu.RUnlock()
+	if own != nil {
+		h.distributeSenderKey(topic, own, []peer.ID{peerID})
+	}
+}
+
+// Forgets sender keys of the member, which has left the topic, and rotates our key
+func (h *Handler) forgetMember(topic string, peerID peer.ID) {
+	h.groups.mu.Lock()
+	delete(h.groups.members, memberKey(topic, peerID))
+	_, ok := h.groups.sessions[topic]
+	h.groups.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := h.rotateSenderKey(topic, peerID); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Wraps encoded message into group encrypted one, if the topic is encrypted and the message is not directed.
+// Returns error if some peers of open topic aren't able to decrypt it, outsiders of private topic aren't expected to
+func (h *Handler) encryptForTopic(topic string, codec Codec, base *api.BaseMessage, sendData []byte) ([]byte, error) {
+	if base.To != "" || groupPlainFlags[base.Flag] {
+		return sendData, nil
+	}
+	h.groups.mu.RLock()
+	session, ok := h.groups.sessions[topic]
+	var own *senderKey
+	if ok {
+		own = session.own
+	}
+	h.groups.mu.RUnlock()
+	private := h.IsPrivateTopic(topic)
+	if own == nil {
+		if private {
+			return nil, errors.New("private topic " + topic + " is not encrypted")
+		}
+		return sendData, nil
+	}
+	if !private {
+		if err := h.requireSupport(topic, "", api.CapabilityGroupEncryption); err != nil {
+			return nil, err
+		}
+	}
+
+	nonce := new([24]byte)
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	encrypted := &api.GroupEncryptedMessage{
+		BaseMessage: api.BaseMessage{
+			Flag:         api.FlagGroupEncrypted,
+			FromMatrixID: base.FromMatrixID,
+			Version:      api.ProtocolVersion,
+			ID:           newMessageID(),
+			Timestamp:    base.Timestamp,
+		},
+		KeyID:      own.id,
+		Nonce:      nonce[:],
+		Ciphertext: secretbox.Seal(nil, sendData, nonce, own.key),
+	}
+	return codec.Marshal(encrypted)
+}
+
+func newSenderKeyMessage() api.Message {
+	return &api.SenderKeyMessage{}
+}
+
+func newGroupEncryptedMessage() api.Message {
+	return &api.GroupEncryptedMessage{}
+}
+
+// Getting sender key of the member. Our messages are encrypted only if we have enabled encryption of the topic
+func handleSenderKey(h *Handler, ctx *MessageContext, message api.Message) {
+	if !ctx.Encrypted {
+		log.Println("Dropping sender key, which was sent in plaintext by " + ctx.FromPeerID.String())
+		return
+	}
+	keyMessage := message.(*api.SenderKeyMessage)
+	if keyMessage.KeyID == "" || len(keyMessage.Key) != 32 {
+		log.Println("Malformed sender key from " + ctx.FromPeerID.String())
+		return
+	}
+	key := &senderKey{id: keyMessage.KeyID, key: new([32]byte)}
+	copy(key.key[:], keyMessage.Key)
+
+	memberID := memberKey(ctx.Topic, ctx.FromPeerID)
+	h.groups.mu.Lock()
+	keys, ok := h.groups.members[memberID]
+	if !ok {
+		keys = &memberKeys{}
+		h.groups.members[memberID] = keys
+	}
+	if keys.current == nil || keys.current.id != key.id {
+		keys.previous = keys.current
+		keys.current = key
+	}
+	delete(h.groups.requested, memberID+"/"+key.id)
+	h.groups.mu.Unlock()
+}
+
+// Getting request of our sender key from the member, which is unable to decrypt our messages
+func handleSenderKeyRequest(h *Handler, ctx *MessageContext, message api.Message) {
+	h.groups.mu.Lock()
+	allowed := h.groups.allowShare(memberKey(ctx.Topic, ctx.FromPeerID), time.Now())
+	h.groups.mu.Unlock()
+	if !allowed {
+		return
+	}
+	h.shareSenderKey(ctx.Topic, ctx.FromPeerID)
+}
+
+// Getting message encrypted with sender key, handling it after decryption
+func handleGroupEncrypted(h *Handler, ctx *MessageContext, message api.Message) {
+	encrypted := message.(*api.GroupEncryptedMessage)
+	if len(encrypted.Nonce) != 24 {
+		log.Println("Malformed encrypted message from " + ctx.FromPeerID.String())
+		return
+	}
+
+	memberID := memberKey(ctx.Topic, ctx.FromPeerID)
+	h.groups.mu.Lock()
+	var key *[32]byte
+	if keys, ok := h.groups.members[memberID]; ok {
+		key = keys.get(encrypted.KeyID)
+	}
+	request := key == nil && h.groups.request(memberID+"/"+encrypted.KeyID, time.Now())
+	h.groups.mu.Unlock()
+	if key == nil {
+		log.Println("Unknown sender key of " + ctx.FromPeerID.String() + " in topic " + ctx.Topic)
+		if request {
+			h.sendMessageToTopic(ctx.Topic, &api.SenderKeyMessage{
+				BaseMessage: api.BaseMessage{
+					Body:         "",
+					To:           ctx.FromPeerID.String(),
+					Flag:         api.FlagSenderKeyRequest,
+					FromMatrixID: h.matrixID,
+				},
+				KeyID: encrypted.KeyID,
+			})
+		}
+		return
+	}
+
+	nonce := new([24]byte)
+	copy(nonce[:], encrypted.Nonce)
+	data, ok := secretbox.Open(nil, encrypted.Ciphertext, nonce, key)
+	if !ok {
+		log.Println("Failed to decrypt message from " + ctx.FromPeerID.String())
+		return
+	}
+	innerCtx := *ctx
+	innerCtx.Encrypted = true
+	h.handleInnerData(&innerCtx, data)
+}
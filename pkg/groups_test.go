@@ -0,0 +1,263 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Delivers sender key of `from` in the topic to `to` as it's done by distributeSenderKey
+func sendTestSenderKey(t *testing.T, from *Handler, to *Handler, topic string) {
+	from.groups.mu.RLock()
+	own := from.groups.sessions[topic].own
+	from.groups.mu.RUnlock()
+	message := &api.SenderKeyMessage{
+		BaseMessage: api.BaseMessage{To: to.peerID.String(), Flag: api.FlagSenderKey},
+		KeyID:       own.id,
+		Key:         own.key[:],
+	}
+	encrypted, err := from.encrypt(to.peerID, JSONCodec, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to.HandleIncomingMessage(topic, newTestPubsubMessage(t, from.peerID, JSONCodec, encrypted), nil, nil, nil)
+}
+
+func TestGroupEncryption(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Hosts aren't connected, so the topic has no peers, which may lack the capability
+	_, alice := newTestNetworkKeyedHandler(t, ctx)
+	_, bob := newTestNetworkKeyedHandler(t, ctx)
+	sendTestHandshake(t, alice, bob)
+	sendTestHandshake(t, bob, alice)
+	for _, h := range []*Handler{alice, bob} {
+		own, err := newSenderKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.groups.sessions["group"] = &groupSession{own: own, removed: make(map[peer.ID]bool)}
+	}
+	sendTestSenderKey(t, alice, bob, "group")
+
+	send := func(body string) *TextMessage {
+		message := &api.BaseMessage{Body: body, Flag: api.FlagGenericMessage, ID: newMessageID(), Timestamp: nowMillis()}
+		data, err := JSONCodec.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = alice.encryptForTopic("group", JSONCodec, message, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := &api.MessageHeader{}
+		if err = JSONCodec.Unmarshal(data, header); err != nil || header.Flag != api.FlagGroupEncrypted {
+			t.Fatal("message is sent in plaintext")
+		}
+
+		var received *TextMessage
+		msg := newTestPubsubMessage(t, alice.peerID, JSONCodec, nil)
+		msg.Data = data
+		bob.HandleIncomingMessage("group", msg, func(textMessage TextMessage) {
+			received = &textMessage
+		}, nil, nil)
+		return received
+	}
+
+	if received := send("hello"); received == nil || received.Body != "hello" || !received.Encrypted {
+		t.Fatal("encrypted message is not delivered to the member")
+	}
+
+	// Messages sent before rotation are still readable
+	previous := alice.groups.sessions["group"].own
+	own, _ := newSenderKey()
+	alice.groups.sessions["group"].own = own
+	sendTestSenderKey(t, alice, bob, "group")
+	alice.groups.sessions["group"].own = previous
+	if received := send("before rotation"); received == nil {
+		t.Fatal("message encrypted with previous key is not delivered")
+	}
+	alice.groups.sessions["group"].own = own
+	if received := send("after rotation"); received == nil {
+		t.Fatal("message encrypted with rotated key is not delivered")
+	}
+}
+
+// Returns ID of our sender key in the topic
+func ownSenderKeyID(h *Handler, topic string) string {
+	h.groups.mu.RLock()
+	defer h.groups.mu.RUnlock()
+	return h.groups.sessions[topic].own.id
+}
+
+// Returns ID of the current sender key of the peer in the topic, which the handler has received
+func memberSenderKeyID(h *Handler, topic string, peerID peer.ID) string {
+	h.groups.mu.RLock()
+	defer h.groups.mu.RUnlock()
+	keys, ok := h.groups.members[memberKey(topic, peerID)]
+	if !ok || keys.current == nil {
+		return ""
+	}
+	return keys.current.id
+}
+
+func TestGroupKeyRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aliceHost, alice := newTestNetworkKeyedHandler(t, ctx)
+	bobHost, bob := newTestNetworkKeyedHandler(t, ctx)
+	carolHost, carol := newTestNetworkKeyedHandler(t, ctx)
+	connectTestHosts(t, ctx, aliceHost, bobHost, carolHost)
+	handlers := []*Handler{alice, bob, carol}
+
+	var mu sync.Mutex
+	received := make(map[*Handler][]string)
+	bodiesOf := func(h *Handler) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, received[h]...)
+	}
+	for _, h := range handlers {
+		h := h
+		joinTestTopic(t, ctx, h, "moonshard", nil)
+		joinTestTopic(t, ctx, h, "group", func(message TextMessage) {
+			if !message.Encrypted {
+				t.Errorf("message %q is received in plaintext", message.Body)
+			}
+			mu.Lock()
+			received[h] = append(received[h], message.Body)
+			mu.Unlock()
+		})
+	}
+	waitFor(t, "pubsub peers", func() bool {
+		for _, h := range handlers {
+			if len(h.GetPeers("group")) != 2 || len(h.GetPeers("moonshard")) != 2 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Messages aren't sent to peers, which aren't known to support encryption
+	if err := alice.EnableTopicEncryption("group"); err != nil {
+		t.Fatal(err)
+	}
+	message := &api.BaseMessage{Body: "lost", Flag: api.FlagGenericMessage}
+	if _, err := alice.encryptForTopic("group", JSONCodec, message, []byte("{}")); err == nil {
+		t.Fatal("message is encrypted for peers without the capability")
+	}
+	alice.DisableTopicEncryption("group")
+
+	for _, h := range handlers {
+		h.SendHandshake()
+	}
+	waitFor(t, "handshakes", func() bool {
+		for _, h := range handlers {
+			for _, other := range handlers {
+				if h != other && !h.PeerSupports(other.peerID, api.CapabilityGroupEncryption) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+
+	// Getting the sender key of Alice doesn't make members encrypt the topic
+	if err := alice.EnableTopicEncryption("group"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "sender key of Alice", func() bool {
+		return hasSenderKey(bob, "group", alice.peerID) && hasSenderKey(carol, "group", alice.peerID)
+	})
+	if bob.IsTopicEncrypted("group") || carol.IsTopicEncrypted("group") {
+		t.Fatal("topic is encrypted without opt-in")
+	}
+	for _, h := range []*Handler{bob, carol} {
+		if err := h.EnableTopicEncryption("group"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "sender keys", func() bool {
+		for _, h := range handlers {
+			for _, other := range handlers {
+				if h != other && !hasSenderKey(h, "group", other.peerID) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	alice.SendMessage("group", "one")
+	waitFor(t, "encrypted message", func() bool {
+		return len(bodiesOf(bob)) == 1 && len(bodiesOf(carol)) == 1
+	})
+
+	// Removed member doesn't get the new key, and isn't able to read messages encrypted with it
+	oldKeyID := ownSenderKeyID(alice, "group")
+	if err := alice.RemoveMember("group", carol.peerID); err != nil {
+		t.Fatal(err)
+	}
+	newKeyID := ownSenderKeyID(alice, "group")
+	if newKeyID == oldKeyID {
+		t.Fatal("sender key is not rotated on removing the member")
+	}
+	waitFor(t, "rotated sender key", func() bool {
+		return memberSenderKeyID(bob, "group", alice.peerID) == newKeyID
+	})
+	alice.SendMessage("group", "two")
+	waitFor(t, "message encrypted with rotated key", func() bool {
+		return len(bodiesOf(bob)) == 2
+	})
+	// Carol requests the unknown key, but Alice doesn't answer
+	time.Sleep(500 * time.Millisecond)
+	if bodies := bodiesOf(carol); len(bodies) != 1 || memberSenderKeyID(carol, "group", alice.peerID) == newKeyID {
+		t.Fatalf("removed member has decrypted the message: %v", bodies)
+	}
+
+	// Members rotate their keys when Bob says farewell, new keys aren't sent to Bob
+	aliceKeyID, carolKeyID := ownSenderKeyID(alice, "group"), ownSenderKeyID(carol, "group")
+	bob.SendFarewellInTopic("group")
+	waitFor(t, "rotation on farewell", func() bool {
+		return ownSenderKeyID(alice, "group") != aliceKeyID && ownSenderKeyID(carol, "group") != carolKeyID
+	})
+	waitFor(t, "rotated sender key of the member", func() bool {
+		return memberSenderKeyID(alice, "group", carol.peerID) == ownSenderKeyID(carol, "group")
+	})
+	if hasSenderKey(alice, "group", bob.peerID) || hasSenderKey(carol, "group", bob.peerID) {
+		t.Fatal("sender key of the member, who has left, is kept")
+	}
+	if memberSenderKeyID(bob, "group", alice.peerID) != newKeyID || memberSenderKeyID(bob, "group", carol.peerID) != carolKeyID {
+		t.Fatal("rotated sender key is sent to the member, who has left")
+	}
+}
+
+func TestSenderKeyRequests(t *testing.T) {
+	groups := newGroupKeys()
+	now := time.Now()
+	if !groups.request("group/peer/key", now) || groups.request("group/peer/key", now) {
+		t.Fatal("key is requested twice")
+	}
+	if !groups.request("group/peer/key", now.Add(keyRequestTimeout)) {
+		t.Fatal("key is not requested again after timeout")
+	}
+	for i := len(groups.requested); i < maxKeyRequests; i++ {
+		groups.request(newMessageID(), now)
+	}
+	if groups.request("group/peer/another", now) {
+		t.Fatal("pending requests are not bounded")
+	}
+	if !groups.request("group/peer/another", now.Add(keyRequestTimeout)) || len(groups.requested) != 2 {
+		t.Fatal("expired requests are not dropped")
+	}
+
+	if !groups.allowShare("group/peer", now) || groups.allowShare("group/peer", now.Add(time.Second)) {
+		t.Fatal("requests of our sender key are not limited")
+	}
+	if !groups.allowShare("group/peer", now.Add(keyShareInterval)) {
+		t.Fatal("sender key is not shared after interval")
+	}
+}
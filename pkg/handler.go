@@ -1,7 +1,6 @@
 package pkg
 
 import (
-	"encoding/json"
 	"log"
 	"sync"
 
@@ -13,13 +12,41 @@ import (
 
 // Handler is a network handler, which handle on incoming network events (such as message)
 type Handler struct {
-	pb            *pubsub.PubSub
-	serviceTopic  string
-	networkTopics mapset.Set
-	identityMap   map[peer.ID]string
-	peerID        peer.ID
-	matrixID      string
-	PbMutex       sync.Mutex
+	pb              *pubsub.PubSub
+	serviceTopic    string
+	networkTopics   mapset.Set
+	identityMap     map[peer.ID]string
+	peerID          peer.ID
+	matrixID        string
+	capabilities    []string
+	autoReceipts    bool
+	peerInfo        map[peer.ID]*PeerInfo
+	topicCodecs     map[string]Codec
+	seenMessages    *seenCache
+	decodedMessages *decodedCache
+	signals         *signalTracker
+	history         *messageHistory
+	files           *fileTransfer
+	validated       map[string]bool
+	maxMsgSize      int
+	fragmentSize    int
+	fragments       *reassembler
+	compressAbove   int
+	keys            *keyring
+	groups          *groupKeys
+	sessions        *sessionStore
+	claims          *identityClaims
+	retired         *retiredKeys
+	pins            *pinStore
+	verifications   *verifications
+	private         *privateTopics
+	limiter         *rateLimiter
+	blocks          *blocklist
+	receipts        *receiptBatches
+	flagHandlers    map[int]*flagHandler
+	handleEvent     func(Event)
+	mu              sync.RWMutex
+	PbMutex         sync.Mutex
 }
 
 // TextMessage is more end-user model of regular text messages
@@ -28,15 +55,50 @@ type TextMessage struct {
 	Body         string `json:"body"`
 	FromPeerID   string `json:"fromPeerID"`
 	FromMatrixID string `json:"fromMatrixID"`
+	ID           string `json:"id"`
+	Timestamp    int64  `json:"timestamp"`
+	ReplyTo      string `json:"replyTo,omitempty"`
+	ThreadRoot   string `json:"threadRoot,omitempty"`
+	ContentType  string `json:"contentType,omitempty"`
+	// Content is typed representation of the body
+	Content Content `json:"content,omitempty"`
+	// Encrypted is set if the message was end-to-end encrypted for us
+	Encrypted bool `json:"encrypted,omitempty"`
 }
 
 func NewHandler(pb *pubsub.PubSub, serviceTopic string, peerID peer.ID, networkTopics *mapset.Set) Handler {
 	return Handler{
-		pb:            pb,
-		serviceTopic:  serviceTopic,
-		networkTopics: *networkTopics,
-		identityMap:   make(map[peer.ID]string),
-		peerID:        peerID,
+		pb:              pb,
+		serviceTopic:    serviceTopic,
+		networkTopics:   *networkTopics,
+		identityMap:     make(map[peer.ID]string),
+		peerID:          peerID,
+		capabilities:    api.DefaultCapabilities,
+		peerInfo:        make(map[peer.ID]*PeerInfo),
+		topicCodecs:     make(map[string]Codec),
+		seenMessages:    newSeenCache(DefaultDedupWindow),
+		decodedMessages: newDecodedCache(),
+		signals:         newSignalTracker(),
+		history:         newMessageHistory(DefaultHistoryLimit),
+		files:           newFileTransfer(),
+		validated:       make(map[string]bool),
+		maxMsgSize:      DefaultMaxMessageSize,
+		fragmentSize:    DefaultFragmentSize,
+		fragments:       newReassembler(),
+		compressAbove:   DefaultCompressionThreshold,
+		keys:            newKeyring(),
+		groups:          newGroupKeys(),
+		sessions:        newSessionStore(),
+		claims:          newIdentityClaims(),
+		retired:         newRetiredKeys(),
+		pins:            newPinStore(),
+		verifications:   newVerifications(),
+		private:         newPrivateTopics(),
+		limiter:         newRateLimiter(),
+		blocks:          newBlocklist(),
+		receipts:        newReceiptBatches(),
+		flagHandlers:    builtinFlagHandlers(),
+		autoReceipts:    true,
 	}
 }
 
@@ -46,76 +108,268 @@ func (h *Handler) HandleIncomingMessage(topic string, msg pubsub.Message, handle
 		log.Println("Error occurred when reading message from field...")
 		return
 	}
-	message := &api.BaseMessage{}
-	if err = json.Unmarshal(msg.Data, message); err != nil {
-		log.Println("Error occurred during unmarshalling the base message data")
+	ctx := &MessageContext{
+		Topic:             topic,
+		FromPeerID:        fromPeerID,
+		handleTextMessage: handleTextMessage,
+		handleMatch:       handleMatch,
+		handleUnmatch:     handleUnmatch,
+	}
+	// Messages are usually decoded by the topic validator already
+	if decoded := h.decodedMessages.take(&msg); decoded != nil {
+		if h.acceptHeader(ctx, decoded.header) {
+			h.handleDecoded(ctx, decoded)
+		}
 		return
 	}
+	h.handleData(ctx, msg.Data)
+}
 
-	ourPeerID, err := peer.IDFromString(string(h.peerID))
-	if message.To != "" && message.To != ourPeerID.String() {
-		return // Drop message, because it is not for us
+// Decodes message and dispatches it to the handler of its flag
+func (h *Handler) handleData(ctx *MessageContext, data []byte) {
+	// Peeking the header first, so messages which are not for us are dropped without decoding them completely
+	codec := codecForData(data)
+	header := &api.MessageHeader{}
+	if err := codec.Unmarshal(data, header); err != nil {
+		log.Println("Error occurred during unmarshalling the message header")
+		return
+	}
+	if !h.acceptHeader(ctx, header) {
+		return
 	}
 
-	switch message.Flag {
-	// Getting regular message
-	case api.FlagGenericMessage:
-		textMessage := TextMessage{
-			Topic:        topic,
-			Body:         message.Body,
-			FromPeerID:   fromPeerID.String(),
-			FromMatrixID: message.FromMatrixID,
-		}
-		handleTextMessage(textMessage)
-	// Getting topic request, answer topic response
-	case api.FlagTopicsRequest:
-		respond := &api.GetTopicsRespondMessage{
-			BaseMessage: api.BaseMessage{
-				Body:         "",
-				Flag:         api.FlagTopicsResponse,
-				FromMatrixID: h.matrixID,
-				To:           fromPeerID.String(),
-			},
-			Topics: h.GetTopics(),
-		}
-		sendData, err := json.Marshal(respond)
-		if err != nil {
-			log.Println("Error occurred during marshalling the respond from TopicsRequest")
-			return
-		}
-		go func() {
-			h.PbMutex.Lock()
-			h.pb.Publish(h.serviceTopic, sendData)
-			h.PbMutex.Unlock()
-		}()
-	// Getting topic respond, adding topics to `networkTopics`
-	case api.FlagTopicsResponse:
-		respond := &api.GetTopicsRespondMessage{}
-		if err = json.Unmarshal(msg.Data, respond); err != nil {
-			log.Println("Error occurred during unmarshalling the message data from TopicsResponse")
-			return
-		}
-		for i := 0; i < len(respond.Topics); i++ {
-			h.networkTopics.Add(respond.Topics[i])
+	h.mu.RLock()
+	flagHandler, ok := h.flagHandlers[header.Flag]
+	h.mu.RUnlock()
+	if !ok {
+		log.Printf("\nUnknown message type: %#x\n", header.Flag)
+		return
+	}
+
+	decoded := flagHandler.newMessage()
+	if err := codec.Unmarshal(data, decoded); err != nil {
+		log.Println("Error occurred during unmarshalling the message data")
+		return
+	}
+	h.handleDecoded(ctx, &decodedData{codec: codec, header: header, message: decoded})
+}
+
+// Checks whether the message should be handled by its header and counts it by rate limiter
+func (h *Handler) acceptHeader(ctx *MessageContext, header *api.MessageHeader) bool {
+	if header.To != "" && header.To != h.peerID.String() {
+		return false // Drop message, because it is not for us
+	}
+	if !isVersionHandled(header.Version, header.Flag) {
+		return false // Drop message of newer protocol, it's only forwarded to peers which are able to read it
+	}
+	// Fragments aren't counted, the message is counted once it's reassembled
+	if header.Flag != api.FlagFragment && !ctx.rateLimited {
+		if !h.checkRateLimit(ctx.FromPeerID, header.Flag) {
+			return false // Drop message, because the peer sends too many of them
 		}
-	// Getting identity request, answer identity response
-	case api.FlagIdentityRequest:
-		h.sendIdentityResponse(h.serviceTopic, fromPeerID.String())
-	// Getting identity respond, mapping Multiaddress/MatrixID
-	case api.FlagIdentityResponse:
-		h.identityMap[peer.ID(fromPeerID.String())] = message.FromMatrixID
-	case api.FlagGreeting:
-		handleMatch(topic, fromPeerID.String(), message.FromMatrixID)
-		log.Println("Greetings from " + fromPeerID.String() + " in topic " + topic)
-		h.sendIdentityResponse(topic, fromPeerID.String())
-	case api.FlagGreetingRespond:
-		handleMatch(topic, fromPeerID.String(), message.FromMatrixID)
-		log.Println("Greeting respond from " + fromPeerID.String() + ":" + message.FromMatrixID + " in topic " + topic)
-	case api.FlagFarewell:
-		handleUnmatch(topic, fromPeerID.String(), message.FromMatrixID)
-	default:
-		log.Printf("\nUnknown message type: %#x\n", message.Flag)
+		ctx.rateLimited = true
+	}
+	return true
+}
+
+// Dispatches decoded message to the handler of its flag
+func (h *Handler) handleDecoded(ctx *MessageContext, decoded *decodedData) {
+	fromPeerID := ctx.FromPeerID
+	h.mu.RLock()
+	flagHandler, ok := h.flagHandlers[decoded.header.Flag]
+	h.mu.RUnlock()
+	if !ok || decoded.message == nil {
+		log.Printf("\nUnknown message type: %#x\n", decoded.header.Flag)
+		return
+	}
+	message := decoded.message.Base()
+
+	if !isVersionSupported(messageVersion(message)) {
+		log.Printf("Dropping message from %s with unsupported protocol version %d\n", fromPeerID.String(), message.Version)
+		return
+	}
+	if h.isBlockedMessage(fromPeerID, message) {
+		return // Drop message, because the sender is blocked or muted
+	}
+	h.updatePeerInfo(fromPeerID, message)
+
+	if message.ID != "" && h.seenMessages.markSeen(fromPeerID, message.ID) {
+		return // Drop duplicate, it has already been delivered
+	}
+
+	ctx.Codec = decoded.codec
+	flagHandler.handle(h, ctx, decoded.message)
+}
+
+// maxWrapperDepth is how many wrappers may carry the message: it's fragmented, encrypted and compressed at most
+const maxWrapperDepth = 3
+
+// wrapperFlags are flags of messages which carry another message
+var wrapperFlags = map[int]bool{
+	api.FlagFragment:       true,
+	api.FlagCompressed:     true,
+	api.FlagEncrypted:      true,
+	api.FlagGroupEncrypted: true,
+	api.FlagRatchet:        true,
+}
+
+// Handles message which was carried inside of another one (fragments or compressed message).
+// It haven't passed through topic validator, so we check it here
+func (h *Handler) handleInnerData(ctx *MessageContext, data []byte) {
+	decoded, err := h.checkData(ctx.FromPeerID, data)
+	if err != nil {
+		log.Printf("Dropping inner message from %s: %s\n", ctx.FromPeerID.String(), err.Error())
+		return
+	}
+	innerCtx := *ctx
+	innerCtx.depth++
+	if wrapperFlags[decoded.header.Flag] && innerCtx.depth >= maxWrapperDepth {
+		log.Printf("Dropping inner message from %s with nested flag %#x\n", ctx.FromPeerID.String(), decoded.header.Flag)
+		return
+	}
+	if h.acceptHeader(&innerCtx, decoded.header) {
+		h.handleDecoded(&innerCtx, decoded)
+	}
+}
+
+// Built-in flags of the protocol, they are registered in every handler
+func builtinFlagHandlers() map[int]*flagHandler {
+	return map[int]*flagHandler{
+		api.FlagGenericMessage:   {newBaseMessage, handleGenericMessage},
+		api.FlagTopicsRequest:    {newBaseMessage, handleTopicsRequest},
+		api.FlagTopicsResponse:   {newTopicsRespondMessage, handleTopicsResponse},
+		api.FlagIdentityRequest:  {newBaseMessage, handleIdentityRequest},
+		api.FlagIdentityResponse: {newIdentityMessage, handleIdentityResponse},
+		api.FlagGreeting:         {newBaseMessage, handleGreeting},
+		api.FlagGreetingRespond:  {newIdentityMessage, handleGreetingRespond},
+		api.FlagFarewell:         {newBaseMessage, handleFarewell},
+		api.FlagHandshake:        {newHandshakeMessage, handleHandshake},
+		api.FlagHandshakeRespond: {newHandshakeMessage, handleHandshakeRespond},
+		api.FlagDeliveryReceipt:  {newReceiptMessage, handleReceipt},
+		api.FlagReadReceipt:      {newReceiptMessage, handleReceipt},
+		api.FlagTypingStarted:    {newSignalMessage, handleSignal},
+		api.FlagTypingStopped:    {newSignalMessage, handleSignal},
+		api.FlagPresenceActive:   {newSignalMessage, handleSignal},
+		api.FlagPresenceIdle:     {newSignalMessage, handleSignal},
+		api.FlagEdit:             {newEditMessage, handleEdit},
+		api.FlagRedact:           {newEditMessage, handleEdit},
+		api.FlagReaction:         {newReactionMessage, handleReaction},
+		api.FlagFileOffer:        {newFileOfferMessage, handleFileOffer},
+		api.FlagFileAccept:       {newFileResponseMessage, handleFileResponse},
+		api.FlagFileDecline:      {newFileResponseMessage, handleFileResponse},
+		api.FlagFragment:         {newFragmentMessage, handleFragment},
+		api.FlagCompressed:       {newCompressedMessage, handleCompressed},
+		api.FlagEncrypted:        {newEncryptedMessage, handleEncrypted},
+		api.FlagSenderKey:        {newSenderKeyMessage, handleSenderKey},
+		api.FlagSenderKeyRequest: {newSenderKeyMessage, handleSenderKeyRequest},
+		api.FlagGroupEncrypted:   {newGroupEncryptedMessage, handleGroupEncrypted},
+		api.FlagRatchet:          {newRatchetMessage, handleRatchet},
+		api.FlagKeyRotation:      {newKeyRotationMessage, handleKeyRotation},
+		api.FlagKeyRevocation:    {newKeyRevocationMessage, handleKeyRevocation},
+		api.FlagVerifyRequest:    {newVerificationMessage, handleVerifyRequest},
+		api.FlagVerifyConfirm:    {newVerificationMessage, handleVerifyConfirm},
+		api.FlagTopicInvite:      {newTopicInviteMessage, handleTopicInvite},
+	}
+}
+
+func newBaseMessage() api.Message {
+	return &api.BaseMessage{}
+}
+
+func newTopicsRespondMessage() api.Message {
+	return &api.GetTopicsRespondMessage{}
+}
+
+func newHandshakeMessage() api.Message {
+	return &api.HandshakeMessage{}
+}
+
+// Getting regular message
+func handleGenericMessage(h *Handler, ctx *MessageContext, message api.Message) {
+	base := message.Base()
+	textMessage := TextMessage{
+		Topic:        ctx.Topic,
+		Body:         base.Body,
+		FromPeerID:   ctx.FromPeerID.String(),
+		FromMatrixID: base.FromMatrixID,
+		ID:           base.ID,
+		Timestamp:    base.Timestamp,
+		ReplyTo:      base.ReplyTo,
+		ThreadRoot:   base.ThreadRoot,
+		ContentType:  base.ContentType,
+		Content:      decodeContent(base),
+		Encrypted:    ctx.Encrypted,
+	}
+	if textMessage.ReplyTo != "" && textMessage.ThreadRoot == "" {
+		textMessage.ThreadRoot = h.history.threadRootFor(textMessage.ReplyTo)
 	}
+	h.history.add(ctx.FromPeerID, textMessage)
+	ctx.handleTextMessage(textMessage)
+	h.sendDeliveryReceipt(ctx.Topic, ctx.FromPeerID, base.ID, base.To != "")
+}
+
+// Getting topic request, answer topic response. Private topics are announced only to their members
+func handleTopicsRequest(h *Handler, ctx *MessageContext, message api.Message) {
+	respond := &api.GetTopicsRespondMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			Flag:         api.FlagTopicsResponse,
+			FromMatrixID: h.matrixID,
+			To:           ctx.FromPeerID.String(),
+		},
+		Topics: h.topicsFor(ctx.FromPeerID),
+	}
+	h.sendMessageToServiceTopic(respond)
+}
+
+// Getting topic respond, adding topics to `networkTopics`
+func handleTopicsResponse(h *Handler, ctx *MessageContext, message api.Message) {
+	respond := message.(*api.GetTopicsRespondMessage)
+	for i := 0; i < len(respond.Topics); i++ {
+		h.networkTopics.Add(respond.Topics[i])
+	}
+}
+
+// Getting identity request, answer identity response
+func handleIdentityRequest(h *Handler, ctx *MessageContext, message api.Message) {
+	h.sendIdentityResponse(h.serviceTopic, ctx.FromPeerID.String())
+}
+
+// Getting identity respond, mapping Multiaddress/MatrixID
+func handleIdentityResponse(h *Handler, ctx *MessageContext, message api.Message) {
+	h.updateIdentity(ctx.FromPeerID, message.(*api.IdentityMessage))
+}
+
+func handleGreeting(h *Handler, ctx *MessageContext, message api.Message) {
+	fromPeerID := ctx.FromPeerID.String()
+	ctx.handleMatch(ctx.Topic, fromPeerID, message.Base().FromMatrixID)
+	log.Println("Greetings from " + fromPeerID + " in topic " + ctx.Topic)
+	h.sendIdentityResponse(ctx.Topic, fromPeerID)
+	h.shareSenderKey(ctx.Topic, ctx.FromPeerID)
+}
+
+func handleGreetingRespond(h *Handler, ctx *MessageContext, message api.Message) {
+	fromPeerID := ctx.FromPeerID.String()
+	ctx.handleMatch(ctx.Topic, fromPeerID, message.Base().FromMatrixID)
+	log.Println("Greeting respond from " + fromPeerID + ":" + message.Base().FromMatrixID + " in topic " + ctx.Topic)
+	h.updateIdentity(ctx.FromPeerID, message.(*api.IdentityMessage))
+}
+
+func handleFarewell(h *Handler, ctx *MessageContext, message api.Message) {
+	ctx.handleUnmatch(ctx.Topic, ctx.FromPeerID.String(), message.Base().FromMatrixID)
+	h.forgetMember(ctx.Topic, ctx.FromPeerID)
+}
+
+// Getting handshake, answer with our version and capabilities
+func handleHandshake(h *Handler, ctx *MessageContext, message api.Message) {
+	h.updatePeerKeys(ctx.FromPeerID, message.(*api.HandshakeMessage))
+	h.sendHandshakeResponse(ctx.FromPeerID.String())
+	h.reannounceRevocations(ctx.FromPeerID)
+}
+
+// Peer info is already updated before dispatching the message
+func handleHandshakeRespond(h *Handler, ctx *MessageContext, message api.Message) {
+	h.updatePeerKeys(ctx.FromPeerID, message.(*api.HandshakeMessage))
 }
 
 func (h *Handler) sendIdentityResponse(topic string, fromPeerID string) {
@@ -125,32 +379,24 @@ func (h *Handler) sendIdentityResponse(topic string, fromPeerID string) {
 	} else {
 		flag = api.FlagGreetingRespond
 	}
-	respond := &api.BaseMessage{
-		Body:         "",
-		Flag:         flag,
-		FromMatrixID: h.matrixID,
-		To:           fromPeerID,
-	}
-	sendData, err := json.Marshal(respond)
-	if err != nil {
-		log.Println("Error occurred during marshalling the respond from IdentityRequest")
-		return
-	}
-	go func() {
-		h.PbMutex.Lock()
-		h.pb.Publish(topic, sendData)
-		h.PbMutex.Unlock()
-	}()
+	h.sendMessageToTopic(topic, h.ownIdentityMessage(flag, fromPeerID))
 }
 
 // Set Matrix ID
 func (h *Handler) SetMatrixID(matrixID string) {
 	h.matrixID = matrixID
+	h.signIdentityClaim()
 }
 
 // Returns copy of handler's identity map ([peer.ID]=>[matrixID])
 func (h *Handler) GetIdentityMap() map[peer.ID]string {
-	return h.identityMap
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	identityMap := make(map[peer.ID]string, len(h.identityMap))
+	for peerID, matrixID := range h.identityMap {
+		identityMap[peerID] = matrixID
+	}
+	return identityMap
 }
 
 // Get list of topics **this** node is subscribed to
@@ -165,9 +411,50 @@ func (h *Handler) GetPeers(topic string) []peer.ID {
 	return peers
 }
 
-// Blacklists a peer by its id
+// Blacklists a peer by its id, it's hard block which can be undone with UnblockPeer
 func (h *Handler) BlacklistPeer(pid peer.ID) {
-	h.pb.BlacklistPeer(pid)
+	if err := h.BlockPeer(pid, BlockHard, ""); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Sends regular text message to the topic, returns ID of the sent message
+func (h *Handler) SendMessage(topic string, body string) string {
+	message := &api.BaseMessage{
+		Body:         body,
+		To:           "",
+		Flag:         api.FlagGenericMessage,
+		FromMatrixID: h.matrixID,
+	}
+
+	h.sendTextMessage(topic, message)
+	return message.ID
+}
+
+// Sends text message and adds it to the history. Replies and typed content are sent as plain text,
+// if receivers don't support them, the body is their fallback
+func (h *Handler) sendTextMessage(topic string, message *api.BaseMessage) {
+	stampMessage(message)
+	wireMessage := *message
+	if (message.ReplyTo != "" || message.ThreadRoot != "") && !h.receiversSupport(topic, message.To, api.CapabilityThreads) {
+		wireMessage.ReplyTo, wireMessage.ThreadRoot = "", ""
+	}
+	if message.ContentType != "" && !h.receiversSupport(topic, message.To, api.CapabilityContent) {
+		wireMessage.ContentType, wireMessage.Payload = "", ""
+	}
+	h.sendMessageToTopic(topic, &wireMessage)
+	h.history.add(h.peerID, TextMessage{
+		Topic:        topic,
+		Body:         message.Body,
+		FromPeerID:   h.peerID.String(),
+		FromMatrixID: h.matrixID,
+		ID:           message.ID,
+		Timestamp:    message.Timestamp,
+		ReplyTo:      message.ReplyTo,
+		ThreadRoot:   message.ThreadRoot,
+		ContentType:  message.ContentType,
+		Content:      decodeContent(message),
+	})
 }
 
 // Requesting topics from **other** peers
@@ -220,17 +507,35 @@ func (h *Handler) SendFarewellInTopic(topic string) {
 }
 
 // Sends marshaled message to the service topic
-func (h *Handler) sendMessageToServiceTopic(message *api.BaseMessage) {
+func (h *Handler) sendMessageToServiceTopic(message api.Message) {
 	h.sendMessageToTopic(h.serviceTopic, message)
 }
 
-func (h *Handler) sendMessageToTopic(topic string, message *api.BaseMessage) {
-	sendData, err := json.Marshal(message)
+// Encodes message with the codec negotiated for the topic and publishes it, fragmenting it if it is too large
+func (h *Handler) sendMessageToTopic(topic string, message api.Message) {
+	base := message.Base()
+	stampMessage(base)
+	codec := h.codecFor(topic, base.To)
+	sendData, err := codec.Marshal(message)
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
 
+	sendData = h.compress(topic, codec, base, sendData)
+	sendData, err = h.encryptForTopic(topic, codec, base, sendData)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if h.needsFragmentation(topic, base.To, sendData) {
+		h.sendFragments(topic, codec, base, sendData)
+		return
+	}
+	h.publish(topic, sendData)
+}
+
+func (h *Handler) publish(topic string, sendData []byte) {
 	go func() {
 		h.PbMutex.Lock()
 		h.pb.Publish(topic, sendData)
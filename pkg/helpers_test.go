@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	mapset "github.com/deckarep/golang-set"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+)
+
+// Creates handler which is not connected to the network
+func newTestHandler(t *testing.T) *Handler {
+	_, peerID := newTestPeer(t)
+	networkTopics := mapset.NewSet()
+	handler := NewHandler(nil, "moonshard", peerID, &networkTopics)
+	return &handler
+}
+
+// Creates random peer identity
+func newTestPeer(t *testing.T) (crypto.PrivKey, peer.ID) {
+	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, 0, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := peer.IDFromPrivateKey(prvKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prvKey, peerID
+}
+
+// Wraps message as if it was received from the network
+func newTestPubsubMessage(t *testing.T, from peer.ID, codec Codec, message interface{}) pubsub.Message {
+	data, err := codec.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubsub.Message{Message: &pb.Message{From: []byte(from), Data: data}}
+}
+
+// Creates handler which is not connected to the network, but has identity key set
+func newTestKeyedHandler(t *testing.T) *Handler {
+	prvKey, peerID := newTestPeer(t)
+	networkTopics := mapset.NewSet()
+	handler := NewHandler(nil, "moonshard", peerID, &networkTopics)
+	if err := handler.SetIdentityKey(prvKey); err != nil {
+		t.Fatal(err)
+	}
+	return &handler
+}
+
+// Delivers handshake of `from` to `to`, so `to` learns its keys
+func sendTestHandshake(t *testing.T, from *Handler, to *Handler) {
+	handshake := from.newHandshake(api.FlagHandshakeRespond, to.peerID.String())
+	handshake.Timestamp = nowMillis()
+	to.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, from.peerID, JSONCodec, handshake), nil, nil, nil)
+}
+
+// Creates handler on top of real host and pubsub
+func newTestNetworkHandler(t *testing.T, ctx context.Context) (host.Host, *Handler) {
+	testHost := bhost.New(swarmt.GenSwarm(t, ctx))
+	pb, err := pubsub.NewFloodSub(ctx, testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networkTopics := mapset.NewSet()
+	handler := NewHandler(pb, "moonshard", testHost.ID(), &networkTopics)
+	return testHost, &handler
+}
+
+// Creates network handler, whose identity key is the key of its host
+func newTestNetworkKeyedHandler(t *testing.T, ctx context.Context) (host.Host, *Handler) {
+	testHost, handler := newTestNetworkHandler(t, ctx)
+	if err := handler.SetIdentityKey(testHost.Peerstore().PrivKey(testHost.ID())); err != nil {
+		t.Fatal(err)
+	}
+	return testHost, handler
+}
+
+// Checks whether the handler has received sender key of the peer in the topic
+func hasSenderKey(h *Handler, topic string, peerID peer.ID) bool {
+	h.groups.mu.RLock()
+	defer h.groups.mu.RUnlock()
+	keys, ok := h.groups.members[memberKey(topic, peerID)]
+	return ok && keys.current != nil
+}
+
+// Connects hosts, so their pubsubs see each other
+func connectTestHosts(t *testing.T, ctx context.Context, hosts ...host.Host) {
+	for i := range hosts {
+		for j := 0; j < i; j++ {
+			if err := hosts[i].Connect(ctx, peer.AddrInfo{ID: hosts[j].ID(), Addrs: hosts[j].Addrs()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// Joins the topic and passes messages of other peers to the handler until ctx is done
+func joinTestTopic(t *testing.T, ctx context.Context, handler *Handler, topic string, handleTextMessage func(TextMessage)) {
+	subscription, err := handler.JoinTopic(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handleTextMessage == nil {
+		handleTextMessage = func(TextMessage) {}
+	}
+	noMatch := func(string, string, string) {}
+	go func() {
+		for {
+			msg, err := subscription.Next(ctx)
+			if err != nil {
+				return
+			}
+			if fromPeerID, err := peer.IDFromBytes(msg.From); err == nil && fromPeerID == handler.peerID {
+				continue
+			}
+			handler.HandleIncomingMessage(topic, *msg, handleTextMessage, noMatch, noMatch)
+		}
+	}()
+}
+
+// Waits until the condition is met, failing the test after timeout
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
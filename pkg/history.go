@@ -0,0 +1,187 @@
+package pkg
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DefaultHistoryLimit is how many messages handler keeps in local history
+const DefaultHistoryLimit = 10000
+
+type historyEntry struct {
+	message  TextMessage
+	author   peer.ID
+	redacted bool
+	// Reaction key => peers which have reacted with it
+	reactions map[string]map[peer.ID]bool
+}
+
+// messageHistory keeps recent text messages (both incoming and ours), so later messages can refer to them
+type messageHistory struct {
+	mu       sync.RWMutex
+	limit    int
+	messages map[string]*historyEntry
+	// IDs in order of arrival, the oldest messages are evicted first
+	order []string
+	// Thread root ID => IDs of replies in the thread
+	threads map[string][]string
+}
+
+func newMessageHistory(limit int) *messageHistory {
+	return &messageHistory{
+		limit:    limit,
+		messages: make(map[string]*historyEntry),
+		threads:  make(map[string][]string),
+	}
+}
+
+// Adds message to the history. The first author of the ID wins, so nobody can hijack ID of others' message
+func (mh *messageHistory) add(author peer.ID, message TextMessage) bool {
+	if message.ID == "" {
+		return false
+	}
+
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	if _, ok := mh.messages[message.ID]; ok {
+		return false
+	}
+	mh.messages[message.ID] = &historyEntry{message: message, author: author}
+	mh.order = append(mh.order, message.ID)
+	if message.ThreadRoot != "" {
+		mh.threads[message.ThreadRoot] = append(mh.threads[message.ThreadRoot], message.ID)
+	}
+	for len(mh.order) > mh.limit {
+		mh.evict(mh.order[0])
+		mh.order = mh.order[1:]
+	}
+	return true
+}
+
+func (mh *messageHistory) evict(id string) {
+	entry, ok := mh.messages[id]
+	if !ok {
+		return
+	}
+	delete(mh.messages, id)
+	root := entry.message.ThreadRoot
+	if root == "" {
+		return
+	}
+	replies := mh.threads[root]
+	for i, replyID := range replies {
+		if replyID == id {
+			replies = append(replies[:i], replies[i+1:]...)
+			break
+		}
+	}
+	if len(replies) == 0 {
+		delete(mh.threads, root)
+	} else {
+		mh.threads[root] = replies
+	}
+}
+
+// Returns root of the thread, which reply to the message belongs to
+func (mh *messageHistory) threadRootFor(replyTo string) string {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	if entry, ok := mh.messages[replyTo]; ok && entry.message.ThreadRoot != "" {
+		return entry.message.ThreadRoot
+	}
+	return replyTo
+}
+
+// Returns replies of the thread in order of their arrival
+func (mh *messageHistory) thread(root string) []TextMessage {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	var replies []TextMessage
+	for _, id := range mh.threads[root] {
+		if entry, ok := mh.messages[id]; ok && !entry.redacted {
+			replies = append(replies, entry.message)
+		}
+	}
+	return replies
+}
+
+func (mh *messageHistory) get(id string) (TextMessage, bool) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	entry, ok := mh.messages[id]
+	if !ok || entry.redacted {
+		return TextMessage{}, false
+	}
+	return entry.message, true
+}
+
+// Applies change to the message, if it exists in the topic and is authored by the peer
+func (mh *messageHistory) update(topic string, author peer.ID, id string, change func(entry *historyEntry)) bool {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	entry, ok := mh.messages[id]
+	if !ok || entry.redacted || entry.author != author || entry.message.Topic != topic {
+		return false
+	}
+	change(entry)
+	return true
+}
+
+// Adds or removes reaction of the peer, returns false if the message is unknown, nothing has changed
+// or the message already has MaxReactionKeys distinct keys
+func (mh *messageHistory) react(topic string, id string, key string, peerID peer.ID, remove bool) bool {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	entry, ok := mh.messages[id]
+	if !ok || entry.redacted || entry.message.Topic != topic {
+		return false
+	}
+	if entry.reactions == nil {
+		entry.reactions = make(map[string]map[peer.ID]bool)
+	}
+	peers := entry.reactions[key]
+	if remove {
+		if !peers[peerID] {
+			return false
+		}
+		delete(peers, peerID)
+		if len(peers) == 0 {
+			delete(entry.reactions, key)
+		}
+		return true
+	}
+	if peers == nil {
+		if len(entry.reactions) >= MaxReactionKeys {
+			return false
+		}
+		peers = make(map[peer.ID]bool)
+		entry.reactions[key] = peers
+	}
+	if peers[peerID] {
+		return false
+	}
+	peers[peerID] = true
+	return true
+}
+
+func (mh *messageHistory) reactions(id string) map[string][]peer.ID {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+	reactions := make(map[string][]peer.ID)
+	entry, ok := mh.messages[id]
+	if !ok || entry.redacted {
+		return reactions
+	}
+	for key, peers := range entry.reactions {
+		for peerID := range peers {
+			reactions[key] = append(reactions[key], peerID)
+		}
+	}
+	return reactions
+}
+
+// Returns message from local history by its ID
+func (h *Handler) GetMessage(id string) (TextMessage, bool) {
+	return h.history.get(id)
+}
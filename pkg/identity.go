@@ -0,0 +1,227 @@
+package pkg
+
+import (
+	"log"
+	"sync"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// IdentityLevel tells how much the Matrix ID claimed by the peer can be trusted
+type IdentityLevel int
+
+const (
+	// IdentityUnverified claim is not signed, Matrix ID is just asserted by the peer
+	IdentityUnverified IdentityLevel = iota
+	// IdentitySigned claim is signed by libp2p identity of the peer
+	IdentitySigned
+	// IdentityMatrixVerified claim is also countersigned by the Matrix key, which the application has approved
+	IdentityMatrixVerified
+)
+
+// Identity is Matrix ID claimed by the peer
+type Identity struct {
+	MatrixID string
+	Level    IdentityLevel
+	// MatrixKey has countersigned the claim, nil if the claim is not countersigned
+	MatrixKey crypto.PubKey
+	// Timestamp is the time when the claim was signed (unix ms)
+	Timestamp int64
+	// Verified is set if the user has verified the key pinned for Matrix ID
+	Verified bool
+}
+
+// IdentityEvent is emitted when the peer claims new Matrix ID or proves it better
+type IdentityEvent struct {
+	PeerID   peer.ID
+	Identity Identity
+}
+
+// identityClaims holds our signed claim and claims of peers
+type identityClaims struct {
+	mu        sync.RWMutex
+	matrixKey crypto.PrivKey
+	verifier  func(matrixID string, matrixKey crypto.PubKey) bool
+	own       *api.IdentityMessage
+	peers     map[peer.ID]Identity
+}
+
+func newIdentityClaims() *identityClaims {
+	return &identityClaims{
+		peers: make(map[peer.ID]Identity),
+	}
+}
+
+// Returns the data which is signed in the claim
+func identityClaimPayload(peerID peer.ID, matrixID string, timestamp int64) []byte {
+	payload := []byte(identityClaimPrefix)
+	for _, field := range []string{string(peerID), matrixID} {
+		payload = appendVarint(payload, uint64(len(field)))
+		payload = append(payload, field...)
+	}
+	return appendVarint(payload, uint64(timestamp))
+}
+
+// Sets the key of our Matrix account, which countersigns our claims of Matrix ID
+func (h *Handler) SetMatrixSigningKey(matrixKey crypto.PrivKey) {
+	h.claims.mu.Lock()
+	h.claims.matrixKey = matrixKey
+	h.claims.mu.Unlock()
+	h.signIdentityClaim()
+}
+
+// Sets callback, which checks that the key really belongs to the Matrix account (e.g. using its homeserver).
+// Only claims countersigned by approved keys are Matrix verified
+func (h *Handler) SetMatrixKeyVerifier(verifier func(matrixID string, matrixKey crypto.PubKey) bool) {
+	h.claims.mu.Lock()
+	defer h.claims.mu.Unlock()
+	h.claims.verifier = verifier
+}
+
+// Returns Matrix ID claimed by the peer with the level of its verification
+func (h *Handler) GetIdentity(peerID peer.ID) (Identity, bool) {
+	h.claims.mu.RLock()
+	identity, ok := h.claims.peers[peerID]
+	h.claims.mu.RUnlock()
+	if ok && identity.Level > IdentityUnverified {
+		pin, pinned := h.GetPinnedIdentity(identity.MatrixID)
+		identity.Verified = pinned && pin.Verified && pin.PeerID == peerID
+	}
+	return identity, ok
+}
+
+// Signs claim of our current Matrix ID, it's sent in identity responses
+func (h *Handler) signIdentityClaim() {
+	h.keys.mu.RLock()
+	identityKey := h.keys.identityKey
+	h.keys.mu.RUnlock()
+	h.claims.mu.Lock()
+	defer h.claims.mu.Unlock()
+	h.claims.own = nil
+	if identityKey == nil || h.matrixID == "" {
+		return
+	}
+
+	claim := &api.IdentityMessage{ClaimTimestamp: nowMillis()}
+	claim.FromMatrixID = h.matrixID
+	payload := identityClaimPayload(h.peerID, h.matrixID, claim.ClaimTimestamp)
+	var err error
+	if claim.IdentityKey, err = crypto.MarshalPublicKey(identityKey.GetPublic()); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if claim.ClaimSignature, err = identityKey.Sign(payload); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if h.claims.matrixKey != nil {
+		if claim.MatrixKey, err = crypto.MarshalPublicKey(h.claims.matrixKey.GetPublic()); err != nil {
+			log.Println(err.Error())
+			return
+		}
+		if claim.MatrixSignature, err = h.claims.matrixKey.Sign(payload); err != nil {
+			log.Println(err.Error())
+			return
+		}
+	}
+	h.claims.own = claim
+}
+
+// Creates identity message with our signed claim
+func (h *Handler) ownIdentityMessage(flag int, toPeerID string) *api.IdentityMessage {
+	message := &api.IdentityMessage{}
+	h.claims.mu.RLock()
+	if h.claims.own != nil && h.claims.own.FromMatrixID == h.matrixID {
+		*message = *h.claims.own
+	}
+	h.claims.mu.RUnlock()
+	message.Body = ""
+	message.Flag = flag
+	message.FromMatrixID = h.matrixID
+	message.To = toPeerID
+	return message
+}
+
+// Checks the claim, returning its level and Matrix key which has countersigned it
+func (h *Handler) verifyIdentityClaim(peerID peer.ID, message *api.IdentityMessage) (IdentityLevel, crypto.PubKey) {
+	if len(message.IdentityKey) == 0 || len(message.ClaimSignature) == 0 {
+		return IdentityUnverified, nil
+	}
+	identityKey, err := crypto.UnmarshalPublicKey(message.IdentityKey)
+	if err != nil || !peerID.MatchesPublicKey(identityKey) {
+		return IdentityUnverified, nil
+	}
+	payload := identityClaimPayload(peerID, message.FromMatrixID, message.ClaimTimestamp)
+	if ok, err := identityKey.Verify(payload, message.ClaimSignature); err != nil || !ok {
+		return IdentityUnverified, nil
+	}
+	if len(message.MatrixKey) == 0 {
+		return IdentitySigned, nil
+	}
+
+	matrixKey, err := crypto.UnmarshalPublicKey(message.MatrixKey)
+	if err != nil {
+		return IdentitySigned, nil
+	}
+	if ok, err := matrixKey.Verify(payload, message.MatrixSignature); err != nil || !ok {
+		return IdentitySigned, nil
+	}
+	h.claims.mu.RLock()
+	verifier := h.claims.verifier
+	h.claims.mu.RUnlock()
+	if verifier != nil && verifier(message.FromMatrixID, matrixKey) {
+		return IdentityMatrixVerified, matrixKey
+	}
+	return IdentitySigned, matrixKey
+}
+
+// Remembers Matrix ID claimed by the peer. Only signed claims of the pinned key get to identity map,
+// and unverified claim never replaces signed one
+func (h *Handler) updateIdentity(peerID peer.ID, message *api.IdentityMessage) {
+	if message.FromMatrixID == "" {
+		return
+	}
+	level, matrixKey := h.verifyIdentityClaim(peerID, message)
+	if level > IdentityUnverified {
+		switch h.checkPin(peerID, message.FromMatrixID) {
+		case pinConflict:
+			return
+		case pinUnavailable:
+			level, matrixKey = IdentityUnverified, nil
+		}
+	}
+	identity := Identity{
+		MatrixID:  message.FromMatrixID,
+		Level:     level,
+		MatrixKey: matrixKey,
+		Timestamp: message.ClaimTimestamp,
+	}
+
+	h.claims.mu.Lock()
+	known, ok := h.claims.peers[peerID]
+	if ok && known.Level > IdentityUnverified {
+		if level == IdentityUnverified || identity.Timestamp < known.Timestamp {
+			h.claims.mu.Unlock()
+			log.Println("Ignoring outdated or unverified Matrix ID claim of " + peerID.String())
+			return
+		}
+	}
+	changed := !ok || known.MatrixID != identity.MatrixID || known.Level != identity.Level
+	h.claims.peers[peerID] = identity
+	h.claims.mu.Unlock()
+
+	if level > IdentityUnverified {
+		h.mu.Lock()
+		h.identityMap[peer.ID(peerID.String())] = identity.MatrixID
+		h.mu.Unlock()
+	}
+	if changed {
+		h.emitEvent(&IdentityEvent{PeerID: peerID, Identity: identity})
+	}
+}
+
+func newIdentityMessage() api.Message {
+	return &api.IdentityMessage{}
+}
@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestIdentityClaims(t *testing.T) {
+	alice, bob, mallory := newTestKeyedHandler(t), newTestKeyedHandler(t), newTestKeyedHandler(t)
+	alice.SetMatrixID("@alice:moonshard")
+	deliver := func(from peer.ID, message *api.IdentityMessage) {
+		message.Timestamp = nowMillis()
+		bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, from, JSONCodec, message), nil, nil, nil)
+	}
+
+	// Mallory replays the claim of Alice
+	deliver(mallory.peerID, alice.ownIdentityMessage(api.FlagIdentityResponse, ""))
+	if identity, ok := bob.GetIdentity(mallory.peerID); !ok || identity.Level != IdentityUnverified {
+		t.Fatal("claim signed by another peer is not reported as unverified")
+	}
+	if _, ok := bob.GetIdentityMap()[peer.ID(mallory.peerID.String())]; ok {
+		t.Fatal("unverified claim is added to identity map")
+	}
+
+	deliver(alice.peerID, alice.ownIdentityMessage(api.FlagIdentityResponse, ""))
+	if identity, ok := bob.GetIdentity(alice.peerID); !ok || identity.Level != IdentitySigned || identity.MatrixID != "@alice:moonshard" {
+		t.Fatalf("signed claim is not verified: %+v", identity)
+	}
+	if bob.GetIdentityMap()[peer.ID(alice.peerID.String())] != "@alice:moonshard" {
+		t.Fatal("verified claim is not added to identity map")
+	}
+	delete(bob.GetIdentityMap(), peer.ID(alice.peerID.String()))
+	if _, ok := bob.GetIdentityMap()[peer.ID(alice.peerID.String())]; !ok {
+		t.Fatal("identity map is not copied")
+	}
+
+	// Unsigned claim doesn't replace the signed one
+	unsigned := &api.IdentityMessage{BaseMessage: api.BaseMessage{Flag: api.FlagIdentityResponse, FromMatrixID: "@mallory:moonshard"}}
+	deliver(alice.peerID, unsigned)
+	if identity, _ := bob.GetIdentity(alice.peerID); identity.MatrixID != "@alice:moonshard" {
+		t.Fatal("unsigned claim replaces signed one")
+	}
+}
+
+func TestMatrixCountersignature(t *testing.T) {
+	alice, bob := newTestKeyedHandler(t), newTestKeyedHandler(t)
+	matrixKey, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.SetMatrixSigningKey(matrixKey)
+	alice.SetMatrixID("@alice:moonshard")
+
+	var approved crypto.PubKey
+	bob.SetMatrixKeyVerifier(func(matrixID string, key crypto.PubKey) bool {
+		return matrixID == "@alice:moonshard" && key.Equals(approved)
+	})
+	var events []*IdentityEvent
+	bob.SetEventHandler(func(event Event) {
+		if identityEvent, ok := event.(*IdentityEvent); ok {
+			events = append(events, identityEvent)
+		}
+	})
+
+	for _, key := range []crypto.PubKey{nil, matrixKey.GetPublic()} {
+		approved = key
+		message := alice.ownIdentityMessage(api.FlagIdentityResponse, "")
+		message.Timestamp = nowMillis()
+		bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, ProtobufCodec, message), nil, nil, nil)
+	}
+	if len(events) != 2 || events[0].Identity.Level != IdentitySigned || events[1].Identity.Level != IdentityMatrixVerified {
+		t.Fatal("countersigned claim is verified only with approved Matrix key")
+	}
+}
@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+func encodeJournalRecords(records []interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// Replaces the journal atomically with the records
+func writeJournal(path string, records []interface{}) error {
+	data, err := encodeJournalRecords(records)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Appends records to the journal, which is the file of JSON records, one per line.
+// Journal of changes is rewritten with the current state, when it has too many records
+func appendJournal(path string, records []interface{}) error {
+	data, err := encodeJournalRecords(records)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Decodes every record of the journal with newRecord and passes it to apply, returns the number of records
+func readJournal(path string, newRecord func() interface{}, apply func(interface{})) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	records := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record := newRecord()
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			// Last record may be torn if we have crashed while appending it
+			log.Println("Skipping malformed record of " + path + ": " + err.Error())
+			continue
+		}
+		records++
+		apply(record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,162 @@
+package pkg
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keystoreVersion = 1
+	// Parameters of scrypt, which derives encryption key of the keystore from the passphrase
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	// Limits of scrypt parameters, which are accepted from the file
+	maxScryptN  = 1 << 20
+	maxScryptRP = 64
+	// rsaKeyBits is the size of generated RSA identity keys
+	rsaKeyBits = 2048
+)
+
+// keystoreFile is the format of identity file, private key is encrypted with the key derived from the passphrase
+type keystoreFile struct {
+	Version int `json:"version"`
+	// KeyType is the name of the key type, it's authenticated along with the ciphertext
+	KeyType    string `json:"keyType"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+var keyTypeNames = map[int]string{
+	crypto.RSA:     "RSA",
+	crypto.Ed25519: "Ed25519",
+}
+
+// Loads identity key from the file, creating new key of keyType (crypto.Ed25519 or crypto.RSA) if the file doesn't exist
+func LoadOrCreateIdentity(path string, keyType int, passphrase []byte) (crypto.PrivKey, error) {
+	prvKey, err := LoadIdentity(path, passphrase)
+	if os.IsNotExist(err) {
+		return CreateIdentity(path, keyType, passphrase)
+	}
+	return prvKey, err
+}
+
+// Generates new identity key of keyType (crypto.Ed25519 or crypto.RSA) and saves it encrypted with the passphrase
+func CreateIdentity(path string, keyType int, passphrase []byte) (crypto.PrivKey, error) {
+	if _, ok := keyTypeNames[keyType]; !ok {
+		return nil, errors.New("unsupported key type")
+	}
+	prvKey, _, err := crypto.GenerateKeyPairWithReader(keyType, rsaKeyBits, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = SaveIdentity(path, prvKey, passphrase); err != nil {
+		return nil, err
+	}
+	return prvKey, nil
+}
+
+// Saves identity key encrypted with the passphrase, the file is readable only by the owner
+func SaveIdentity(path string, prvKey crypto.PrivKey, passphrase []byte) error {
+	keyType, ok := keyTypeNames[int(prvKey.Type())]
+	if !ok {
+		return errors.New("unsupported key type")
+	}
+	if len(passphrase) == 0 {
+		return errors.New("passphrase is empty")
+	}
+	rawKey, err := crypto.MarshalPrivateKey(prvKey)
+	if err != nil {
+		return err
+	}
+
+	file := &keystoreFile{
+		Version: keystoreVersion,
+		KeyType: keyType,
+		Salt:    make([]byte, 32),
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Nonce:   make([]byte, chacha20poly1305.NonceSize),
+	}
+	if _, err = rand.Read(file.Salt); err != nil {
+		return err
+	}
+	if _, err = rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	aead, err := file.aead(passphrase)
+	if err != nil {
+		return err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, rawKey, []byte(file.KeyType))
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Loads identity key, which was saved encrypted with the passphrase
+func LoadIdentity(path string, passphrase []byte) (crypto.PrivKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &keystoreFile{}
+	if err = json.Unmarshal(data, file); err != nil {
+		return nil, err
+	}
+	if file.Version != keystoreVersion {
+		return nil, errors.New("unsupported version of identity file")
+	}
+
+	aead, err := file.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, errors.New("malformed identity file")
+	}
+	rawKey, err := aead.Open(nil, file.Nonce, file.Ciphertext, []byte(file.KeyType))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted identity file")
+	}
+	prvKey, err := crypto.UnmarshalPrivateKey(rawKey)
+	if err != nil {
+		return nil, err
+	}
+	if keyTypeNames[int(prvKey.Type())] != file.KeyType {
+		return nil, errors.New("key type doesn't match identity file")
+	}
+	return prvKey, nil
+}
+
+// Derives cipher from the passphrase, parameters of the file are limited so it can't make us spend too much memory
+func (f *keystoreFile) aead(passphrase []byte) (cipher.AEAD, error) {
+	if f.N > maxScryptN || f.R*f.P > maxScryptRP {
+		return nil, errors.New("scrypt parameters of identity file are too large")
+	}
+	key, err := scrypt.Key(passphrase, f.Salt, f.N, f.R, f.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
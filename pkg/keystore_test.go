@@ -0,0 +1,36 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+func TestKeystore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "p2chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, keyType := range []int{crypto.Ed25519, crypto.RSA} {
+		path := filepath.Join(tempDir, keyTypeNames[keyType]+".key")
+		created, err := LoadOrCreateIdentity(path, keyType, []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadOrCreateIdentity(path, keyType, []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !created.Equals(loaded) {
+			t.Fatalf("%s: loaded key differs from the created one", keyTypeNames[keyType])
+		}
+		if _, err = LoadIdentity(path, []byte("wrong")); err == nil {
+			t.Fatalf("%s: key is loaded with wrong passphrase", keyTypeNames[keyType])
+		}
+	}
+}
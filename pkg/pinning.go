@@ -0,0 +1,271 @@
+package pkg
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// PinnedIdentity is the key which was first seen with the Matrix ID, it's trusted on first use
+type PinnedIdentity struct {
+	MatrixID string  `json:"matrixID"`
+	PeerID   peer.ID `json:"peerID"`
+	// FirstSeen is the time when the identity was pinned (unix ms)
+	FirstSeen int64 `json:"firstSeen"`
+	// Verified is set by the application, when the user has compared the keys out of band
+	Verified bool `json:"verified"`
+}
+
+// IdentityKeyChangedEvent is emitted when the Matrix ID is claimed by another key than the pinned one.
+// Claim of the new key is ignored until the application verifies it
+type IdentityKeyChangedEvent struct {
+	MatrixID     string
+	PinnedPeerID peer.ID
+	PeerID       peer.ID
+	// Verified is set if the pinned identity was verified by the user
+	Verified bool
+}
+
+const (
+	// DefaultMaxPinnedIdentities is how many identities are pinned on first use, claims of new Matrix IDs aren't trusted above it
+	DefaultMaxPinnedIdentities = 10000
+	// minPinJournal is the number of records, which the file may have before it's compacted
+	minPinJournal = 100
+)
+
+// pinRecord is the line of the pin file, which is the journal of changes
+type pinRecord struct {
+	PinnedIdentity
+	// Unpinned is set when the identity is unpinned
+	Unpinned bool `json:"unpinned,omitempty"`
+}
+
+// Result of checking the claim against the pinned identity
+type pinResult int
+
+const (
+	pinTrusted pinResult = iota
+	// pinConflict means that the Matrix ID is pinned to another key
+	pinConflict
+	// pinUnavailable means that the Matrix ID is new, but it can't be pinned, so the claim isn't trusted
+	pinUnavailable
+)
+
+// pinStore holds pinned identities, which are persisted in path
+type pinStore struct {
+	mu    sync.RWMutex
+	path  string
+	pins  map[string]*PinnedIdentity
+	limit int
+	// Changes which aren't written yet. They are queued under mu and appended to the file in order under fileMu
+	queue  []interface{}
+	fileMu sync.Mutex
+	// Number of records in the file, it's compacted when it has much more records than pins
+	records int
+}
+
+func newPinStore() *pinStore {
+	return &pinStore{
+		pins:  make(map[string]*PinnedIdentity),
+		limit: DefaultMaxPinnedIdentities,
+	}
+}
+
+// Queues the change of the pin to be written after unlocking. Must be called with locked mutex
+func (s *pinStore) record(pin *PinnedIdentity, unpinned bool) {
+	if s.path != "" {
+		s.queue = append(s.queue, &pinRecord{PinnedIdentity: *pin, Unpinned: unpinned})
+	}
+}
+
+// Writes queued changes, compacting the file if it has too many records. Must be called with unlocked mutex
+func (s *pinStore) flush() {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	s.mu.Lock()
+	path, records := s.path, s.queue
+	s.queue = nil
+	var compacted []interface{}
+	if s.records+len(records) > 2*len(s.pins)+minPinJournal {
+		compacted = make([]interface{}, 0, len(s.pins))
+		for _, pin := range s.pins {
+			compacted = append(compacted, &pinRecord{PinnedIdentity: *pin})
+		}
+	}
+	s.mu.Unlock()
+	if path == "" || len(records) == 0 {
+		return
+	}
+
+	var err error
+	if compacted != nil {
+		if err = writeJournal(path, compacted); err == nil {
+			s.records = len(compacted)
+		}
+	} else if err = appendJournal(path, records); err == nil {
+		s.records += len(records)
+	}
+	if err != nil {
+		log.Println("Failed to save pinned identities: " + err.Error())
+	}
+}
+
+// Replays the journal of changes, returns pins and the number of records
+func readPinFile(path string) (map[string]*PinnedIdentity, int, error) {
+	pins := make(map[string]*PinnedIdentity)
+	records, err := readJournal(path, func() interface{} {
+		return &pinRecord{}
+	}, func(value interface{}) {
+		record := value.(*pinRecord)
+		if record.Unpinned {
+			delete(pins, record.MatrixID)
+			return
+		}
+		pin := record.PinnedIdentity
+		pins[record.MatrixID] = &pin
+	})
+	return pins, records, err
+}
+
+// Loads pinned identities from the file and appends every change there
+func (h *Handler) EnableIdentityPinStore(path string) error {
+	pins, records, err := readPinFile(path)
+	if err != nil {
+		return err
+	}
+
+	h.pins.fileMu.Lock()
+	h.pins.mu.Lock()
+	// Identities pinned before the store is enabled are kept, unless the file knows better
+	h.pins.queue = nil
+	for matrixID, pin := range h.pins.pins {
+		if _, ok := pins[matrixID]; !ok {
+			pins[matrixID] = pin
+			h.pins.queue = append(h.pins.queue, &pinRecord{PinnedIdentity: *pin})
+		}
+	}
+	h.pins.path = path
+	h.pins.pins = pins
+	h.pins.records = records
+	h.pins.mu.Unlock()
+	h.pins.fileMu.Unlock()
+	h.pins.flush()
+	return nil
+}
+
+// Sets how many identities are pinned on first use. Verified identities are pinned regardless of the limit
+func (h *Handler) SetMaxPinnedIdentities(limit int) {
+	h.pins.mu.Lock()
+	defer h.pins.mu.Unlock()
+	h.pins.limit = limit
+}
+
+// Returns identity pinned for the Matrix ID
+func (h *Handler) GetPinnedIdentity(matrixID string) (PinnedIdentity, bool) {
+	h.pins.mu.RLock()
+	defer h.pins.mu.RUnlock()
+	pin, ok := h.pins.pins[matrixID]
+	if !ok {
+		return PinnedIdentity{}, false
+	}
+	return *pin, true
+}
+
+// Returns peer IDs, which are pinned for some Matrix ID
+func (h *Handler) pinnedPeers() map[peer.ID]bool {
+	h.pins.mu.RLock()
+	defer h.pins.mu.RUnlock()
+	peers := make(map[peer.ID]bool, len(h.pins.pins))
+	for _, pin := range h.pins.pins {
+		peers[pin.PeerID] = true
+	}
+	return peers
+}
+
+// Marks the key as verified for the Matrix ID, pinning it instead of the previous one.
+// Application calls it when the user has compared the keys out of band
+func (h *Handler) VerifyIdentity(matrixID string, peerID peer.ID) error {
+	if matrixID == "" || peerID == "" {
+		return errors.New("matrix ID and peer ID must be set")
+	}
+	h.pins.mu.Lock()
+	pin, ok := h.pins.pins[matrixID]
+	if !ok || pin.PeerID != peerID {
+		pin = &PinnedIdentity{MatrixID: matrixID, PeerID: peerID, FirstSeen: nowMillis()}
+		h.pins.pins[matrixID] = pin
+	}
+	pin.Verified = true
+	h.pins.record(pin, false)
+	h.pins.mu.Unlock()
+	h.pins.flush()
+
+	// Claim of the key may have been ignored before, so it's mapped now
+	if identity, ok := h.GetIdentity(peerID); ok && identity.MatrixID == matrixID && identity.Level > IdentityUnverified {
+		h.mu.Lock()
+		h.identityMap[peer.ID(peerID.String())] = matrixID
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// Forgets the identity pinned for the Matrix ID, so the next key claiming it is trusted on first use
+func (h *Handler) UnpinIdentity(matrixID string) {
+	h.pins.mu.Lock()
+	if pin, ok := h.pins.pins[matrixID]; ok {
+		delete(h.pins.pins, matrixID)
+		h.pins.record(pin, true)
+	}
+	h.pins.mu.Unlock()
+	h.pins.flush()
+}
+
+// Checks the signed claim against the pinned identity, pinning it if the Matrix ID is new.
+// Claims of new Matrix IDs aren't trusted when too many identities are pinned, so they can't be used to bypass pinning
+func (h *Handler) checkPin(peerID peer.ID, matrixID string) pinResult {
+	if matrixID == h.matrixID && peerID != h.peerID {
+		log.Println("Peer " + peerID.String() + " claims our Matrix ID " + matrixID)
+		h.emitEvent(&IdentityKeyChangedEvent{MatrixID: matrixID, PinnedPeerID: h.peerID, PeerID: peerID})
+		return pinConflict
+	}
+
+	h.pins.mu.Lock()
+	pin, ok := h.pins.pins[matrixID]
+	if !ok && len(h.pins.pins) >= h.pins.limit {
+		h.pins.mu.Unlock()
+		log.Println("Too many pinned identities, claim of " + matrixID + " by " + peerID.String() + " is not trusted")
+		return pinUnavailable
+	}
+	if !ok {
+		pin = &PinnedIdentity{MatrixID: matrixID, PeerID: peerID, FirstSeen: nowMillis()}
+		h.pins.pins[matrixID] = pin
+		h.pins.record(pin, false)
+		h.pins.mu.Unlock()
+		h.pins.flush()
+		return pinTrusted
+	}
+	if pin.PeerID == peerID {
+		h.pins.mu.Unlock()
+		return pinTrusted
+	}
+	event := &IdentityKeyChangedEvent{MatrixID: matrixID, PinnedPeerID: pin.PeerID, PeerID: peerID, Verified: pin.Verified}
+	h.pins.mu.Unlock()
+
+	log.Println("Matrix ID " + matrixID + " is pinned to " + event.PinnedPeerID.String() + ", but claimed by " + peerID.String())
+	h.emitEvent(event)
+	return pinConflict
+}
+
+// Moves pins of the peer to its new key, the rotation is vouched by the pinned key
+func (h *Handler) migratePins(oldPeerID peer.ID, newPeerID peer.ID) {
+	h.pins.mu.Lock()
+	for _, pin := range h.pins.pins {
+		if pin.PeerID == oldPeerID {
+			pin.PeerID = newPeerID
+			h.pins.record(pin, false)
+		}
+	}
+	h.pins.mu.Unlock()
+	h.pins.flush()
+}
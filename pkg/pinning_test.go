@@ -0,0 +1,166 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestIdentityPinning(t *testing.T) {
+	alice, bob, mallory := newTestKeyedHandler(t), newTestKeyedHandler(t), newTestKeyedHandler(t)
+	alice.SetMatrixID("@alice:moonshard")
+	mallory.SetMatrixID("@alice:moonshard")
+	deliver := func(from *Handler) {
+		message := from.ownIdentityMessage(api.FlagIdentityResponse, "")
+		message.Timestamp = nowMillis()
+		bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, from.peerID, JSONCodec, message), nil, nil, nil)
+	}
+	var events []*IdentityKeyChangedEvent
+	bob.SetEventHandler(func(event Event) {
+		if changedEvent, ok := event.(*IdentityKeyChangedEvent); ok {
+			events = append(events, changedEvent)
+		}
+	})
+
+	deliver(alice)
+	if pin, ok := bob.GetPinnedIdentity("@alice:moonshard"); !ok || pin.PeerID != alice.peerID || pin.Verified {
+		t.Fatal("identity is not pinned on first use")
+	}
+
+	// Mallory signs the claim with its own key, but Matrix ID is already pinned
+	deliver(mallory)
+	if len(events) != 1 || events[0].PinnedPeerID != alice.peerID || events[0].PeerID != mallory.peerID {
+		t.Fatal("key change is not reported")
+	}
+	if _, ok := bob.GetIdentityMap()[peer.ID(mallory.peerID.String())]; ok {
+		t.Fatal("claim of another key is added to identity map")
+	}
+
+	// User has checked that the new key is right
+	if err := bob.VerifyIdentity("@alice:moonshard", mallory.peerID); err != nil {
+		t.Fatal(err)
+	}
+	deliver(mallory)
+	if pin, _ := bob.GetPinnedIdentity("@alice:moonshard"); pin.PeerID != mallory.peerID || !pin.Verified {
+		t.Fatal("verified key is not pinned")
+	}
+	if len(events) != 1 || bob.GetIdentityMap()[peer.ID(mallory.peerID.String())] != "@alice:moonshard" {
+		t.Fatal("claim of verified key is rejected")
+	}
+}
+
+func TestIdentityPinStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2chat-pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pins.json")
+
+	bob := newTestKeyedHandler(t)
+	_, alicePeerID := newTestPeer(t)
+	if err = bob.VerifyIdentity("@alice:moonshard", alicePeerID); err != nil {
+		t.Fatal(err)
+	}
+	if err = bob.EnableIdentityPinStore(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestKeyedHandler(t)
+	if err = restarted.EnableIdentityPinStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if pin, ok := restarted.GetPinnedIdentity("@alice:moonshard"); !ok || pin.PeerID != alicePeerID || !pin.Verified {
+		t.Fatal("pinned identity is not persisted")
+	}
+	restarted.UnpinIdentity("@alice:moonshard")
+	if _, ok := restarted.GetPinnedIdentity("@alice:moonshard"); ok {
+		t.Fatal("identity is not unpinned")
+	}
+}
+
+func TestPinLimit(t *testing.T) {
+	alice, bob, carol := newTestKeyedHandler(t), newTestKeyedHandler(t), newTestKeyedHandler(t)
+	alice.SetMatrixID("@alice:moonshard")
+	carol.SetMatrixID("@carol:moonshard")
+	bob.SetMaxPinnedIdentities(1)
+	deliver := func(from *Handler) {
+		message := from.ownIdentityMessage(api.FlagIdentityResponse, "")
+		message.Timestamp = nowMillis()
+		bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, from.peerID, JSONCodec, message), nil, nil, nil)
+	}
+
+	deliver(alice)
+	if _, ok := bob.GetIdentityMap()[peer.ID(alice.peerID.String())]; !ok {
+		t.Fatal("claim of the new Matrix ID is rejected")
+	}
+	// Claims above the limit can't be pinned, so they aren't trusted
+	deliver(carol)
+	if _, ok := bob.GetPinnedIdentity("@carol:moonshard"); ok {
+		t.Fatal("identity is pinned above the limit")
+	}
+	if _, ok := bob.GetIdentityMap()[peer.ID(carol.peerID.String())]; ok {
+		t.Fatal("claim above the limit is trusted")
+	}
+	if identity, ok := bob.GetIdentity(carol.peerID); !ok || identity.Level != IdentityUnverified {
+		t.Fatalf("claim above the limit is not reported as unverified: %+v", identity)
+	}
+
+	if err := bob.VerifyIdentity("@carol:moonshard", carol.peerID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bob.GetPinnedIdentity("@carol:moonshard"); !ok {
+		t.Fatal("verified identity is not pinned above the limit")
+	}
+}
+
+func TestPinJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2chat-pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pins.json")
+
+	bob := newTestKeyedHandler(t)
+	if err = bob.EnableIdentityPinStore(path); err != nil {
+		t.Fatal(err)
+	}
+	_, alicePeerID := newTestPeer(t)
+	_, carolPeerID := newTestPeer(t)
+	bob.checkPin(alicePeerID, "@alice:moonshard")
+	bob.checkPin(carolPeerID, "@carol:moonshard")
+	bob.UnpinIdentity("@alice:moonshard")
+	// Changes are appended, the file isn't rewritten
+	if bob.pins.records != 3 {
+		t.Fatalf("%d records are written instead of 3", bob.pins.records)
+	}
+
+	restarted := newTestKeyedHandler(t)
+	if err = restarted.EnableIdentityPinStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.GetPinnedIdentity("@alice:moonshard"); ok {
+		t.Fatal("unpinned identity is loaded")
+	}
+	if pin, ok := restarted.GetPinnedIdentity("@carol:moonshard"); !ok || pin.PeerID != carolPeerID {
+		t.Fatal("pinned identity is not loaded")
+	}
+
+	// File is compacted when it has too many records
+	for i := 0; i < minPinJournal; i++ {
+		restarted.UnpinIdentity("@carol:moonshard")
+		restarted.checkPin(carolPeerID, "@carol:moonshard")
+	}
+	if restarted.pins.records > 2+minPinJournal {
+		t.Fatalf("file with %d records is not compacted", restarted.pins.records)
+	}
+	pins, _, err := readPinFile(path)
+	if err != nil || len(pins) != 1 || pins["@carol:moonshard"] == nil {
+		t.Fatalf("wrong pins after compaction: %v, %v", pins, err)
+	}
+}
@@ -0,0 +1,312 @@
+package pkg
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// TopicInvite is the token, which lets the member into private topic. It's signed by the topic creator
+// and is passed to the member out of band (e.g. in direct message)
+type TopicInvite struct {
+	Topic string `json:"topic"`
+	// CreatorKey is marshalled public key of the topic creator
+	CreatorKey []byte  `json:"creatorKey"`
+	Member     peer.ID `json:"member"`
+	// Expires is the time when the invite expires (unix ms), zero if it doesn't expire
+	Expires   int64  `json:"expires,omitempty"`
+	Signature []byte `json:"signature"`
+}
+
+// privateTopic holds members of the topic, who have presented their invites
+type privateTopic struct {
+	creator peer.ID
+	own     *TopicInvite
+	// Members map to expiration time of their invites
+	members map[peer.ID]int64
+}
+
+type privateTopics struct {
+	mu     sync.RWMutex
+	topics map[string]*privateTopic
+}
+
+func newPrivateTopics() *privateTopics {
+	return &privateTopics{
+		topics: make(map[string]*privateTopic),
+	}
+}
+
+// Returns the data which is signed in the invite
+func topicInvitePayload(topic string, member peer.ID, expires int64) []byte {
+	payload := []byte(topicInvitePrefix)
+	for _, field := range []string{topic, string(member)} {
+		payload = appendVarint(payload, uint64(len(field)))
+		payload = append(payload, field...)
+	}
+	return appendVarint(payload, uint64(expires))
+}
+
+// Checks signature and expiration of the invite, returning peer ID of its creator
+func verifyTopicInvite(invite *TopicInvite) (peer.ID, error) {
+	if invite.Expires != 0 && invite.Expires < nowMillis() {
+		return "", errors.New("invite has expired")
+	}
+	creatorKey, err := crypto.UnmarshalPublicKey(invite.CreatorKey)
+	if err != nil {
+		return "", err
+	}
+	creator, err := peer.IDFromPublicKey(creatorKey)
+	if err != nil {
+		return "", err
+	}
+	payload := topicInvitePayload(invite.Topic, invite.Member, invite.Expires)
+	if ok, err := creatorKey.Verify(payload, invite.Signature); err != nil || !ok {
+		return "", errors.New("invalid signature of invite")
+	}
+	return creator, nil
+}
+
+// Makes the topic private, we become its creator and the only member. Others join it with our invites
+func (h *Handler) CreatePrivateTopic(topic string) error {
+	h.private.mu.RLock()
+	_, ok := h.private.topics[topic]
+	h.private.mu.RUnlock()
+	if ok {
+		return errors.New("topic " + topic + " is already private")
+	}
+	own, err := h.signTopicInvite(topic, h.peerID, 0)
+	if err != nil {
+		return err
+	}
+
+	h.private.mu.Lock()
+	h.private.topics[topic] = &privateTopic{
+		creator: h.peerID,
+		own:     own,
+		members: map[peer.ID]int64{h.peerID: 0},
+	}
+	h.private.mu.Unlock()
+	// Messages are readable only by members, sender key is shared with them when they present their invites
+	_, err = h.startGroupSession(topic)
+	return err
+}
+
+// Creates invite of the peer to our private topic, it expires after ttl (never if ttl is zero)
+func (h *Handler) CreateTopicInvite(topic string, member peer.ID, ttl time.Duration) (*TopicInvite, error) {
+	h.private.mu.RLock()
+	private, ok := h.private.topics[topic]
+	h.private.mu.RUnlock()
+	if !ok || private.creator != h.peerID {
+		return nil, errors.New("we are not the creator of private topic " + topic)
+	}
+	var expires int64
+	if ttl != 0 {
+		expires = nowMillis() + int64(ttl/time.Millisecond)
+	}
+	return h.signTopicInvite(topic, member, expires)
+}
+
+func (h *Handler) signTopicInvite(topic string, member peer.ID, expires int64) (*TopicInvite, error) {
+	h.keys.mu.RLock()
+	identityKey := h.keys.identityKey
+	h.keys.mu.RUnlock()
+	if identityKey == nil {
+		return nil, errors.New("identity key is not set")
+	}
+
+	invite := &TopicInvite{Topic: topic, Member: member, Expires: expires}
+	var err error
+	if invite.CreatorKey, err = crypto.MarshalPublicKey(identityKey.GetPublic()); err != nil {
+		return nil, err
+	}
+	if invite.Signature, err = identityKey.Sign(topicInvitePayload(topic, member, expires)); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// Accepts invite to private topic, it must be accepted before joining the topic
+func (h *Handler) AcceptTopicInvite(invite *TopicInvite) error {
+	if invite.Member != h.peerID {
+		return errors.New("invite is issued to another peer")
+	}
+	creator, err := verifyTopicInvite(invite)
+	if err != nil {
+		return err
+	}
+
+	h.private.mu.Lock()
+	private, ok := h.private.topics[invite.Topic]
+	if ok && private.creator != creator {
+		h.private.mu.Unlock()
+		return errors.New("topic " + invite.Topic + " is already created by another peer")
+	}
+	if !ok {
+		private = &privateTopic{
+			creator: creator,
+			members: map[peer.ID]int64{creator: 0},
+		}
+		h.private.topics[invite.Topic] = private
+	}
+	private.own = invite
+	private.members[h.peerID] = invite.Expires
+	h.private.mu.Unlock()
+	_, err = h.startGroupSession(invite.Topic)
+	return err
+}
+
+// Checks whether the topic is private
+func (h *Handler) IsPrivateTopic(topic string) bool {
+	h.private.mu.RLock()
+	defer h.private.mu.RUnlock()
+	_, ok := h.private.topics[topic]
+	return ok
+}
+
+// Returns members of private topic, who have presented their invites
+func (h *Handler) GetTopicMembers(topic string) []peer.ID {
+	h.private.mu.RLock()
+	defer h.private.mu.RUnlock()
+	private, ok := h.private.topics[topic]
+	if !ok {
+		return nil
+	}
+	members := []peer.ID{}
+	for member := range private.members {
+		if isTopicMember(private, member) {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+func isTopicMember(private *privateTopic, peerID peer.ID) bool {
+	expires, ok := private.members[peerID]
+	return ok && (expires == 0 || expires >= nowMillis())
+}
+
+// Checks whether the peer may post to the topic, every peer may post to public topics
+func (h *Handler) isTopicMember(topic string, peerID peer.ID) bool {
+	h.private.mu.RLock()
+	defer h.private.mu.RUnlock()
+	private, ok := h.private.topics[topic]
+	return !ok || isTopicMember(private, peerID)
+}
+
+// Returns our topics, which may be announced to the peer. Private topics are announced only to their members
+func (h *Handler) topicsFor(peerID peer.ID) []string {
+	topics := []string{}
+	for _, topic := range h.GetTopics() {
+		if h.isTopicMember(topic, peerID) {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// Remembers the member, if its invite is signed by creator of the topic
+func (h *Handler) addTopicMember(fromPeerID peer.ID, message *api.TopicInviteMessage) error {
+	member, err := peer.IDB58Decode(message.Member)
+	if err != nil {
+		return errors.New("malformed member of invite")
+	}
+	invite := &TopicInvite{
+		Topic:      message.Topic,
+		CreatorKey: message.CreatorKey,
+		Member:     member,
+		Expires:    message.Expires,
+		Signature:  message.Signature,
+	}
+	if invite.Member != fromPeerID {
+		return errors.New("invite is issued to another peer")
+	}
+	creator, err := verifyTopicInvite(invite)
+	if err != nil {
+		return err
+	}
+
+	h.private.mu.Lock()
+	defer h.private.mu.Unlock()
+	private, ok := h.private.topics[invite.Topic]
+	if !ok || private.creator != creator {
+		return errors.New("invite is not signed by creator of the topic")
+	}
+	private.members[fromPeerID] = invite.Expires
+	return nil
+}
+
+// Validates the message in private topic: senders must be members, or present their invites
+func (h *Handler) checkMembership(topic string, fromPeerID peer.ID, decoded *decodedData) error {
+	if h.isTopicMember(topic, fromPeerID) {
+		return nil
+	}
+	message, ok := decoded.message.(*api.TopicInviteMessage)
+	if !ok || decoded.header.Flag != api.FlagTopicInvite {
+		return errors.New("sender is not a member of private topic")
+	}
+	if message.Topic != topic {
+		return errors.New("invite is issued for another topic")
+	}
+	return h.addTopicMember(fromPeerID, message)
+}
+
+// Presents our invite in private topic, so its members accept our messages
+func (h *Handler) presentInvite(topic string, toPeerID string) {
+	h.private.mu.RLock()
+	private, ok := h.private.topics[topic]
+	var own *TopicInvite
+	if ok {
+		own = private.own
+	}
+	h.private.mu.RUnlock()
+	if own == nil {
+		return
+	}
+
+	message := own.message()
+	message.FromMatrixID = h.matrixID
+	message.To = toPeerID
+	h.sendMessageToTopic(topic, message)
+}
+
+// Creates message, which presents the invite
+func (invite *TopicInvite) message() *api.TopicInviteMessage {
+	return &api.TopicInviteMessage{
+		BaseMessage: api.BaseMessage{
+			Body: "",
+			Flag: api.FlagTopicInvite,
+		},
+		Topic:      invite.Topic,
+		CreatorKey: invite.CreatorKey,
+		Member:     invite.Member.String(),
+		Expires:    invite.Expires,
+		Signature:  invite.Signature,
+	}
+}
+
+func newTopicInviteMessage() api.Message {
+	return &api.TopicInviteMessage{}
+}
+
+// Getting invite of the new member, answering with ours so the member accepts our messages too.
+// Our sender key is shared with the member, so it's able to read our messages
+func handleTopicInvite(h *Handler, ctx *MessageContext, message api.Message) {
+	invite := message.(*api.TopicInviteMessage)
+	if invite.Topic != ctx.Topic || ctx.FromPeerID == h.peerID {
+		return
+	}
+	if err := h.addTopicMember(ctx.FromPeerID, invite); err != nil {
+		log.Println("Invalid invite from " + ctx.FromPeerID.String() + ": " + err.Error())
+		return
+	}
+	if invite.To == "" {
+		h.presentInvite(ctx.Topic, ctx.FromPeerID.String())
+	}
+	h.shareSenderKey(ctx.Topic, ctx.FromPeerID)
+}
@@ -0,0 +1,178 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestPrivateTopic(t *testing.T) {
+	alice, bob, carol, mallory := newTestKeyedHandler(t), newTestKeyedHandler(t), newTestKeyedHandler(t), newTestKeyedHandler(t)
+	if err := alice.CreatePrivateTopic("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.CreateTopicInvite("secret", carol.peerID, 0); err == nil {
+		t.Fatal("invite is created by the peer, which is not the creator")
+	}
+	for _, member := range []*Handler{bob, carol} {
+		invite, err := alice.CreateTopicInvite("secret", member.peerID, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = member.AcceptTopicInvite(invite); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(from peer.ID, message api.Message) error {
+		msg := newTestPubsubMessage(t, from, JSONCodec, message)
+		msg.TopicIDs = []string{"secret"}
+		_, err := bob.checkMessage(&msg)
+		return err
+	}
+	text := func() api.Message {
+		return &api.BaseMessage{Flag: api.FlagGenericMessage, Body: "hello", Timestamp: nowMillis()}
+	}
+
+	if err := check(alice.peerID, text()); err != nil {
+		t.Fatal("message of the creator is rejected: " + err.Error())
+	}
+	if err := check(mallory.peerID, text()); err == nil {
+		t.Fatal("message of the peer without invite is accepted")
+	}
+
+	// Mallory can't use invite of another member, or sign its own one
+	carolInvite := carol.private.topics["secret"].own
+	if err := check(mallory.peerID, carolInvite.message()); err == nil {
+		t.Fatal("invite of another member is accepted")
+	}
+	if err := mallory.CreatePrivateTopic("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(mallory.peerID, mallory.private.topics["secret"].own.message()); err == nil {
+		t.Fatal("invite signed by another creator is accepted")
+	}
+
+	// Carol presents the invite, and then messages of Carol are accepted
+	if err := check(carol.peerID, text()); err == nil {
+		t.Fatal("message is accepted before the invite is presented")
+	}
+	if err := check(carol.peerID, carolInvite.message()); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(carol.peerID, text()); err != nil {
+		t.Fatal("message of the member is rejected: " + err.Error())
+	}
+	if len(bob.GetTopicMembers("secret")) != 3 {
+		t.Fatal("members of the topic are not known")
+	}
+}
+
+func TestExpiredTopicInvite(t *testing.T) {
+	alice, bob := newTestKeyedHandler(t), newTestKeyedHandler(t)
+	if err := alice.CreatePrivateTopic("secret"); err != nil {
+		t.Fatal(err)
+	}
+	invite, err := alice.signTopicInvite("secret", bob.peerID, nowMillis()-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bob.AcceptTopicInvite(invite); err == nil {
+		t.Fatal("expired invite is accepted")
+	}
+	if bob.IsPrivateTopic("secret") {
+		t.Fatal("topic is registered with expired invite")
+	}
+}
+
+func TestPrivateTopicEncryption(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aliceHost, alice := newTestNetworkKeyedHandler(t, ctx)
+	bobHost, bob := newTestNetworkKeyedHandler(t, ctx)
+	malloryHost, mallory := newTestNetworkKeyedHandler(t, ctx)
+	connectTestHosts(t, ctx, aliceHost, bobHost, malloryHost)
+	for _, h := range []*Handler{alice, bob, mallory} {
+		joinTestTopic(t, ctx, h, "moonshard", nil)
+	}
+	waitFor(t, "pubsub peers", func() bool {
+		return len(alice.GetPeers("moonshard")) == 2 && len(bob.GetPeers("moonshard")) == 2
+	})
+	alice.SendHandshake()
+	bob.SendHandshake()
+	waitFor(t, "handshake", func() bool {
+		return alice.PeerSupports(bobHost.ID(), api.CapabilityGroupEncryption) && alice.PeerSupports(malloryHost.ID(), api.CapabilityGroupEncryption) &&
+			bob.PeerSupports(aliceHost.ID(), api.CapabilityGroupEncryption)
+	})
+
+	if err := alice.CreatePrivateTopic("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !alice.IsTopicEncrypted("secret") {
+		t.Fatal("private topic is not encrypted")
+	}
+	alice.DisableTopicEncryption("secret")
+	if !alice.IsTopicEncrypted("secret") {
+		t.Fatal("encryption of private topic is disabled")
+	}
+	invite, err := alice.CreateTopicInvite("secret", bobHost.ID(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bob.AcceptTopicInvite(invite); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	received := make(map[*Handler][]TextMessage)
+	receiver := func(h *Handler) func(TextMessage) {
+		return func(message TextMessage) {
+			mu.Lock()
+			received[h] = append(received[h], message)
+			mu.Unlock()
+		}
+	}
+	messagesOf := func(h *Handler) []TextMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]TextMessage{}, received[h]...)
+	}
+	joinTestTopic(t, ctx, alice, "secret", receiver(alice))
+	joinTestTopic(t, ctx, mallory, "secret", receiver(mallory))
+	waitFor(t, "subscriptions to private topic", func() bool {
+		return len(bob.GetPeers("secret")) == 2
+	})
+	// Bob presents the invite on joining, and members exchange their sender keys
+	joinTestTopic(t, ctx, bob, "secret", receiver(bob))
+	waitFor(t, "sender keys", func() bool {
+		return hasSenderKey(bob, "secret", aliceHost.ID()) && hasSenderKey(alice, "secret", bobHost.ID())
+	})
+	if hasSenderKey(mallory, "secret", aliceHost.ID()) || hasSenderKey(mallory, "secret", bobHost.ID()) {
+		t.Fatal("sender key is shared with the peer without invite")
+	}
+
+	alice.SendMessage("secret", "hello Bob")
+	bob.SendMessage("secret", "hello Alice")
+	waitFor(t, "messages of members", func() bool {
+		return len(messagesOf(alice)) == 1 && len(messagesOf(bob)) == 1
+	})
+	if message := messagesOf(bob)[0]; message.Body != "hello Bob" || !message.Encrypted {
+		t.Fatalf("wrong message of private topic %+v", message)
+	}
+	if message := messagesOf(alice)[0]; message.Body != "hello Alice" || !message.Encrypted {
+		t.Fatalf("wrong message of private topic %+v", message)
+	}
+
+	// Mallory is subscribed to the topic, but its messages are rejected and messages of members are unreadable for it
+	mallory.SendMessage("secret", "let me in")
+	time.Sleep(500 * time.Millisecond)
+	if messages := messagesOf(mallory); len(messages) != 0 {
+		t.Fatalf("message of private topic is readable without invite: %+v", messages)
+	}
+	if len(messagesOf(alice)) != 1 || len(messagesOf(bob)) != 1 {
+		t.Fatal("message of the peer without invite is accepted")
+	}
+}
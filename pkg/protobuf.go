@@ -0,0 +1,283 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  uint64 = 0
+	wireFixed64 uint64 = 1
+	wireBytes   uint64 = 2
+	wireFixed32 uint64 = 5
+)
+
+// Returns whether protobuf data may start with the byte. Our messages don't use groups,
+// so bytes with group (or invalid) wire types never start protobuf data and can mark data of other codecs
+func isProtobufKeyByte(b byte) bool {
+	switch uint64(b) & 0x7 {
+	case wireVarint, wireFixed64, wireBytes, wireFixed32:
+		return true
+	}
+	return false
+}
+
+// protobufCodec encodes messages in protobuf wire format using `protobuf` struct tags of api types,
+// the schema is described in api/p2chat.proto. Fields of embedded structs (BaseMessage) are flattened into the outer message
+type protobufCodec struct{}
+
+type protoField struct {
+	index  []int
+	number uint64
+}
+
+// Cache of parsed struct tags (reflect.Type => []protoField)
+var protoFieldsCache sync.Map
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Marshal(message interface{}) ([]byte, error) {
+	v := reflect.ValueOf(message)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("protobuf: unable to marshal %T", message)
+	}
+	return appendProtoStruct(nil, v)
+}
+
+func (protobufCodec) Unmarshal(data []byte, message interface{}) error {
+	v := reflect.ValueOf(message)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("protobuf: unable to unmarshal into %T", message)
+	}
+	return decodeProtoStruct(data, v.Elem())
+}
+
+func protoFields(t reflect.Type) []protoField {
+	if fields, ok := protoFieldsCache.Load(t); ok {
+		return fields.([]protoField)
+	}
+	fields := collectProtoFields(t, nil)
+	protoFieldsCache.Store(t, fields)
+	return fields
+}
+
+func collectProtoFields(t reflect.Type, index []int) []protoField {
+	var fields []protoField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldIndex := append(append([]int{}, index...), i)
+		tag := field.Tag.Get("protobuf")
+		if tag == "" {
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				fields = append(fields, collectProtoFields(field.Type, fieldIndex)...)
+			}
+			continue
+		}
+		// Tag format is "<wire type>,<field number>,<label>,name=<name>"
+		parts := strings.Split(tag, ",")
+		if len(parts) < 2 {
+			continue
+		}
+		number, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		fields = append(fields, protoField{index: fieldIndex, number: number})
+	}
+	return fields
+}
+
+func appendVarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendProtoKey(buf []byte, number uint64, wire uint64) []byte {
+	return appendVarint(buf, number<<3|wire)
+}
+
+func appendProtoBytes(buf []byte, number uint64, data []byte) []byte {
+	buf = appendProtoKey(buf, number, wireBytes)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendProtoStruct(buf []byte, v reflect.Value) ([]byte, error) {
+	var err error
+	for _, field := range protoFields(v.Type()) {
+		buf, err = appendProtoField(buf, field.number, v.FieldByIndex(field.index), false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// Appends single field. Zero values are omitted (as in proto3), unless the value is element of repeated field
+func appendProtoField(buf []byte, number uint64, v reflect.Value, repeated bool) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() == 0 && !repeated {
+			return buf, nil
+		}
+		return appendProtoBytes(buf, number, []byte(v.String())), nil
+	case reflect.Bool:
+		if !v.Bool() && !repeated {
+			return buf, nil
+		}
+		var b uint64
+		if v.Bool() {
+			b = 1
+		}
+		return appendVarint(appendProtoKey(buf, number, wireVarint), b), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() == 0 && !repeated {
+			return buf, nil
+		}
+		return appendVarint(appendProtoKey(buf, number, wireVarint), uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() == 0 && !repeated {
+			return buf, nil
+		}
+		return appendVarint(appendProtoKey(buf, number, wireVarint), v.Uint()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Len() == 0 && !repeated {
+				return buf, nil
+			}
+			return appendProtoBytes(buf, number, v.Bytes()), nil
+		}
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			buf, err = appendProtoField(buf, number, v.Index(i), true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			return buf, nil
+		}
+		return appendProtoField(buf, number, v.Elem(), repeated)
+	case reflect.Struct:
+		data, err := appendProtoStruct(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoBytes(buf, number, data), nil
+	}
+	return nil, fmt.Errorf("protobuf: unsupported field type %s", v.Type())
+}
+
+func decodeProtoStruct(data []byte, v reflect.Value) error {
+	fields := make(map[uint64][]int)
+	for _, field := range protoFields(v.Type()) {
+		fields[field.number] = field.index
+	}
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("protobuf: malformed field key")
+		}
+		data = data[n:]
+		number, wire := key>>3, key&0x7
+
+		var varint uint64
+		var raw []byte
+		switch wire {
+		case wireVarint:
+			varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("protobuf: malformed varint")
+			}
+			data = data[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wire == wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return errors.New("protobuf: unexpected end of data")
+			}
+			data = data[size:]
+			continue // we don't use fixed-size fields, skip them
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errors.New("protobuf: malformed length-delimited field")
+			}
+			raw = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", wire)
+		}
+
+		index, ok := fields[number]
+		if !ok {
+			continue // unknown field, probably from newer version of the protocol
+		}
+		if err := setProtoField(v.FieldByIndex(index), wire, varint, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setProtoField(v reflect.Value, wire uint64, varint uint64, raw []byte) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setProtoField(v.Elem(), wire, varint, raw)
+	}
+
+	kind := v.Kind()
+	expectedWire := wireVarint
+	switch kind {
+	case reflect.String, reflect.Slice, reflect.Struct:
+		expectedWire = wireBytes
+	}
+	if kind == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		element := reflect.New(v.Type().Elem()).Elem()
+		if err := setProtoField(element, wire, varint, raw); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, element))
+		return nil
+	}
+	if wire != expectedWire {
+		return fmt.Errorf("protobuf: wrong wire type %d for field of type %s", wire, v.Type())
+	}
+
+	switch kind {
+	case reflect.String:
+		v.SetString(string(raw))
+	case reflect.Bool:
+		v.SetBool(varint != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(varint))
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(varint)
+	case reflect.Slice:
+		v.SetBytes(append([]byte{}, raw...))
+	case reflect.Struct:
+		return decodeProtoStruct(raw, v)
+	default:
+		return fmt.Errorf("protobuf: unsupported field type %s", v.Type())
+	}
+	return nil
+}
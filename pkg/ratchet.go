@@ -0,0 +1,247 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// maxSkippedKeys limits number of message keys, which are kept for messages delivered out of order
+	maxSkippedKeys     = 1000
+	ratchetRootInfo    = "p2chat ratchet root"
+	ratchetMessageInfo = "p2chat ratchet message"
+)
+
+// skippedKey is the key of message, which haven't been received yet, but the following messages have
+type skippedKey struct {
+	RatchetKey []byte `json:"ratchetKey"`
+	Index      int    `json:"index"`
+	MessageKey []byte `json:"messageKey"`
+}
+
+// ratchetState is the state of double ratchet session with the peer, it's persisted as JSON
+type ratchetState struct {
+	RootKey      []byte `json:"rootKey"`
+	SendingKey   []byte `json:"sendingKey,omitempty"`
+	ReceivingKey []byte `json:"receivingKey,omitempty"`
+	// Our current ratchet key pair and the current ratchet key of the peer
+	PrivateKey []byte `json:"privateKey"`
+	PublicKey  []byte `json:"publicKey"`
+	RemoteKey  []byte `json:"remoteKey,omitempty"`
+	// Numbers of messages in the current sending, receiving and the previous sending chains
+	Sent         int          `json:"sent"`
+	Received     int          `json:"received"`
+	PreviousSent int          `json:"previousSent"`
+	Skipped      []skippedKey `json:"skipped,omitempty"`
+	// AssociatedData binds messages to identities of both peers
+	AssociatedData []byte `json:"associatedData"`
+	// Key agreement values, which initiator attaches to messages until the peer replies
+	EphemeralKey []byte `json:"ephemeralKey,omitempty"`
+	PreKey       []byte `json:"preKey,omitempty"`
+	// RemoteEphemeral is ephemeral key of the peer, which has initiated this session
+	RemoteEphemeral []byte `json:"remoteEphemeral,omitempty"`
+}
+
+// ratchetHeader is sent in plaintext along with each message and authenticated with it
+type ratchetHeader struct {
+	ratchetKey   []byte
+	previousSent int
+	index        int
+}
+
+func (h ratchetHeader) bytes() []byte {
+	data := append([]byte{}, h.ratchetKey...)
+	data = appendVarint(data, uint64(h.previousSent))
+	return appendVarint(data, uint64(h.index))
+}
+
+func generateKeyPair() (privateKey []byte, publicKey []byte, err error) {
+	private, public := new([32]byte), new([32]byte)
+	if _, err = rand.Read(private[:]); err != nil {
+		return nil, nil, err
+	}
+	curve25519.ScalarBaseMult(public, private)
+	return private[:], public[:], nil
+}
+
+// Computes X25519 shared secret, rejecting low order public keys
+func dh(privateKey []byte, publicKey []byte) ([]byte, error) {
+	if len(privateKey) != 32 || len(publicKey) != 32 {
+		return nil, errors.New("malformed key")
+	}
+	private, public, shared := new([32]byte), new([32]byte), new([32]byte)
+	copy(private[:], privateKey)
+	copy(public[:], publicKey)
+	curve25519.ScalarMult(shared, private, public)
+	if bytes.Equal(shared[:], make([]byte, 32)) {
+		return nil, errors.New("low order public key")
+	}
+	return shared[:], nil
+}
+
+func deriveKeys(secret []byte, salt []byte, info string, size int) []byte {
+	out := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), out); err != nil {
+		panic(err) // HKDF fails only if too much output is requested
+	}
+	return out
+}
+
+// Returns the next root key and the new chain key
+func kdfRoot(rootKey []byte, dhOut []byte) ([]byte, []byte) {
+	out := deriveKeys(dhOut, rootKey, ratchetRootInfo, 64)
+	return out[:32], out[32:]
+}
+
+// Returns the next chain key and the message key
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	next := mac.Sum(nil)
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	return next, mac.Sum(nil)
+}
+
+func sealRatchetMessage(messageKey []byte, plaintext []byte, associatedData []byte) ([]byte, error) {
+	keys := deriveKeys(messageKey, nil, ratchetMessageInfo, 32+chacha20poly1305.NonceSize)
+	aead, err := chacha20poly1305.New(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, keys[32:], plaintext, associatedData), nil
+}
+
+func openRatchetMessage(messageKey []byte, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	keys := deriveKeys(messageKey, nil, ratchetMessageInfo, 32+chacha20poly1305.NonceSize)
+	aead, err := chacha20poly1305.New(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, keys[32:], ciphertext, associatedData)
+}
+
+// Creates session of the peer, which has sent the first message, remotePreKey is the signed prekey of the responder
+func newInitiatorState(sharedSecret []byte, remotePreKey []byte, associatedData []byte) (*ratchetState, error) {
+	privateKey, publicKey, err := generateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	dhOut, err := dh(privateKey, remotePreKey)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, sendingKey := kdfRoot(sharedSecret, dhOut)
+	return &ratchetState{
+		RootKey:        rootKey,
+		SendingKey:     sendingKey,
+		PrivateKey:     privateKey,
+		PublicKey:      publicKey,
+		RemoteKey:      remotePreKey,
+		AssociatedData: associatedData,
+	}, nil
+}
+
+// Creates session of the peer, which has received the first message encrypted for its signed prekey
+func newResponderState(sharedSecret []byte, preKey *preKey, associatedData []byte) *ratchetState {
+	return &ratchetState{
+		RootKey:        sharedSecret,
+		PrivateKey:     preKey.PrivateKey,
+		PublicKey:      preKey.PublicKey,
+		AssociatedData: associatedData,
+	}
+}
+
+// Returns deep copy of the state, so failed decryption doesn't corrupt the session
+func (s *ratchetState) clone() *ratchetState {
+	c := *s
+	c.Skipped = append([]skippedKey(nil), s.Skipped...)
+	return &c
+}
+
+func (s *ratchetState) encrypt(plaintext []byte) (ratchetHeader, []byte, error) {
+	if s.SendingKey == nil {
+		return ratchetHeader{}, nil, errors.New("session is not able to send yet")
+	}
+	var messageKey []byte
+	s.SendingKey, messageKey = kdfChain(s.SendingKey)
+	header := ratchetHeader{ratchetKey: s.PublicKey, previousSent: s.PreviousSent, index: s.Sent}
+	s.Sent++
+	ciphertext, err := sealRatchetMessage(messageKey, plaintext, append(append([]byte{}, s.AssociatedData...), header.bytes()...))
+	return header, ciphertext, err
+}
+
+func (s *ratchetState) decrypt(header ratchetHeader, ciphertext []byte) ([]byte, error) {
+	associatedData := append(append([]byte{}, s.AssociatedData...), header.bytes()...)
+	for i, skipped := range s.Skipped {
+		if skipped.Index == header.index && bytes.Equal(skipped.RatchetKey, header.ratchetKey) {
+			s.Skipped = append(s.Skipped[:i], s.Skipped[i+1:]...)
+			return openRatchetMessage(skipped.MessageKey, ciphertext, associatedData)
+		}
+	}
+
+	if !bytes.Equal(header.ratchetKey, s.RemoteKey) {
+		if err := s.skipKeys(header.previousSent); err != nil {
+			return nil, err
+		}
+		if err := s.step(header.ratchetKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.skipKeys(header.index); err != nil {
+		return nil, err
+	}
+	var messageKey []byte
+	s.ReceivingKey, messageKey = kdfChain(s.ReceivingKey)
+	s.Received++
+	return openRatchetMessage(messageKey, ciphertext, associatedData)
+}
+
+// Stores keys of the receiving chain up to the message `until`, dropping the oldest ones above the limit
+func (s *ratchetState) skipKeys(until int) error {
+	if s.ReceivingKey == nil {
+		return nil
+	}
+	if until-s.Received > maxSkippedKeys {
+		return errors.New("too many skipped messages")
+	}
+	for s.Received < until {
+		var messageKey []byte
+		s.ReceivingKey, messageKey = kdfChain(s.ReceivingKey)
+		s.Skipped = append(s.Skipped, skippedKey{RatchetKey: s.RemoteKey, Index: s.Received, MessageKey: messageKey})
+		s.Received++
+	}
+	if len(s.Skipped) > maxSkippedKeys {
+		s.Skipped = s.Skipped[len(s.Skipped)-maxSkippedKeys:]
+	}
+	return nil
+}
+
+// Performs DH ratchet step, when the peer has sent new ratchet key
+func (s *ratchetState) step(remoteKey []byte) error {
+	dhOut, err := dh(s.PrivateKey, remoteKey)
+	if err != nil {
+		return err
+	}
+	s.PreviousSent = s.Sent
+	s.Sent, s.Received = 0, 0
+	s.RemoteKey = remoteKey
+	s.RootKey, s.ReceivingKey = kdfRoot(s.RootKey, dhOut)
+
+	if s.PrivateKey, s.PublicKey, err = generateKeyPair(); err != nil {
+		return err
+	}
+	if dhOut, err = dh(s.PrivateKey, remoteKey); err != nil {
+		return err
+	}
+	s.RootKey, s.SendingKey = kdfRoot(s.RootKey, dhOut)
+	return nil
+}
@@ -0,0 +1,211 @@
+package pkg
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// DefaultBlacklistViolations is how many dropped messages within DefaultBlacklistWindow make us blacklist the peer
+	DefaultBlacklistViolations = 100
+	DefaultBlacklistWindow     = time.Minute
+	// idleBucketTimeout is how long bucket is kept after the last message of the peer
+	idleBucketTimeout = 10 * time.Minute
+)
+
+// RateLimit is the token bucket: peer may send Burst messages at once, and then Rate messages per second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// DefaultRateLimit applies to flags, which have no limit of their own.
+// Fragments are not limited, the message is limited when it's reassembled
+var DefaultRateLimit = RateLimit{Rate: 20, Burst: 100}
+
+// defaultFlagLimits are limits of flags, which make us answer or do expensive work
+var defaultFlagLimits = map[int]RateLimit{
+	api.FlagTopicsRequest:    {Rate: 0.2, Burst: 3},
+	api.FlagIdentityRequest:  {Rate: 0.5, Burst: 5},
+	api.FlagGreeting:         {Rate: 0.5, Burst: 5},
+	api.FlagHandshake:        {Rate: 0.5, Burst: 5},
+	api.FlagSenderKeyRequest: {Rate: 0.5, Burst: 5},
+	api.FlagVerifyRequest:    {Rate: 0.1, Burst: 3},
+	api.FlagTopicInvite:      {Rate: 0.5, Burst: 5},
+}
+
+// RateLimitEvent is emitted when message of the peer is dropped, because the peer exceeds the limit of the flag
+type RateLimitEvent struct {
+	PeerID peer.ID
+	Flag   int
+	// Violations is the number of dropped messages of the peer within blacklist window
+	Violations int
+}
+
+// PeerBlacklistedEvent is emitted when the peer is blacklisted for sustained abuse
+type PeerBlacklistedEvent struct {
+	PeerID     peer.ID
+	Violations int
+}
+
+type bucketKey struct {
+	peerID peer.ID
+	flag   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// violations counts dropped messages of the peer within the window
+type violations struct {
+	count int
+	since time.Time
+}
+
+// rateLimiter holds token buckets of peers per flag
+type rateLimiter struct {
+	mu           sync.Mutex
+	defaultLimit RateLimit
+	limits       map[int]RateLimit
+	buckets      map[bucketKey]*bucket
+	violations   map[peer.ID]*violations
+	// Peer is blacklisted when it has maxViolations dropped messages within window, zero disables blacklisting
+	maxViolations int
+	window        time.Duration
+	lastCleanup   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	limits := make(map[int]RateLimit)
+	for flag, limit := range defaultFlagLimits {
+		limits[flag] = limit
+	}
+	return &rateLimiter{
+		defaultLimit:  DefaultRateLimit,
+		limits:        limits,
+		buckets:       make(map[bucketKey]*bucket),
+		violations:    make(map[peer.ID]*violations),
+		maxViolations: DefaultBlacklistViolations,
+		window:        DefaultBlacklistWindow,
+		lastCleanup:   time.Now(),
+	}
+}
+
+// Sets the limit of messages with the flag, which every peer may send
+func (h *Handler) SetRateLimit(flag int, limit RateLimit) {
+	h.limiter.mu.Lock()
+	defer h.limiter.mu.Unlock()
+	h.limiter.limits[flag] = limit
+	h.limiter.resetBuckets(flag)
+}
+
+// Sets the limit of flags, which have no limit of their own
+func (h *Handler) SetDefaultRateLimit(limit RateLimit) {
+	h.limiter.mu.Lock()
+	defer h.limiter.mu.Unlock()
+	h.limiter.defaultLimit = limit
+	h.limiter.buckets = make(map[bucketKey]*bucket)
+}
+
+// Sets how many dropped messages within the window make us blacklist the peer, zero disables blacklisting
+func (h *Handler) SetBlacklistThreshold(maxViolations int, window time.Duration) {
+	h.limiter.mu.Lock()
+	defer h.limiter.mu.Unlock()
+	h.limiter.maxViolations = maxViolations
+	h.limiter.window = window
+}
+
+// Must be called with locked mutex
+func (l *rateLimiter) resetBuckets(flag int) {
+	for key := range l.buckets {
+		if key.flag == flag {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Takes token from the bucket of the peer, returns false if the bucket is empty
+func (l *rateLimiter) allow(peerID peer.ID, flag int, now time.Time) bool {
+	limit, ok := l.limits[flag]
+	if !ok {
+		limit = l.defaultLimit
+	}
+	key := bucketKey{peerID: peerID, flag: flag}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Counts dropped message of the peer, returns the number of violations and whether the peer must be blacklisted
+func (l *rateLimiter) violate(peerID peer.ID, now time.Time) (int, bool) {
+	v, ok := l.violations[peerID]
+	if !ok || now.Sub(v.since) > l.window {
+		v = &violations{since: now}
+		l.violations[peerID] = v
+	}
+	v.count++
+	return v.count, l.maxViolations > 0 && v.count == l.maxViolations
+}
+
+// Drops buckets and violations of peers, which haven't sent anything for a while. Must be called with locked mutex
+func (l *rateLimiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < idleBucketTimeout {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > idleBucketTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	for peerID, v := range l.violations {
+		if now.Sub(v.since) > l.window {
+			delete(l.violations, peerID)
+		}
+	}
+	l.lastCleanup = now
+}
+
+// Checks rate limit of the flag for the peer. Dropped messages are reported, and sustained abuse gets the peer blacklisted
+func (h *Handler) checkRateLimit(fromPeerID peer.ID, flag int) bool {
+	if fromPeerID == h.peerID {
+		return true
+	}
+	now := time.Now()
+	h.limiter.mu.Lock()
+	h.limiter.cleanup(now)
+	if h.limiter.allow(fromPeerID, flag, now) {
+		h.limiter.mu.Unlock()
+		return true
+	}
+	count, blacklist := h.limiter.violate(fromPeerID, now)
+	h.limiter.mu.Unlock()
+
+	h.emitEvent(&RateLimitEvent{PeerID: fromPeerID, Flag: flag, Violations: count})
+	if blacklist {
+		log.Printf("Blacklisting %s, it has exceeded rate limits %d times\n", fromPeerID.String(), count)
+		if err := h.BlockPeer(fromPeerID, BlockHard, "rate limits exceeded"); err != nil {
+			log.Println(err.Error())
+		}
+		h.emitEvent(&PeerBlacklistedEvent{PeerID: fromPeerID, Violations: count})
+	}
+	return false
+}
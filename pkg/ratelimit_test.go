@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limiter := newRateLimiter()
+	_, peerID := newTestPeer(t)
+	limiter.limits[api.FlagTopicsRequest] = RateLimit{Rate: 1, Burst: 2}
+	now := time.Now()
+
+	if !limiter.allow(peerID, api.FlagTopicsRequest, now) || !limiter.allow(peerID, api.FlagTopicsRequest, now) {
+		t.Fatal("burst is not allowed")
+	}
+	if limiter.allow(peerID, api.FlagTopicsRequest, now) {
+		t.Fatal("limit is not enforced")
+	}
+	if !limiter.allow(peerID, api.FlagGenericMessage, now) {
+		t.Fatal("limit of one flag applies to another")
+	}
+	if !limiter.allow(peerID, api.FlagTopicsRequest, now.Add(time.Second)) {
+		t.Fatal("bucket is not refilled")
+	}
+}
+
+func TestRateLimitBlacklisting(t *testing.T) {
+	handler := newTestHandler(t)
+	_, abuser := newTestPeer(t)
+	_, neighbour := newTestPeer(t)
+	flag := api.FlagUserDefined + 1
+	received := 0
+	err := handler.RegisterFlag(flag, func() api.Message {
+		return &testPingMessage{}
+	}, func(h *Handler, ctx *MessageContext, message api.Message) {
+		received++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetRateLimit(flag, RateLimit{Rate: 0, Burst: 3})
+	handler.SetBlacklistThreshold(2, time.Minute)
+
+	var limited []*RateLimitEvent
+	var blacklisted []*PeerBlacklistedEvent
+	handler.SetEventHandler(func(event Event) {
+		switch event := event.(type) {
+		case *RateLimitEvent:
+			limited = append(limited, event)
+		case *PeerBlacklistedEvent:
+			blacklisted = append(blacklisted, event)
+		}
+	})
+	for i := 0; i < 6; i++ {
+		message := &testPingMessage{BaseMessage: api.BaseMessage{Flag: flag, ID: newMessageID()}}
+		handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, abuser, JSONCodec, message), nil, nil, nil)
+	}
+	if received != 3 || len(limited) != 3 {
+		t.Fatalf("%d messages are delivered and %d are dropped", received, len(limited))
+	}
+	if mode, blocked := handler.IsBlocked(abuser); len(blacklisted) != 1 || blacklisted[0].PeerID != abuser || !blocked || mode != BlockHard {
+		t.Fatal("abuser is not blacklisted")
+	}
+
+	message := &testPingMessage{BaseMessage: api.BaseMessage{Flag: flag, ID: newMessageID()}}
+	handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, neighbour, JSONCodec, message), nil, nil, nil)
+	if received != 4 {
+		t.Fatal("message of another peer is dropped")
+	}
+}
+
+func TestWrappedRateLimit(t *testing.T) {
+	handler := newTestHandler(t)
+	_, sender := newTestPeer(t)
+	handler.SetDefaultRateLimit(RateLimit{Rate: 0, Burst: 2})
+	limited := 0
+	handler.SetEventHandler(func(event Event) {
+		if _, ok := event.(*RateLimitEvent); ok {
+			limited++
+		}
+	})
+	received := 0
+	handleTextMessage := func(TextMessage) { received++ }
+
+	// Fragments of the large message are counted as the single message
+	message := &api.BaseMessage{
+		Body:      strings.Repeat("large message ", 1000),
+		Flag:      api.FlagGenericMessage,
+		Version:   api.ProtocolVersion,
+		ID:        newMessageID(),
+		Timestamp: nowMillis(),
+	}
+	data, err := JSONCodec.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 10
+	chunkSize := len(data)/count + 1
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		fragment := &api.FragmentMessage{
+			BaseMessage: api.BaseMessage{Flag: api.FlagFragment, Version: api.ProtocolVersion, ID: newMessageID()},
+			MessageID:   message.ID,
+			Index:       i,
+			Count:       count,
+			Data:        data[i*chunkSize : end],
+		}
+		handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, sender, JSONCodec, fragment), handleTextMessage, nil, nil)
+	}
+	if received != 1 || limited != 0 {
+		t.Fatalf("%d messages are delivered and %d are dropped", received, limited)
+	}
+
+	// Messages inside of the wrappers aren't counted again
+	for i := 0; i < 2; i++ {
+		message := &api.BaseMessage{Body: "hello", Flag: api.FlagGenericMessage, Version: api.ProtocolVersion, ID: newMessageID()}
+		data, err := JSONCodec.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(data)
+		writer.Close()
+		compressed := &api.CompressedMessage{
+			BaseMessage: api.BaseMessage{Flag: api.FlagCompressed, Version: api.ProtocolVersion, ID: newMessageID()},
+			Compression: api.CompressionGzip,
+			Data:        buffer.Bytes(),
+		}
+		handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, sender, JSONCodec, compressed), handleTextMessage, nil, nil)
+	}
+	if received != 3 || limited != 0 {
+		t.Fatalf("%d messages are delivered and %d are dropped", received, limited)
+	}
+}
@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"errors"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// MaxReactionKeyLength is the maximum length of reaction key in bytes, it's enough for any emoji sequence
+	MaxReactionKeyLength = 64
+	// MaxReactionKeys is how many distinct reaction keys the message may have, reactions with new keys are ignored above it
+	MaxReactionKeys = 32
+)
+
+// ReactionEvent is emitted when peer adds or removes reaction to the message
+type ReactionEvent struct {
+	Topic      string
+	FromPeerID string
+	MessageID  string
+	Key        string
+	Removed    bool
+}
+
+var errUnknownMessage = errors.New("message is not found in the topic")
+
+// Adds our reaction to the message
+func (h *Handler) React(topic string, messageID string, key string) error {
+	return h.sendReaction(topic, messageID, key, false)
+}
+
+// Removes our reaction from the message
+func (h *Handler) Unreact(topic string, messageID string, key string) error {
+	return h.sendReaction(topic, messageID, key, true)
+}
+
+func (h *Handler) sendReaction(topic string, messageID string, key string, remove bool) error {
+	if key == "" {
+		return errors.New("reaction key is empty")
+	}
+	if len(key) > MaxReactionKeyLength {
+		return errors.New("reaction key is too long")
+	}
+	if err := h.requireSupport(topic, "", api.CapabilityReactions); err != nil {
+		return err
+	}
+	if !h.history.react(topic, messageID, key, h.peerID, remove) {
+		if _, ok := h.history.get(messageID); !ok {
+			return errUnknownMessage
+		}
+		return nil // Our reaction is already in this state, or the message has too many reaction keys
+	}
+
+	reactionMessage := &api.ReactionMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			To:           "",
+			Flag:         api.FlagReaction,
+			FromMatrixID: h.matrixID,
+		},
+		TargetID: messageID,
+		Key:      key,
+		Remove:   remove,
+	}
+
+	h.sendMessageToTopic(topic, reactionMessage)
+	return nil
+}
+
+// Returns reactions to the message: reaction key => peers, who reacted with it
+func (h *Handler) GetReactions(messageID string) map[string][]peer.ID {
+	return h.history.reactions(messageID)
+}
+
+// Returns number of reactions of each key to the message
+func (h *Handler) GetReactionCounts(messageID string) map[string]int {
+	counts := make(map[string]int)
+	for key, peers := range h.history.reactions(messageID) {
+		counts[key] = len(peers)
+	}
+	return counts
+}
+
+func newReactionMessage() api.Message {
+	return &api.ReactionMessage{}
+}
+
+// Getting reaction, aggregating it in the history of the message
+func handleReaction(h *Handler, ctx *MessageContext, message api.Message) {
+	reactionMessage := message.(*api.ReactionMessage)
+	if reactionMessage.Key == "" || len(reactionMessage.Key) > MaxReactionKeyLength {
+		return
+	}
+	if !h.history.react(ctx.Topic, reactionMessage.TargetID, reactionMessage.Key, ctx.FromPeerID, reactionMessage.Remove) {
+		return // Unknown message, reaction state has not changed or there are too many keys
+	}
+	h.emitEvent(&ReactionEvent{
+		Topic:      ctx.Topic,
+		FromPeerID: ctx.FromPeerID.String(),
+		MessageID:  reactionMessage.TargetID,
+		Key:        reactionMessage.Key,
+		Removed:    reactionMessage.Remove,
+	})
+}
@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestHistoryReactions(t *testing.T) {
+	history := newMessageHistory(DefaultHistoryLimit)
+	alice, bob := peer.ID("alice"), peer.ID("bob")
+	history.add(alice, TextMessage{Topic: "moonshard", ID: "1"})
+
+	if history.react("random", "1", "👍", bob, false) {
+		t.Fatal("reaction from another topic is accepted")
+	}
+	if !history.react("moonshard", "1", "👍", bob, false) || !history.react("moonshard", "1", "👍", alice, false) {
+		t.Fatal("reaction is not accepted")
+	}
+	if history.react("moonshard", "1", "👍", bob, false) {
+		t.Fatal("the same reaction is counted twice")
+	}
+	if len(history.reactions("1")["👍"]) != 2 {
+		t.Fatal("reactions are not aggregated")
+	}
+	if !history.react("moonshard", "1", "👍", bob, true) || len(history.reactions("1")["👍"]) != 1 {
+		t.Fatal("reaction is not removed")
+	}
+}
+
+func TestReactionLimits(t *testing.T) {
+	handler := newTestHandler(t)
+	_, authorPeerID := newTestPeer(t)
+	handler.history.add(authorPeerID, TextMessage{Topic: "moonshard", ID: "1"})
+	react := func(key string) {
+		reaction := &api.ReactionMessage{
+			BaseMessage: api.BaseMessage{Flag: api.FlagReaction, ID: newMessageID(), Timestamp: nowMillis()},
+			TargetID:    "1",
+			Key:         key,
+		}
+		handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, authorPeerID, JSONCodec, reaction), nil, nil, nil)
+	}
+
+	longKey := strings.Repeat("👍", MaxReactionKeyLength)
+	react(longKey)
+	if len(handler.GetReactions("1")) != 0 {
+		t.Fatal("too long reaction key is accepted")
+	}
+	if err := handler.React("moonshard", "1", longKey); err == nil {
+		t.Fatal("too long reaction key is sent")
+	}
+
+	for i := 0; i <= MaxReactionKeys; i++ {
+		react(fmt.Sprintf("key%d", i))
+	}
+	counts := handler.GetReactionCounts("1")
+	if len(counts) != MaxReactionKeys || counts[fmt.Sprintf("key%d", MaxReactionKeys)] != 0 {
+		t.Fatalf("number of reaction keys is not limited: %d", len(counts))
+	}
+}
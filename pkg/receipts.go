@@ -0,0 +1,156 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// receiptBatchDelay is how long delivery receipts of group messages are collected before they are sent at once
+	receiptBatchDelay = time.Second
+	// maxReceiptBatch is the number of message IDs, which makes the batch to be sent without waiting
+	maxReceiptBatch = 100
+)
+
+// ReceiptStatus is the state of the sent message on the side of receiver
+type ReceiptStatus int
+
+const (
+	ReceiptDelivered ReceiptStatus = iota + 1
+	ReceiptRead
+)
+
+// ReceiptEvent is emitted when peer acknowledges our messages
+type ReceiptEvent struct {
+	Topic      string
+	FromPeerID string
+	Status     ReceiptStatus
+	MessageIDs []string
+}
+
+type receiptBatchKey struct {
+	topic    string
+	toPeerID peer.ID
+}
+
+// receiptBatches collects delivery receipts of group messages per author, so every message doesn't cause a publish
+type receiptBatches struct {
+	mu sync.Mutex
+	// group enables delivery receipts of group messages, receipts are sent only for direct messages otherwise
+	group   bool
+	pending map[receiptBatchKey][]string
+}
+
+func newReceiptBatches() *receiptBatches {
+	return &receiptBatches{
+		pending: make(map[receiptBatchKey][]string),
+	}
+}
+
+func newReceiptMessage() api.Message {
+	return &api.ReceiptMessage{}
+}
+
+// Sets whether delivery receipts are sent automatically for incoming direct messages (enabled by default)
+func (h *Handler) SetSendDeliveryReceipts(enabled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.autoReceipts = enabled
+}
+
+// Sets whether delivery receipts are sent for group messages too (disabled by default).
+// They are batched per author, so the author gets one receipt for several messages
+func (h *Handler) SetGroupDeliveryReceipts(enabled bool) {
+	h.receipts.mu.Lock()
+	defer h.receipts.mu.Unlock()
+	h.receipts.group = enabled
+}
+
+// Acknowledges delivery of the message to its author, if the author is able to handle receipts.
+// Receipts of group messages are batched
+func (h *Handler) sendDeliveryReceipt(topic string, toPeerID peer.ID, messageID string, direct bool) {
+	h.mu.RLock()
+	enabled := h.autoReceipts
+	h.mu.RUnlock()
+	if !enabled || messageID == "" {
+		return
+	}
+	if direct {
+		h.sendReceipt(topic, toPeerID, api.FlagDeliveryReceipt, []string{messageID})
+		return
+	}
+
+	key := receiptBatchKey{topic: topic, toPeerID: toPeerID}
+	h.receipts.mu.Lock()
+	if !h.receipts.group {
+		h.receipts.mu.Unlock()
+		return
+	}
+	batch := append(h.receipts.pending[key], messageID)
+	h.receipts.pending[key] = batch
+	h.receipts.mu.Unlock()
+
+	if len(batch) >= maxReceiptBatch {
+		h.flushReceipts(key)
+	} else if len(batch) == 1 {
+		time.AfterFunc(receiptBatchDelay, func() {
+			h.flushReceipts(key)
+		})
+	}
+}
+
+// Sends collected delivery receipts to the author
+func (h *Handler) flushReceipts(key receiptBatchKey) {
+	h.receipts.mu.Lock()
+	messageIDs := h.receipts.pending[key]
+	delete(h.receipts.pending, key)
+	h.receipts.mu.Unlock()
+	if len(messageIDs) > 0 {
+		h.sendReceipt(key.topic, key.toPeerID, api.FlagDeliveryReceipt, messageIDs)
+	}
+}
+
+// Marks messages of the peer in the topic as read and notifies the peer about it
+func (h *Handler) MarkAsRead(topic string, fromPeerID string, messageIDs ...string) {
+	toPeerID, err := peer.IDB58Decode(fromPeerID)
+	if err != nil || len(messageIDs) == 0 {
+		return
+	}
+	h.sendReceipt(topic, toPeerID, api.FlagReadReceipt, messageIDs)
+}
+
+func (h *Handler) sendReceipt(topic string, toPeerID peer.ID, flag int, messageIDs []string) {
+	// v1 nodes don't know about receipts, so we don't bother them
+	if !h.PeerSupports(toPeerID, api.CapabilityReceipts) {
+		return
+	}
+	receipt := &api.ReceiptMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			To:           toPeerID.String(),
+			Flag:         flag,
+			FromMatrixID: h.matrixID,
+		},
+		MessageIDs: messageIDs,
+	}
+
+	h.sendMessageToTopic(topic, receipt)
+}
+
+// Getting receipt, notifying the application
+func handleReceipt(h *Handler, ctx *MessageContext, message api.Message) {
+	receipt := message.(*api.ReceiptMessage)
+	status := ReceiptDelivered
+	if receipt.Flag == api.FlagReadReceipt {
+		status = ReceiptRead
+	}
+	h.emitEvent(&ReceiptEvent{
+		Topic:      ctx.Topic,
+		FromPeerID: ctx.FromPeerID.String(),
+		Status:     status,
+		MessageIDs: receipt.MessageIDs,
+	})
+}
@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+func hasString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReceipts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aliceHost, alice := newTestNetworkHandler(t, ctx)
+	bobHost, bob := newTestNetworkHandler(t, ctx)
+	connectTestHosts(t, ctx, aliceHost, bobHost)
+
+	var mu sync.Mutex
+	var receipts []*ReceiptEvent
+	alice.SetEventHandler(func(event Event) {
+		if receipt, ok := event.(*ReceiptEvent); ok {
+			mu.Lock()
+			receipts = append(receipts, receipt)
+			mu.Unlock()
+		}
+	})
+	lastReceipt := func() *ReceiptEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(receipts) == 0 {
+			return nil
+		}
+		return receipts[len(receipts)-1]
+	}
+	var received []TextMessage
+	joinTestTopic(t, ctx, alice, "moonshard", nil)
+	joinTestTopic(t, ctx, bob, "moonshard", func(message TextMessage) {
+		mu.Lock()
+		received = append(received, message)
+		mu.Unlock()
+	})
+	receivedCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received)
+	}
+	waitFor(t, "pubsub peers", func() bool {
+		return len(alice.GetPeers("moonshard")) == 1 && len(bob.GetPeers("moonshard")) == 1
+	})
+	alice.SendHandshake()
+	waitFor(t, "handshake", func() bool {
+		return alice.PeerSupports(bobHost.ID(), api.CapabilityReceipts) && bob.PeerSupports(aliceHost.ID(), api.CapabilityReceipts)
+	})
+
+	// Group messages aren't acknowledged by default
+	alice.SendMessage("moonshard", "hello everyone")
+	waitFor(t, "group message", func() bool { return receivedCount() == 1 })
+	time.Sleep(receiptBatchDelay + 200*time.Millisecond)
+	if lastReceipt() != nil {
+		t.Fatal("delivery receipt is sent for group message")
+	}
+
+	direct := &api.BaseMessage{Flag: api.FlagGenericMessage, Body: "hello Bob", To: bobHost.ID().String()}
+	directID := alice.PublishMessage("moonshard", direct)
+	waitFor(t, "delivery receipt", func() bool { return lastReceipt() != nil })
+	receipt := lastReceipt()
+	if receipt.Status != ReceiptDelivered || len(receipt.MessageIDs) != 1 || receipt.MessageIDs[0] != directID {
+		t.Fatalf("wrong delivery receipt %+v", receipt)
+	}
+	if receipt.FromPeerID != bobHost.ID().String() || receipt.Topic != "moonshard" {
+		t.Fatalf("wrong sender of receipt %+v", receipt)
+	}
+
+	// Receipts of group messages are batched, when they are enabled
+	bob.SetGroupDeliveryReceipts(true)
+	firstID := alice.SendMessage("moonshard", "first")
+	secondID := alice.SendMessage("moonshard", "second")
+	waitFor(t, "batched delivery receipt", func() bool { return lastReceipt() != receipt })
+	receipt = lastReceipt()
+	// Messages may be delivered in any order
+	if receipt.Status != ReceiptDelivered || len(receipt.MessageIDs) != 2 || !hasString(receipt.MessageIDs, firstID) || !hasString(receipt.MessageIDs, secondID) {
+		t.Fatalf("wrong batched delivery receipt %+v", receipt)
+	}
+
+	bob.MarkAsRead("moonshard", aliceHost.ID().String(), directID, firstID)
+	waitFor(t, "read receipt", func() bool { return lastReceipt() != receipt })
+	receipt = lastReceipt()
+	if receipt.Status != ReceiptRead || len(receipt.MessageIDs) != 2 || receipt.MessageIDs[0] != directID || receipt.MessageIDs[1] != firstID {
+		t.Fatalf("wrong read receipt %+v", receipt)
+	}
+
+	// Peers, which don't support receipts, aren't bothered with them
+	legacy := &api.BaseMessage{Flag: api.FlagGenericMessage, Body: "hi"}
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, aliceHost.ID(), JSONCodec, legacy), func(TextMessage) {}, nil, nil)
+	bob.MarkAsRead("moonshard", aliceHost.ID().String(), directID)
+	time.Sleep(200 * time.Millisecond)
+	if lastReceipt() != receipt {
+		t.Fatal("receipt is sent to the peer, which doesn't support receipts")
+	}
+}
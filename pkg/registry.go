@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// FlagHandlerFunc handles decoded incoming message with specific flag
+type FlagHandlerFunc func(h *Handler, ctx *MessageContext, message api.Message)
+
+// MessageContext describes where incoming message came from
+type MessageContext struct {
+	Topic      string
+	FromPeerID peer.ID
+	// Codec which the message was encoded with
+	Codec Codec
+	// Encrypted is set if the message was end-to-end encrypted for us
+	Encrypted bool
+	// rateLimited is set when the message is counted by rate limiter, so messages carried inside of it aren't counted again
+	rateLimited bool
+	// depth is the number of wrappers which carried the message
+	depth int
+
+	handleTextMessage func(TextMessage)
+	handleMatch       func(string, string, string)
+	handleUnmatch     func(string, string, string)
+}
+
+type flagHandler struct {
+	// Returns empty message of the type which is used for this flag
+	newMessage func() api.Message
+	handle     FlagHandlerFunc
+}
+
+// Registers handler for the application-defined flag.
+// Incoming data is decoded into the message returned by newMessage, so handle may type-assert it to that type.
+// Application flags must be not less than api.FlagUserDefined and every flag can be registered only once
+func (h *Handler) RegisterFlag(flag int, newMessage func() api.Message, handle FlagHandlerFunc) error {
+	if flag < api.FlagUserDefined {
+		return fmt.Errorf("flag %#x is reserved by the protocol", flag)
+	}
+	if newMessage == nil || handle == nil {
+		return fmt.Errorf("handler of flag %#x is not set", flag)
+	}
+	return h.registerFlag(flag, newMessage, handle)
+}
+
+func (h *Handler) registerFlag(flag int, newMessage func() api.Message, handle FlagHandlerFunc) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.flagHandlers[flag]; ok {
+		return fmt.Errorf("flag %#x is already registered", flag)
+	}
+	h.flagHandlers[flag] = &flagHandler{
+		newMessage: newMessage,
+		handle:     handle,
+	}
+	return nil
+}
+
+// Removes handler of the application-defined flag, messages with this flag are ignored afterwards
+func (h *Handler) UnregisterFlag(flag int) {
+	if flag < api.FlagUserDefined {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.flagHandlers, flag)
+}
+
+// Checks whether there is a handler for the flag
+func (h *Handler) IsFlagRegistered(flag int) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.flagHandlers[flag]
+	return ok
+}
+
+// Sends message of any (including application-defined) type to the topic, returns ID of the sent message
+func (h *Handler) PublishMessage(topic string, message api.Message) string {
+	base := message.Base()
+	if base.FromMatrixID == "" {
+		base.FromMatrixID = h.matrixID
+	}
+
+	h.sendMessageToTopic(topic, message)
+	return base.ID
+}
@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+type testPingMessage struct {
+	api.BaseMessage
+	Count int `json:"count" protobuf:"varint,16,opt,name=count"`
+}
+
+func TestRegisterFlag(t *testing.T) {
+	handler := newTestHandler(t)
+	_, fromPeerID := newTestPeer(t)
+	flag := api.FlagUserDefined + 1
+
+	if err := handler.RegisterFlag(api.FlagGreeting, nil, nil); err == nil {
+		t.Fatal("built-in flag is overridden")
+	}
+
+	if err := handler.RegisterFlag(flag, nil, nil); err == nil {
+		t.Fatal("flag without handler is registered")
+	}
+	if handler.IsFlagRegistered(flag) {
+		t.Fatal("flag without handler is registered")
+	}
+
+	var received *testPingMessage
+	err := handler.RegisterFlag(flag, func() api.Message {
+		return &testPingMessage{}
+	}, func(h *Handler, ctx *MessageContext, message api.Message) {
+		if ctx.FromPeerID != fromPeerID {
+			t.Fatalf("wrong sender %s", ctx.FromPeerID)
+		}
+		received = message.(*testPingMessage)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = handler.RegisterFlag(flag, newBaseMessage, handleGenericMessage); err == nil {
+		t.Fatal("flag is registered twice")
+	}
+
+	for i, codec := range []Codec{JSONCodec, ProtobufCodec} {
+		received = nil
+		message := &testPingMessage{
+			BaseMessage: api.BaseMessage{Flag: flag, ID: newMessageID()},
+			Count:       i + 1,
+		}
+		handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, fromPeerID, codec, message), nil, nil, nil)
+		if received == nil || received.Count != i+1 {
+			t.Fatalf("%s: message is not delivered to the flag handler", codec.Name())
+		}
+	}
+
+	handler.UnregisterFlag(flag)
+	if handler.IsFlagRegistered(flag) {
+		t.Fatal("flag is still registered")
+	}
+}
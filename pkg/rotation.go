@@ -0,0 +1,589 @@
+package pkg
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// maxReannouncedRevocations is how many revocations are sent to the peer, which has just appeared
+	maxReannouncedRevocations = 32
+	// maxRetiredKeys limits the store of retired keys, announcements of less important peers are dropped above it
+	maxRetiredKeys = 1000
+	// minRetiredJournal is the number of records, which the file may have before it's compacted
+	minRetiredJournal = 100
+)
+
+// KeyRotationEvent is emitted when the peer moves to the new identity, application should migrate its rosters
+type KeyRotationEvent struct {
+	OldPeerID peer.ID
+	NewPeerID peer.ID
+}
+
+// KeyRevocationEvent is emitted when identity key of the peer is revoked, messages from it are rejected since then
+type KeyRevocationEvent struct {
+	PeerID peer.ID
+	Reason string
+}
+
+// RetiredKey is the rotated or revoked key along with its signed announcement, so it can be re-announced
+type RetiredKey struct {
+	Rotation   *api.KeyRotationMessage   `json:"rotation,omitempty"`
+	Revocation *api.KeyRevocationMessage `json:"revocation,omitempty"`
+	// Retired is the time when we have learnt about the announcement (unix ms)
+	Retired int64 `json:"retired"`
+	// Own is set for our own revoked keys
+	Own bool `json:"own,omitempty"`
+}
+
+// retiredRecord is the line of the retired keys file, which is the journal of changes
+type retiredRecord struct {
+	RetiredKey
+	// Dropped is set when the retired key of the peer is dropped from the full store
+	Dropped peer.ID `json:"dropped,omitempty"`
+}
+
+// retiredKeys holds peer IDs, whose keys were rotated or revoked, and persists them in path
+type retiredKeys struct {
+	mu   sync.RWMutex
+	path string
+	// Rotated peer ID maps to the new one, revoked peer ID maps to empty ID
+	peers   map[peer.ID]peer.ID
+	entries map[peer.ID]*RetiredKey
+	// Changes which aren't written yet. They are queued under mu and appended to the file in order under fileMu
+	queue  []interface{}
+	fileMu sync.Mutex
+	// Number of records in the file, it's compacted when it has much more records than entries
+	records int
+}
+
+func newRetiredKeys() *retiredKeys {
+	return &retiredKeys{
+		peers:   make(map[peer.ID]peer.ID),
+		entries: make(map[peer.ID]*RetiredKey),
+	}
+}
+
+func (r *retiredKeys) isRetired(peerID peer.ID) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.peers[peerID]
+	return ok
+}
+
+// Adds the retired key, next is empty ID if the key is revoked. Must be called with locked mutex
+func (r *retiredKeys) add(peerID peer.ID, next peer.ID, entry *RetiredKey) {
+	r.peers[peerID] = next
+	r.entries[peerID] = entry
+	if r.path != "" {
+		r.queue = append(r.queue, &retiredRecord{RetiredKey: *entry})
+	}
+}
+
+// Drops the retired key from the full store. Must be called with locked mutex
+func (r *retiredKeys) drop(peerID peer.ID) {
+	delete(r.peers, peerID)
+	delete(r.entries, peerID)
+	if r.path != "" {
+		r.queue = append(r.queue, &retiredRecord{Dropped: peerID})
+	}
+}
+
+// Writes queued changes, compacting the file if it has too many records. Must be called with unlocked mutex
+func (r *retiredKeys) flush() {
+	r.fileMu.Lock()
+	defer r.fileMu.Unlock()
+	r.mu.Lock()
+	path, records := r.path, r.queue
+	r.queue = nil
+	var compacted []interface{}
+	if r.records+len(records) > 2*len(r.entries)+minRetiredJournal {
+		compacted = make([]interface{}, 0, len(r.entries))
+		for _, entry := range r.entries {
+			compacted = append(compacted, &retiredRecord{RetiredKey: *entry})
+		}
+	}
+	r.mu.Unlock()
+	if path == "" || len(records) == 0 {
+		return
+	}
+
+	var err error
+	if compacted != nil {
+		if err = writeJournal(path, compacted); err == nil {
+			r.records = len(compacted)
+		}
+	} else if err = appendJournal(path, records); err == nil {
+		r.records += len(records)
+	}
+	if err != nil {
+		log.Println("Failed to save retired keys: " + err.Error())
+	}
+}
+
+// Importance of the retired key: our own keys go first, then keys of pinned peers
+func retiredPriority(peerID peer.ID, entry *RetiredKey, pinned map[peer.ID]bool) int {
+	switch {
+	case entry.Own:
+		return 2
+	case pinned[peerID]:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Checks whether the retired key `a` is less important than `b`, older keys are less important among the equal ones
+func lessImportantRetired(a peer.ID, aEntry *RetiredKey, b peer.ID, bEntry *RetiredKey, pinned map[peer.ID]bool) bool {
+	aPriority, bPriority := retiredPriority(a, aEntry, pinned), retiredPriority(b, bEntry, pinned)
+	if aPriority != bPriority {
+		return aPriority < bPriority
+	}
+	return aEntry.Retired < bEntry.Retired
+}
+
+// Checks whether we have interacted with the peer: it has sent us the handshake or signed identity claim
+func (h *Handler) isKnownPeer(peerID peer.ID) bool {
+	h.claims.mu.RLock()
+	_, claimed := h.claims.peers[peerID]
+	h.claims.mu.RUnlock()
+	h.keys.mu.RLock()
+	_, keyed := h.keys.identityKeys[peerID]
+	h.keys.mu.RUnlock()
+	return claimed || keyed
+}
+
+// Remembers the retired key, next is empty ID if the key is revoked. Keys of peers, which we have neither pinned nor seen,
+// aren't retired, and the least important key is dropped when the store is full. Returns false if the key isn't retired
+func (h *Handler) retireKey(peerID peer.ID, next peer.ID, entry *RetiredKey) bool {
+	pinned := h.pinnedPeers()
+	if !entry.Own && !pinned[peerID] && !h.isKnownPeer(peerID) {
+		return false
+	}
+
+	h.retired.mu.Lock()
+	if _, ok := h.retired.entries[peerID]; !ok && len(h.retired.entries) >= maxRetiredKeys {
+		dropped, droppedEntry := peerID, entry
+		for id, stored := range h.retired.entries {
+			if lessImportantRetired(id, stored, dropped, droppedEntry, pinned) {
+				dropped, droppedEntry = id, stored
+			}
+		}
+		if dropped == peerID {
+			h.retired.mu.Unlock()
+			return false
+		}
+		h.retired.drop(dropped)
+	}
+	h.retired.add(peerID, next, entry)
+	h.retired.mu.Unlock()
+	h.retired.flush()
+	return true
+}
+
+// Loads rotated and revoked keys from the file and appends every change there.
+// Announcements are verified again, so the file can't make us distrust valid keys
+func (h *Handler) EnableRetiredKeyStore(path string) error {
+	peers := make(map[peer.ID]peer.ID)
+	entries := make(map[peer.ID]*RetiredKey)
+	records, err := readJournal(path, func() interface{} {
+		return &retiredRecord{}
+	}, func(value interface{}) {
+		record := value.(*retiredRecord)
+		entry := record.RetiredKey
+		switch {
+		case record.Dropped != "":
+			delete(peers, record.Dropped)
+			delete(entries, record.Dropped)
+		case entry.Revocation != nil:
+			peerID, err := verifyKeyRevocation(entry.Revocation)
+			if err != nil {
+				log.Println("Skipping invalid key revocation: " + err.Error())
+				return
+			}
+			peers[peerID] = ""
+			entries[peerID] = &entry
+		case entry.Rotation != nil:
+			oldPeerID, newPeerID, err := verifyKeyRotation(entry.Rotation)
+			if err != nil {
+				log.Println("Skipping invalid key rotation: " + err.Error())
+				return
+			}
+			// Revocation wins, if the key is known to be revoked
+			if next, ok := peers[oldPeerID]; !ok || next != "" {
+				peers[oldPeerID] = newPeerID
+				entries[oldPeerID] = &entry
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	h.retired.fileMu.Lock()
+	h.retired.mu.Lock()
+	// Keys retired before the store is enabled are kept, unless the file knows better
+	h.retired.queue = nil
+	for peerID, entry := range h.retired.entries {
+		if _, ok := entries[peerID]; !ok {
+			peers[peerID] = h.retired.peers[peerID]
+			entries[peerID] = entry
+			h.retired.queue = append(h.retired.queue, &retiredRecord{RetiredKey: *entry})
+		}
+	}
+	h.retired.path = path
+	h.retired.peers = peers
+	h.retired.entries = entries
+	h.retired.records = records
+	h.retired.mu.Unlock()
+	h.retired.fileMu.Unlock()
+	h.retired.flush()
+	return nil
+}
+
+// Returns rotated and revoked keys, which we know about
+func (h *Handler) GetRetiredKeys() []RetiredKey {
+	h.retired.mu.RLock()
+	defer h.retired.mu.RUnlock()
+	entries := make([]RetiredKey, 0, len(h.retired.entries))
+	for _, entry := range h.retired.entries {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+func keyRotationPayload(oldPeerID peer.ID, newPeerID peer.ID) []byte {
+	payload := []byte(keyRotationPrefix)
+	for _, field := range []string{string(oldPeerID), string(newPeerID)} {
+		payload = appendVarint(payload, uint64(len(field)))
+		payload = append(payload, field...)
+	}
+	return payload
+}
+
+func keyRevocationPayload(peerID peer.ID, reason string) []byte {
+	payload := []byte(keyRevocationPrefix)
+	for _, field := range []string{string(peerID), reason} {
+		payload = appendVarint(payload, uint64(len(field)))
+		payload = append(payload, field...)
+	}
+	return payload
+}
+
+// Announces on the service topic that the node moves from oldKey to newKey identity
+func (h *Handler) AnnounceKeyRotation(oldKey crypto.PrivKey, newKey crypto.PrivKey) error {
+	rotation, err := h.newKeyRotation(oldKey, newKey)
+	if err != nil {
+		return err
+	}
+	h.sendMessageToServiceTopic(rotation)
+	return nil
+}
+
+// Announces on the service topic that the key is compromised and must not be trusted anymore.
+// Revocation is remembered, so it's announced again to peers which appear later
+func (h *Handler) RevokeIdentityKey(key crypto.PrivKey, reason string) error {
+	revocation, err := h.newKeyRevocation(key, reason)
+	if err != nil {
+		return err
+	}
+	peerID, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	h.sendMessageToServiceTopic(revocation)
+	h.retireKey(peerID, "", &RetiredKey{Revocation: revocation, Retired: nowMillis(), Own: true})
+	return nil
+}
+
+// Sends revocations to the peer, which may have been offline when they were announced.
+// Our own revocations go first, then revocations of pinned peers, the latest ones first among the equal
+func (h *Handler) reannounceRevocations(toPeerID peer.ID) {
+	pinned := h.pinnedPeers()
+	h.retired.mu.RLock()
+	peerIDs := []peer.ID{}
+	revocations := make(map[peer.ID]*RetiredKey)
+	for peerID, entry := range h.retired.entries {
+		if entry.Revocation != nil && peerID != toPeerID {
+			peerIDs = append(peerIDs, peerID)
+			revocations[peerID] = entry
+		}
+	}
+	h.retired.mu.RUnlock()
+	sort.Slice(peerIDs, func(i, j int) bool {
+		return lessImportantRetired(peerIDs[j], revocations[peerIDs[j]], peerIDs[i], revocations[peerIDs[i]], pinned)
+	})
+	if len(peerIDs) > maxReannouncedRevocations {
+		peerIDs = peerIDs[:maxReannouncedRevocations]
+	}
+
+	for _, peerID := range peerIDs {
+		entry := revocations[peerID]
+		h.sendMessageToServiceTopic(&api.KeyRevocationMessage{
+			BaseMessage: api.BaseMessage{
+				Body:         "",
+				To:           toPeerID.String(),
+				Flag:         api.FlagKeyRevocation,
+				FromMatrixID: h.matrixID,
+			},
+			RevokedKey: entry.Revocation.RevokedKey,
+			Reason:     entry.Revocation.Reason,
+			Signature:  entry.Revocation.Signature,
+		})
+	}
+}
+
+// Creates rotation message signed by both keys
+func (h *Handler) newKeyRotation(oldKey crypto.PrivKey, newKey crypto.PrivKey) (*api.KeyRotationMessage, error) {
+	oldPeerID, err := peer.IDFromPrivateKey(oldKey)
+	if err != nil {
+		return nil, err
+	}
+	newPeerID, err := peer.IDFromPrivateKey(newKey)
+	if err != nil {
+		return nil, err
+	}
+	if oldPeerID == newPeerID {
+		return nil, errors.New("keys are the same")
+	}
+
+	rotation := &api.KeyRotationMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			Flag:         api.FlagKeyRotation,
+			FromMatrixID: h.matrixID,
+		},
+	}
+	payload := keyRotationPayload(oldPeerID, newPeerID)
+	if rotation.OldKey, err = crypto.MarshalPublicKey(oldKey.GetPublic()); err != nil {
+		return nil, err
+	}
+	if rotation.NewKey, err = crypto.MarshalPublicKey(newKey.GetPublic()); err != nil {
+		return nil, err
+	}
+	if rotation.OldSignature, err = oldKey.Sign(payload); err != nil {
+		return nil, err
+	}
+	if rotation.NewSignature, err = newKey.Sign(payload); err != nil {
+		return nil, err
+	}
+	return rotation, nil
+}
+
+// Creates revocation message signed by the revoked key
+func (h *Handler) newKeyRevocation(key crypto.PrivKey, reason string) (*api.KeyRevocationMessage, error) {
+	peerID, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	revocation := &api.KeyRevocationMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			Flag:         api.FlagKeyRevocation,
+			FromMatrixID: h.matrixID,
+		},
+		Reason: reason,
+	}
+	if revocation.RevokedKey, err = crypto.MarshalPublicKey(key.GetPublic()); err != nil {
+		return nil, err
+	}
+	if revocation.Signature, err = key.Sign(keyRevocationPayload(peerID, reason)); err != nil {
+		return nil, err
+	}
+	return revocation, nil
+}
+
+// Returns the current peer ID of the peer following its key rotations, empty ID if its key is revoked
+func (h *Handler) CurrentPeerID(peerID peer.ID) peer.ID {
+	h.retired.mu.RLock()
+	defer h.retired.mu.RUnlock()
+	for i := 0; i < len(h.retired.peers); i++ {
+		next, ok := h.retired.peers[peerID]
+		if !ok {
+			break
+		}
+		peerID = next
+	}
+	return peerID
+}
+
+// Checks whether identity key of the peer is revoked
+func (h *Handler) IsRevoked(peerID peer.ID) bool {
+	h.retired.mu.RLock()
+	defer h.retired.mu.RUnlock()
+	next, ok := h.retired.peers[peerID]
+	return ok && next == ""
+}
+
+// Returns peer ID of the key if it matches the signature of the payload
+func verifyAnnouncement(marshalledKey []byte, signature []byte, payload func(peer.ID) []byte) (peer.ID, error) {
+	key, err := crypto.UnmarshalPublicKey(marshalledKey)
+	if err != nil {
+		return "", err
+	}
+	peerID, err := peer.IDFromPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	if ok, err := key.Verify(payload(peerID), signature); err != nil || !ok {
+		return "", errors.New("invalid signature")
+	}
+	return peerID, nil
+}
+
+func newKeyRotationMessage() api.Message {
+	return &api.KeyRotationMessage{}
+}
+
+func newKeyRevocationMessage() api.Message {
+	return &api.KeyRevocationMessage{}
+}
+
+// Checks both signatures of the rotation, returning old and new peer IDs
+func verifyKeyRotation(rotation *api.KeyRotationMessage) (peer.ID, peer.ID, error) {
+	newKey, err := crypto.UnmarshalPublicKey(rotation.NewKey)
+	if err != nil {
+		return "", "", err
+	}
+	newPeerID, err := peer.IDFromPublicKey(newKey)
+	if err != nil {
+		return "", "", err
+	}
+	oldPeerID, err := verifyAnnouncement(rotation.OldKey, rotation.OldSignature, func(oldPeerID peer.ID) []byte {
+		return keyRotationPayload(oldPeerID, newPeerID)
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if ok, err := newKey.Verify(keyRotationPayload(oldPeerID, newPeerID), rotation.NewSignature); err != nil || !ok {
+		return "", "", errors.New("invalid signature")
+	}
+	return oldPeerID, newPeerID, nil
+}
+
+// Checks signature of the revocation, returning the revoked peer ID
+func verifyKeyRevocation(revocation *api.KeyRevocationMessage) (peer.ID, error) {
+	return verifyAnnouncement(revocation.RevokedKey, revocation.Signature, func(peerID peer.ID) []byte {
+		return keyRevocationPayload(peerID, revocation.Reason)
+	})
+}
+
+// Getting key rotation, it's signed by both keys, so it doesn't matter who has forwarded it
+func handleKeyRotation(h *Handler, ctx *MessageContext, message api.Message) {
+	rotation := message.(*api.KeyRotationMessage)
+	oldPeerID, newPeerID, err := verifyKeyRotation(rotation)
+	if err != nil {
+		log.Println("Invalid key rotation from " + ctx.FromPeerID.String())
+		return
+	}
+	if oldPeerID == newPeerID || oldPeerID == h.peerID || h.retired.isRetired(oldPeerID) || h.retired.isRetired(newPeerID) {
+		return // Already known, or revoked key tries to move somewhere
+	}
+
+	if !h.retireKey(oldPeerID, newPeerID, &RetiredKey{Rotation: rotation, Retired: nowMillis()}) {
+		log.Println("Ignoring key rotation of unknown peer " + oldPeerID.String())
+		return
+	}
+	h.migratePeer(oldPeerID, newPeerID)
+	log.Println("Peer " + oldPeerID.String() + " has moved to " + newPeerID.String())
+	h.emitEvent(&KeyRotationEvent{OldPeerID: oldPeerID, NewPeerID: newPeerID})
+}
+
+// Getting key revocation, it's signed by the revoked key itself
+func handleKeyRevocation(h *Handler, ctx *MessageContext, message api.Message) {
+	revocation := message.(*api.KeyRevocationMessage)
+	peerID, err := verifyKeyRevocation(revocation)
+	if err != nil {
+		log.Println("Invalid key revocation from " + ctx.FromPeerID.String())
+		return
+	}
+	if h.IsRevoked(peerID) {
+		return
+	}
+
+	if !h.retireKey(peerID, "", &RetiredKey{Revocation: revocation, Retired: nowMillis()}) {
+		log.Println("Ignoring key revocation of unknown peer " + peerID.String())
+		return
+	}
+	h.forgetPeer(peerID)
+	log.Println("Identity key of " + peerID.String() + " is revoked: " + revocation.Reason)
+	h.emitEvent(&KeyRevocationEvent{PeerID: peerID, Reason: revocation.Reason})
+}
+
+// Moves everything we know about the peer to its new ID
+func (h *Handler) migratePeer(oldPeerID peer.ID, newPeerID peer.ID) {
+	h.blocks.mu.RLock()
+	blocked := h.blocks.peers[oldPeerID]
+	h.blocks.mu.RUnlock()
+	if blocked != nil {
+		if err := h.BlockPeer(newPeerID, blocked.Mode, blocked.Reason); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	h.mu.Lock()
+	if matrixID, ok := h.identityMap[peer.ID(oldPeerID.String())]; ok {
+		h.identityMap[peer.ID(newPeerID.String())] = matrixID
+	}
+	h.mu.Unlock()
+
+	h.claims.mu.Lock()
+	if identity, ok := h.claims.peers[oldPeerID]; ok {
+		if _, known := h.claims.peers[newPeerID]; !known {
+			h.claims.peers[newPeerID] = identity
+		}
+	}
+	h.claims.mu.Unlock()
+
+	h.groups.mu.Lock()
+	for _, session := range h.groups.sessions {
+		if session.removed[oldPeerID] {
+			session.removed[newPeerID] = true
+		}
+	}
+	h.groups.mu.Unlock()
+
+	h.migratePins(oldPeerID, newPeerID)
+	h.forgetPeer(oldPeerID)
+}
+
+// Drops identity and keys of the peer, whose key is retired
+func (h *Handler) forgetPeer(peerID peer.ID) {
+	h.mu.Lock()
+	delete(h.identityMap, peer.ID(peerID.String()))
+	delete(h.peerInfo, peerID)
+	h.mu.Unlock()
+
+	h.claims.mu.Lock()
+	delete(h.claims.peers, peerID)
+	h.claims.mu.Unlock()
+
+	h.keys.mu.Lock()
+	delete(h.keys.identityKeys, peerID)
+	delete(h.keys.peerKeys, peerID)
+	delete(h.keys.preKeys, peerID)
+	h.keys.mu.Unlock()
+
+	h.verifications.mu.Lock()
+	delete(h.verifications.states, peerID)
+	h.verifications.mu.Unlock()
+
+	h.sessions.mu.Lock()
+	h.sessions.drop(peerID)
+	h.sessions.mu.Unlock()
+
+	h.groups.mu.Lock()
+	for key := range h.groups.members {
+		if strings.HasSuffix(key, "/"+peerID.String()) {
+			delete(h.groups.members, key)
+		}
+	}
+	h.groups.mu.Unlock()
+}
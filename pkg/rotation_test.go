@@ -0,0 +1,234 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestKeyRotation(t *testing.T) {
+	alice, bob := newTestKeyedHandler(t), newTestKeyedHandler(t)
+	alice.SetMatrixID("@alice:moonshard")
+	claim := alice.ownIdentityMessage(api.FlagIdentityResponse, "")
+	claim.Timestamp = nowMillis()
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, JSONCodec, claim), nil, nil, nil)
+
+	newKey, newPeerID := newTestPeer(t)
+	mallory := newTestKeyedHandler(t)
+	// Rotation must be signed by the new key too, otherwise anyone could steal the identity
+	forged, err := alice.newKeyRotation(alice.keys.identityKey, mallory.keys.identityKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forged.NewKey, err = crypto.MarshalPublicKey(newKey.GetPublic()); err != nil {
+		t.Fatal(err)
+	}
+	forged.Timestamp = nowMillis()
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, mallory.peerID, JSONCodec, forged), nil, nil, nil)
+	if bob.CurrentPeerID(alice.peerID) != alice.peerID {
+		t.Fatal("rotation with invalid signature is accepted")
+	}
+
+	var events []*KeyRotationEvent
+	bob.SetEventHandler(func(event Event) {
+		if rotationEvent, ok := event.(*KeyRotationEvent); ok {
+			events = append(events, rotationEvent)
+		}
+	})
+	rotation, err := alice.newKeyRotation(alice.keys.identityKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotation.Timestamp = nowMillis()
+	// Rotation is signed by both keys, so it may be forwarded by anyone
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, mallory.peerID, JSONCodec, rotation), nil, nil, nil)
+	if len(events) != 1 || events[0].OldPeerID != alice.peerID || events[0].NewPeerID != newPeerID {
+		t.Fatal("rotation event is not emitted")
+	}
+	if bob.CurrentPeerID(alice.peerID) != newPeerID {
+		t.Fatal("rotation is not followed")
+	}
+	if bob.GetIdentityMap()[peer.ID(newPeerID.String())] != "@alice:moonshard" {
+		t.Fatal("identity map is not migrated")
+	}
+	if _, ok := bob.GetIdentityMap()[peer.ID(alice.peerID.String())]; ok {
+		t.Fatal("old peer ID is left in identity map")
+	}
+	data, err := JSONCodec.Marshal(&api.BaseMessage{Flag: api.FlagGenericMessage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.checkData(alice.peerID, data); err == nil {
+		t.Fatal("message from rotated key is accepted")
+	}
+}
+
+func TestKeyRevocation(t *testing.T) {
+	alice, bob, eve := newTestKeyedHandler(t), newTestKeyedHandler(t), newTestKeyedHandler(t)
+	sendTestHandshake(t, alice, bob)
+
+	// Revocations of peers, which we have never seen, aren't stored
+	junk, err := eve.newKeyRevocation(eve.keys.identityKey, "junk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk.Timestamp = nowMillis()
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, JSONCodec, junk), nil, nil, nil)
+	if bob.IsRevoked(eve.peerID) || len(bob.GetRetiredKeys()) != 0 {
+		t.Fatal("revocation of unknown peer is stored")
+	}
+
+	revocation, err := alice.newKeyRevocation(alice.keys.identityKey, "stolen laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocation.Timestamp = nowMillis()
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, JSONCodec, revocation), nil, nil, nil)
+	if !bob.IsRevoked(alice.peerID) || bob.CurrentPeerID(alice.peerID) != "" {
+		t.Fatal("key is not revoked")
+	}
+	if bob.keys.peerKey(alice.peerID) != nil {
+		t.Fatal("encryption key of revoked identity is kept")
+	}
+
+	// Revoked key can't move to another identity
+	newKey, _ := newTestPeer(t)
+	rotation, err := alice.newKeyRotation(alice.keys.identityKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotation.Timestamp = nowMillis()
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, bob.peerID, JSONCodec, rotation), nil, nil, nil)
+	if bob.CurrentPeerID(alice.peerID) != "" {
+		t.Fatal("revoked key has rotated")
+	}
+}
+
+func TestRetiredKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2chat-retired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "retired.json")
+
+	alice, carol, bob := newTestKeyedHandler(t), newTestKeyedHandler(t), newTestKeyedHandler(t)
+	if err = bob.EnableRetiredKeyStore(path); err != nil {
+		t.Fatal(err)
+	}
+	sendTestHandshake(t, alice, bob)
+	sendTestHandshake(t, carol, bob)
+	revocation, err := alice.newKeyRevocation(alice.keys.identityKey, "stolen laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocation.Timestamp = nowMillis()
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, JSONCodec, revocation), nil, nil, nil)
+	newKey, newPeerID := newTestPeer(t)
+	rotation, err := carol.newKeyRotation(carol.keys.identityKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotation.Timestamp = nowMillis()
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, carol.peerID, JSONCodec, rotation), nil, nil, nil)
+
+	restarted := newTestKeyedHandler(t)
+	if err = restarted.EnableRetiredKeyStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.IsRevoked(alice.peerID) {
+		t.Fatal("revocation is not persisted")
+	}
+	if restarted.CurrentPeerID(carol.peerID) != newPeerID {
+		t.Fatal("rotation is not persisted")
+	}
+	if len(restarted.GetRetiredKeys()) != 2 {
+		t.Fatal("announcements of retired keys are not kept")
+	}
+
+	// Announcements are verified on loading
+	forged := &RetiredKey{Revocation: &api.KeyRevocationMessage{RevokedKey: revocation.RevokedKey, Reason: "forged", Signature: revocation.Signature}}
+	if err = writeJournal(path, []interface{}{&retiredRecord{RetiredKey: *forged}}); err != nil {
+		t.Fatal(err)
+	}
+	restarted = newTestKeyedHandler(t)
+	if err = restarted.EnableRetiredKeyStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.IsRevoked(alice.peerID) {
+		t.Fatal("revocation with invalid signature is loaded")
+	}
+}
+
+func TestRevocationReannouncement(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bobHost, bob := newTestNetworkKeyedHandler(t, ctx)
+	carolHost, carol := newTestNetworkKeyedHandler(t, ctx)
+	alice := newTestKeyedHandler(t)
+	sendTestHandshake(t, alice, bob)
+	sendTestHandshake(t, alice, carol)
+
+	// Bob has learnt about revocation, while Carol was offline
+	revocation, err := alice.newKeyRevocation(alice.keys.identityKey, "stolen laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocation.Timestamp = nowMillis()
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, JSONCodec, revocation), nil, nil, nil)
+
+	connectTestHosts(t, ctx, bobHost, carolHost)
+	joinTestTopic(t, ctx, bob, "moonshard", nil)
+	joinTestTopic(t, ctx, carol, "moonshard", nil)
+	waitFor(t, "pubsub peers", func() bool {
+		return len(bob.GetPeers("moonshard")) == 1 && len(carol.GetPeers("moonshard")) == 1
+	})
+	carol.SendHandshake()
+	waitFor(t, "re-announced revocation", func() bool {
+		return carol.IsRevoked(alice.peerID)
+	})
+}
+
+func TestRetiredKeyLimit(t *testing.T) {
+	bob := newTestKeyedHandler(t)
+	for i := 0; i < maxRetiredKeys; i++ {
+		bob.retired.add(peer.ID(fmt.Sprintf("retired-%d", i)), "", &RetiredKey{Retired: int64(i + 1)})
+	}
+
+	_, unknownPeerID := newTestPeer(t)
+	if bob.retireKey(unknownPeerID, "", &RetiredKey{Retired: nowMillis()}) {
+		t.Fatal("key of unknown peer is retired")
+	}
+	// Pinned peer is more important than the rest, even though its key is retired earlier
+	_, alicePeerID := newTestPeer(t)
+	bob.checkPin(alicePeerID, "@alice:moonshard")
+	if !bob.retireKey(alicePeerID, "", &RetiredKey{}) || !bob.IsRevoked(alicePeerID) {
+		t.Fatal("key of pinned peer is not retired in the full store")
+	}
+	if len(bob.GetRetiredKeys()) != maxRetiredKeys || bob.IsRevoked("retired-0") {
+		t.Fatal("the oldest key is not dropped from the full store")
+	}
+	_, ownPeerID := newTestPeer(t)
+	if !bob.retireKey(ownPeerID, "", &RetiredKey{Own: true}) || bob.IsRevoked("retired-1") {
+		t.Fatal("own key is not retired in the full store")
+	}
+
+	// Store is full of more important keys
+	carol := newTestKeyedHandler(t)
+	sendTestHandshake(t, carol, bob)
+	bob.retired.mu.Lock()
+	for _, entry := range bob.retired.entries {
+		entry.Own = true
+	}
+	bob.retired.mu.Unlock()
+	if bob.retireKey(carol.peerID, "", &RetiredKey{Retired: nowMillis()}) || bob.IsRevoked(carol.peerID) {
+		t.Fatal("less important key has replaced more important one")
+	}
+}
@@ -0,0 +1,256 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	safetyNumberVersion = 0
+	// Hash is iterated to make it expensive to find the key with similar safety number
+	safetyNumberIterations = 5200
+	// Every side contributes 6 blocks of 5 digits
+	safetyNumberBlocks = 6
+	safetyNumberEmoji  = 7
+)
+
+// safetyEmoji is the table of emoji, every emoji stands for 6 bits of the fingerprint
+var safetyEmoji = [64]string{
+	"🐶", "🐱", "🦁", "🐎", "🦄", "🐷", "🐘", "🐰",
+	"🐼", "🐓", "🐧", "🐢", "🐟", "🐙", "🦋", "🌷",
+	"🌳", "🌵", "🍄", "🌏", "🌙", "☁️", "🔥", "🍌",
+	"🍎", "🍓", "🌽", "🍕", "🎂", "❤️", "😀", "🤖",
+	"🎩", "👓", "🔧", "🎅", "👍", "☂️", "⌛", "⏰",
+	"🎁", "💡", "📕", "✏️", "📎", "✂️", "🔒", "🔑",
+	"🔨", "☎️", "🏁", "🚂", "🚲", "✈️", "🚀", "🏆",
+	"⚽", "🎸", "🎺", "🔔", "⚓", "🎧", "📁", "📌",
+}
+
+// SafetyNumber is the fingerprint of two identities, which users compare out of band.
+// Both sides get the same safety number
+type SafetyNumber struct {
+	// Digits are 12 blocks of 5 digits separated by spaces
+	Digits string
+	Emoji  []string
+	// fingerprint is the hash, which peers exchange when they confirm the safety number
+	fingerprint []byte
+}
+
+// VerificationState tells which sides have confirmed the safety number
+type VerificationState int
+
+const (
+	// VerificationNone means that no side has confirmed the safety number yet
+	VerificationNone VerificationState = iota
+	// VerificationLocal means that our user has confirmed the safety number
+	VerificationLocal
+	// VerificationRemote means that the peer has confirmed the safety number
+	VerificationRemote
+	// VerificationMutual means that both sides have confirmed the same safety number
+	VerificationMutual
+)
+
+// VerificationEvent is emitted when the peer requests verification or its state changes.
+// Mismatch is set if the peer has confirmed another safety number, so someone is in the middle
+type VerificationEvent struct {
+	PeerID    peer.ID
+	State     VerificationState
+	Requested bool
+	Mismatch  bool
+}
+
+// verifications holds states of safety number verification with peers
+type verifications struct {
+	mu     sync.Mutex
+	states map[peer.ID]VerificationState
+}
+
+func newVerifications() *verifications {
+	return &verifications{
+		states: make(map[peer.ID]VerificationState),
+	}
+}
+
+// Derives fingerprint of one side from its identity key and Matrix ID
+func identityFingerprint(key crypto.PubKey, matrixID string) ([]byte, error) {
+	rawKey, err := crypto.MarshalPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	input := make([]byte, 2, 2+len(rawKey)+len(matrixID))
+	binary.BigEndian.PutUint16(input, safetyNumberVersion)
+	input = append(input, rawKey...)
+	input = append(input, matrixID...)
+
+	hash := input
+	for i := 0; i < safetyNumberIterations; i++ {
+		sum := sha512.Sum512(append(hash, rawKey...))
+		hash = sum[:]
+	}
+	return hash[:safetyNumberBlocks*5], nil
+}
+
+// Computes safety number of two identities, it doesn't depend on which side is local
+func ComputeSafetyNumber(localKey crypto.PubKey, localMatrixID string, remoteKey crypto.PubKey, remoteMatrixID string) (*SafetyNumber, error) {
+	local, err := identityFingerprint(localKey, localMatrixID)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := identityFingerprint(remoteKey, remoteMatrixID)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Compare(local, remote) > 0 {
+		local, remote = remote, local
+	}
+
+	blocks := make([]string, 0, 2*safetyNumberBlocks)
+	for _, side := range [][]byte{local, remote} {
+		for i := 0; i < safetyNumberBlocks; i++ {
+			chunk := side[i*5 : i*5+5]
+			value := uint64(chunk[0])<<32 | uint64(chunk[1])<<24 | uint64(chunk[2])<<16 | uint64(chunk[3])<<8 | uint64(chunk[4])
+			blocks = append(blocks, fmt.Sprintf("%05d", value%100000))
+		}
+	}
+
+	fingerprint := sha256.Sum256(append(append([]byte{}, local...), remote...))
+	emoji := make([]string, safetyNumberEmoji)
+	bits := binary.BigEndian.Uint64(fingerprint[:8])
+	for i := range emoji {
+		emoji[i] = safetyEmoji[bits>>uint(58-6*i)&63]
+	}
+	return &SafetyNumber{
+		Digits:      strings.Join(blocks, " "),
+		Emoji:       emoji,
+		fingerprint: fingerprint[:],
+	}, nil
+}
+
+// Returns safety number of our identity and identity of the peer, the peer must have sent its identity key in the handshake
+func (h *Handler) SafetyNumber(peerID peer.ID) (*SafetyNumber, error) {
+	h.keys.mu.RLock()
+	identityKey := h.keys.identityKey
+	peerKey := h.keys.identityKeys[peerID]
+	h.keys.mu.RUnlock()
+	if identityKey == nil {
+		return nil, errors.New("identity key is not set")
+	}
+	if peerKey == nil {
+		return nil, errors.New("identity key of " + peerID.String() + " is unknown")
+	}
+	return ComputeSafetyNumber(identityKey.GetPublic(), h.matrixID, peerKey, h.verifiedMatrixID(peerID))
+}
+
+// Returns Matrix ID of the peer, if its claim is signed
+func (h *Handler) verifiedMatrixID(peerID peer.ID) string {
+	identity, ok := h.GetIdentity(peerID)
+	if !ok || identity.Level == IdentityUnverified {
+		return ""
+	}
+	return identity.MatrixID
+}
+
+// Returns state of safety number verification with the peer
+func (h *Handler) GetVerificationState(peerID peer.ID) VerificationState {
+	h.verifications.mu.Lock()
+	defer h.verifications.mu.Unlock()
+	return h.verifications.states[peerID]
+}
+
+// Asks the peer to compare safety numbers, its application should show the safety number to the user
+func (h *Handler) RequestVerification(peerID peer.ID) {
+	request := &api.VerificationMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			Flag:         api.FlagVerifyRequest,
+			FromMatrixID: h.matrixID,
+			To:           peerID.String(),
+		},
+	}
+	h.sendMessageToServiceTopic(request)
+}
+
+// Confirms that the user has compared the safety number with the peer, and sends the confirmation to the peer.
+// Identity is verified when both sides have confirmed
+func (h *Handler) ConfirmVerification(peerID peer.ID) error {
+	safetyNumber, err := h.SafetyNumber(peerID)
+	if err != nil {
+		return err
+	}
+	h.setVerificationState(peerID, VerificationLocal)
+
+	confirm := &api.VerificationMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			Flag:         api.FlagVerifyConfirm,
+			FromMatrixID: h.matrixID,
+			To:           peerID.String(),
+		},
+		Fingerprint: safetyNumber.fingerprint,
+	}
+	h.sendMessageToServiceTopic(confirm)
+	return nil
+}
+
+// Merges confirmation of one side into verification state, pinning the identity when both sides have confirmed
+func (h *Handler) setVerificationState(peerID peer.ID, confirmed VerificationState) {
+	h.verifications.mu.Lock()
+	state := h.verifications.states[peerID]
+	if state != confirmed && state != VerificationMutual {
+		if state == VerificationNone {
+			state = confirmed
+		} else {
+			state = VerificationMutual
+		}
+	}
+	h.verifications.states[peerID] = state
+	h.verifications.mu.Unlock()
+
+	if state == VerificationMutual {
+		if matrixID := h.verifiedMatrixID(peerID); matrixID != "" {
+			if err := h.VerifyIdentity(matrixID, peerID); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
+	h.emitEvent(&VerificationEvent{PeerID: peerID, State: state})
+}
+
+func newVerificationMessage() api.Message {
+	return &api.VerificationMessage{}
+}
+
+func handleVerifyRequest(h *Handler, ctx *MessageContext, message api.Message) {
+	h.emitEvent(&VerificationEvent{PeerID: ctx.FromPeerID, State: h.GetVerificationState(ctx.FromPeerID), Requested: true})
+}
+
+// Getting confirmation of the peer, it counts only if the peer has seen the same safety number as we do
+func handleVerifyConfirm(h *Handler, ctx *MessageContext, message api.Message) {
+	confirm := message.(*api.VerificationMessage)
+	safetyNumber, err := h.SafetyNumber(ctx.FromPeerID)
+	if err != nil {
+		log.Println("Can't check safety number confirmed by " + ctx.FromPeerID.String() + ": " + err.Error())
+		return
+	}
+	if subtle.ConstantTimeCompare(safetyNumber.fingerprint, confirm.Fingerprint) != 1 {
+		log.Println("Safety number confirmed by " + ctx.FromPeerID.String() + " doesn't match ours")
+		h.verifications.mu.Lock()
+		delete(h.verifications.states, ctx.FromPeerID)
+		h.verifications.mu.Unlock()
+		h.emitEvent(&VerificationEvent{PeerID: ctx.FromPeerID, State: VerificationNone, Mismatch: true})
+		return
+	}
+	h.setVerificationState(ctx.FromPeerID, VerificationRemote)
+}
@@ -0,0 +1,85 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	alice, bob, mallory := newTestKeyedHandler(t), newTestKeyedHandler(t), newTestKeyedHandler(t)
+	sendTestHandshake(t, alice, bob)
+	sendTestHandshake(t, bob, alice)
+	sendTestHandshake(t, mallory, alice)
+
+	aliceNumber, err := alice.SafetyNumber(bob.peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobNumber, err := bob.SafetyNumber(alice.peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliceNumber.Digits != bobNumber.Digits || len(aliceNumber.Digits) != 12*5+11 || len(aliceNumber.Emoji) != safetyNumberEmoji {
+		t.Fatalf("safety numbers differ: %s and %s", aliceNumber.Digits, bobNumber.Digits)
+	}
+	for i := range aliceNumber.Emoji {
+		if aliceNumber.Emoji[i] != bobNumber.Emoji[i] {
+			t.Fatal("emoji differ")
+		}
+	}
+	malloryNumber, err := alice.SafetyNumber(mallory.peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if malloryNumber.Digits == aliceNumber.Digits {
+		t.Fatal("safety number doesn't depend on the key")
+	}
+}
+
+func TestVerificationFlow(t *testing.T) {
+	alice, bob := newTestKeyedHandler(t), newTestKeyedHandler(t)
+	alice.SetMatrixID("@alice:moonshard")
+	sendTestHandshake(t, alice, bob)
+	sendTestHandshake(t, bob, alice)
+	claim := alice.ownIdentityMessage(api.FlagIdentityResponse, "")
+	claim.Timestamp = nowMillis()
+	bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, JSONCodec, claim), nil, nil, nil)
+
+	var events []*VerificationEvent
+	bob.SetEventHandler(func(event Event) {
+		if verificationEvent, ok := event.(*VerificationEvent); ok {
+			events = append(events, verificationEvent)
+		}
+	})
+	deliverConfirm := func(fingerprint []byte) {
+		confirm := &api.VerificationMessage{
+			BaseMessage: api.BaseMessage{Flag: api.FlagVerifyConfirm, To: bob.peerID.String(), Timestamp: nowMillis()},
+			Fingerprint: fingerprint,
+		}
+		bob.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, alice.peerID, JSONCodec, confirm), nil, nil, nil)
+	}
+
+	// Alice has seen another safety number, so someone is in the middle
+	deliverConfirm(make([]byte, 32))
+	if len(events) != 1 || !events[0].Mismatch || bob.GetVerificationState(alice.peerID) != VerificationNone {
+		t.Fatal("mismatch of safety numbers is not reported")
+	}
+
+	// Bob confirms locally (ConfirmVerification also sends the confirmation, which needs the network)
+	bob.setVerificationState(alice.peerID, VerificationLocal)
+	if identity, _ := bob.GetIdentity(alice.peerID); identity.Verified {
+		t.Fatal("identity is verified by one side")
+	}
+	aliceNumber, err := alice.SafetyNumber(bob.peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverConfirm(aliceNumber.fingerprint)
+	if bob.GetVerificationState(alice.peerID) != VerificationMutual {
+		t.Fatal("verification is not mutual")
+	}
+	if identity, _ := bob.GetIdentity(alice.peerID); !identity.Verified {
+		t.Fatal("mutually verified identity is not marked as verified")
+	}
+}
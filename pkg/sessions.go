@@ -0,0 +1,463 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// DefaultPreKeyLifetime is how long signed prekey is used before it's replaced with the new one
+	DefaultPreKeyLifetime = 7 * 24 * time.Hour
+	x3dhInfo              = "p2chat x3dh"
+	preKeysFile           = "prekeys.json"
+	// storageKeyInfo derives the key, which encrypts session files, from the identity key
+	storageKeyInfo = "p2chat session storage"
+)
+
+// preKey is medium-term key pair, which is used by peers to start sessions with us
+type preKey struct {
+	PrivateKey []byte `json:"privateKey"`
+	PublicKey  []byte `json:"publicKey"`
+	// Created is unix time in milliseconds
+	Created int64 `json:"created"`
+}
+
+// Previous prekey is kept for sessions which were started before rotation
+type preKeys struct {
+	Current  *preKey `json:"current"`
+	Previous *preKey `json:"previous,omitempty"`
+}
+
+func (p *preKeys) find(publicKey []byte) *preKey {
+	for _, key := range []*preKey{p.Current, p.Previous} {
+		if key != nil && bytes.Equal(key.PublicKey, publicKey) {
+			return key
+		}
+	}
+	return nil
+}
+
+// Sessions with the peer. Previous session is kept while both peers start sessions simultaneously
+type peerSessions struct {
+	Current  *ratchetState `json:"current"`
+	Previous *ratchetState `json:"previous,omitempty"`
+}
+
+// sealedFile is the format of files in sessions dir, their JSON is encrypted with the storage key.
+// Name of the file is authenticated, so files of different peers can't be swapped
+type sealedFile struct {
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// sessionStore holds double ratchet sessions, which are persisted in dir
+type sessionStore struct {
+	mu        sync.Mutex
+	dir       string
+	storage   cipher.AEAD
+	preKeys   *preKeys
+	signature []byte
+	sessions  map[peer.ID]*peerSessions
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		sessions: make(map[peer.ID]*peerSessions),
+	}
+}
+
+// Returns sessions with the peer, loading them from disk if needed. Must be called with locked mutex
+func (s *sessionStore) get(peerID peer.ID) *peerSessions {
+	if sessions, ok := s.sessions[peerID]; ok {
+		return sessions
+	}
+	sessions := &peerSessions{}
+	if err := s.readFile(peerID.String()+".json", sessions); err != nil && !os.IsNotExist(err) {
+		log.Println("Corrupted session with " + peerID.String() + ": " + err.Error())
+		sessions = &peerSessions{}
+	}
+	s.sessions[peerID] = sessions
+	return sessions
+}
+
+// Must be called with locked mutex
+func (s *sessionStore) save(peerID peer.ID) error {
+	return s.writeFile(peerID.String()+".json", s.sessions[peerID])
+}
+
+// Encrypts value with the storage key and writes it to the file in sessions dir. Must be called with locked mutex
+func (s *sessionStore) writeFile(name string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.storage.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(s.dir, name), &sealedFile{
+		Nonce:      nonce,
+		Ciphertext: s.storage.Seal(nil, nonce, data, []byte(name)),
+	})
+}
+
+// Reads the file from sessions dir and decrypts it into value. Must be called with locked mutex
+func (s *sessionStore) readFile(name string, value interface{}) error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	sealed := &sealedFile{}
+	if err = json.Unmarshal(data, sealed); err != nil {
+		return err
+	}
+	if len(sealed.Nonce) != s.storage.NonceSize() {
+		return errors.New("malformed nonce")
+	}
+	plaintext, err := s.storage.Open(nil, sealed.Nonce, sealed.Ciphertext, []byte(name))
+	if err != nil {
+		return errors.New("unable to decrypt " + name + ", it may be encrypted with another identity key")
+	}
+	return json.Unmarshal(plaintext, value)
+}
+
+// Derives the key, which encrypts session files, from the identity key
+func newStorageCipher(identityKey crypto.PrivKey) (cipher.AEAD, error) {
+	rawKey, err := crypto.MarshalPrivateKey(identityKey)
+	if err != nil {
+		return nil, err
+	}
+	storageKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, rawKey, nil, []byte(storageKeyInfo)), storageKey); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(storageKey)
+}
+
+// Drops sessions with the peer, removing them from disk too. Must be called with locked mutex
+func (s *sessionStore) drop(peerID peer.ID) {
+	delete(s.sessions, peerID)
+	if s.dir == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(s.dir, peerID.String()+".json")); err != nil && !os.IsNotExist(err) {
+		log.Println(err.Error())
+	}
+}
+
+// Writes file atomically, so the state isn't lost if we crash in the middle of writing
+func writeJSONFile(path string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Enables double ratchet sessions for direct messages, their state is persisted in dir.
+// Files are encrypted with the key derived from the identity key, so identity key must be set before.
+// Peers learn our prekey with the next handshake
+func (h *Handler) EnableSessions(dir string) error {
+	h.keys.mu.RLock()
+	identityKey := h.keys.identityKey
+	h.keys.mu.RUnlock()
+	if identityKey == nil {
+		return errors.New("identity key is not set")
+	}
+	storage, err := newStorageCipher(identityKey)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+	store := &sessionStore{dir: dir, storage: storage}
+	keys := &preKeys{}
+	if err = store.readFile(preKeysFile, keys); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	h.sessions.dir = dir
+	h.sessions.storage = storage
+	h.sessions.preKeys = keys
+	h.sessions.sessions = make(map[peer.ID]*peerSessions)
+	if keys.Current == nil || time.Since(time.Unix(0, keys.Current.Created*int64(time.Millisecond))) > DefaultPreKeyLifetime {
+		return h.rotatePreKey()
+	}
+	return h.signPreKey()
+}
+
+// Replaces our signed prekey, the previous one is still accepted for sessions started before.
+// Peers learn the new prekey with the next handshake
+func (h *Handler) RotatePreKey() error {
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+	if h.sessions.dir == "" {
+		return errors.New("sessions are not enabled")
+	}
+	return h.rotatePreKey()
+}
+
+// Must be called with locked mutex of sessions
+func (h *Handler) rotatePreKey() error {
+	privateKey, publicKey, err := generateKeyPair()
+	if err != nil {
+		return err
+	}
+	keys := &preKeys{
+		Current:  &preKey{PrivateKey: privateKey, PublicKey: publicKey, Created: nowMillis()},
+		Previous: h.sessions.preKeys.Current,
+	}
+	if err = h.sessions.writeFile(preKeysFile, keys); err != nil {
+		return err
+	}
+	h.sessions.preKeys = keys
+	return h.signPreKey()
+}
+
+// Must be called with locked mutex of sessions
+func (h *Handler) signPreKey() error {
+	h.keys.mu.RLock()
+	identityKey := h.keys.identityKey
+	h.keys.mu.RUnlock()
+	signature, err := identityKey.Sign(append([]byte(preKeyPrefix), h.sessions.preKeys.Current.PublicKey...))
+	if err != nil {
+		return err
+	}
+	h.sessions.signature = signature
+	return nil
+}
+
+// Returns our current prekey with its signature, nil if sessions are not enabled
+func (h *Handler) currentPreKey() ([]byte, []byte) {
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+	if h.sessions.dir == "" {
+		return nil, nil
+	}
+	return h.sessions.preKeys.Current.PublicKey, h.sessions.signature
+}
+
+// Checks whether direct messages to the peer are sent in double ratchet session
+func (h *Handler) usesSession(peerID peer.ID) bool {
+	h.sessions.mu.Lock()
+	enabled := h.sessions.dir != ""
+	h.sessions.mu.Unlock()
+	return enabled && h.PeerSupports(peerID, api.CapabilityRatchet) && h.keys.peerPreKey(peerID) != nil
+}
+
+// Derives shared secret of X3DH key agreement from DH outputs
+func x3dhSecret(dhOuts ...[]byte) []byte {
+	secret := bytes.Repeat([]byte{0xFF}, 32)
+	for _, dhOut := range dhOuts {
+		secret = append(secret, dhOut...)
+	}
+	return deriveKeys(secret, make([]byte, 32), x3dhInfo, 32)
+}
+
+// Starts session with the peer using its identity key and signed prekey
+func (h *Handler) initiateSession(peerID peer.ID) (*ratchetState, error) {
+	h.keys.mu.RLock()
+	identityPrivate, identityPublic := h.keys.privateKey, h.keys.publicKey
+	h.keys.mu.RUnlock()
+	remoteIdentity, remotePreKey := h.keys.peerKey(peerID), h.keys.peerPreKey(peerID)
+	if identityPrivate == nil || remoteIdentity == nil || remotePreKey == nil {
+		return nil, errors.New("keys of the peer are unknown")
+	}
+
+	ephemeralPrivate, ephemeralPublic, err := generateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	dh1, err := dh(identityPrivate[:], remotePreKey)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := dh(ephemeralPrivate, remoteIdentity[:])
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := dh(ephemeralPrivate, remotePreKey)
+	if err != nil {
+		return nil, err
+	}
+
+	associatedData := append(append([]byte{}, identityPublic[:]...), remoteIdentity[:]...)
+	state, err := newInitiatorState(x3dhSecret(dh1, dh2, dh3), remotePreKey, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	state.EphemeralKey = ephemeralPublic
+	state.PreKey = remotePreKey
+	return state, nil
+}
+
+// Accepts session, which the peer has started with our prekey
+func (h *Handler) acceptSession(peerID peer.ID, ephemeralKey []byte, preKeyPublic []byte) (*ratchetState, error) {
+	key := h.sessions.preKeys.find(preKeyPublic)
+	if key == nil {
+		return nil, errors.New("unknown prekey")
+	}
+	h.keys.mu.RLock()
+	identityPrivate, identityPublic := h.keys.privateKey, h.keys.publicKey
+	h.keys.mu.RUnlock()
+	remoteIdentity := h.keys.peerKey(peerID)
+	if remoteIdentity == nil {
+		return nil, errors.New("identity key of the peer is unknown")
+	}
+
+	dh1, err := dh(key.PrivateKey, remoteIdentity[:])
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := dh(identityPrivate[:], ephemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := dh(key.PrivateKey, ephemeralKey)
+	if err != nil {
+		return nil, err
+	}
+
+	associatedData := append(append([]byte{}, remoteIdentity[:]...), identityPublic[:]...)
+	state := newResponderState(x3dhSecret(dh1, dh2, dh3), key, associatedData)
+	state.RemoteEphemeral = ephemeralKey
+	return state, nil
+}
+
+// Encodes message and encrypts it in the session with the peer, starting the session if needed
+func (h *Handler) encryptInSession(toPeerID peer.ID, codec Codec, message api.Message) (*api.RatchetMessage, error) {
+	stampMessage(message.Base())
+	data, err := codec.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+	sessions := h.sessions.get(toPeerID)
+	if sessions.Current == nil {
+		if sessions.Current, err = h.initiateSession(toPeerID); err != nil {
+			return nil, err
+		}
+	}
+	state := sessions.Current
+	header, ciphertext, err := state.encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.sessions.save(toPeerID); err != nil {
+		return nil, err
+	}
+
+	return &api.RatchetMessage{
+		BaseMessage: api.BaseMessage{
+			To:           toPeerID.String(),
+			Flag:         api.FlagRatchet,
+			FromMatrixID: message.Base().FromMatrixID,
+			Timestamp:    message.Base().Timestamp,
+		},
+		RatchetKey:   header.ratchetKey,
+		PreviousSent: header.previousSent,
+		Index:        header.index,
+		Ciphertext:   ciphertext,
+		EphemeralKey: state.EphemeralKey,
+		PreKey:       state.PreKey,
+	}, nil
+}
+
+// Decrypts message in the session with the peer, accepting the session if the peer has started it
+func (h *Handler) decryptInSession(fromPeerID peer.ID, message *api.RatchetMessage) ([]byte, error) {
+	if len(message.RatchetKey) != 32 {
+		return nil, errors.New("malformed ratchet key")
+	}
+	header := ratchetHeader{ratchetKey: message.RatchetKey, previousSent: message.PreviousSent, index: message.Index}
+
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+	if h.sessions.dir == "" {
+		return nil, errors.New("sessions are not enabled")
+	}
+	sessions := h.sessions.get(fromPeerID)
+
+	for _, state := range []*ratchetState{sessions.Current, sessions.Previous} {
+		if state == nil {
+			continue
+		}
+		attempt := state.clone()
+		data, err := attempt.decrypt(header, message.Ciphertext)
+		if err != nil {
+			continue
+		}
+		// Peer has replied, so it doesn't need key agreement values anymore
+		attempt.EphemeralKey, attempt.PreKey = nil, nil
+		if state == sessions.Current {
+			sessions.Current = attempt
+		} else {
+			sessions.Previous = attempt
+		}
+		return data, h.sessions.save(fromPeerID)
+	}
+
+	if len(message.EphemeralKey) == 0 {
+		return nil, errors.New("no session is able to decrypt the message")
+	}
+	for _, state := range []*ratchetState{sessions.Current, sessions.Previous} {
+		if state != nil && bytes.Equal(state.RemoteEphemeral, message.EphemeralKey) {
+			return nil, errors.New("session is already accepted")
+		}
+	}
+	state, err := h.acceptSession(fromPeerID, message.EphemeralKey, message.PreKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := state.decrypt(header, message.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	// If both peers have started sessions simultaneously, the session started by the lesser peer ID wins
+	if sessions.Current != nil && sessions.Current.EphemeralKey != nil && h.peerID < fromPeerID {
+		sessions.Previous = state
+	} else {
+		sessions.Previous, sessions.Current = sessions.Current, state
+	}
+	return data, h.sessions.save(fromPeerID)
+}
+
+func newRatchetMessage() api.Message {
+	return &api.RatchetMessage{}
+}
+
+// Getting message encrypted in double ratchet session, handling it after decryption
+func handleRatchet(h *Handler, ctx *MessageContext, message api.Message) {
+	data, err := h.decryptInSession(ctx.FromPeerID, message.(*api.RatchetMessage))
+	if err != nil {
+		log.Printf("Failed to decrypt message from %s: %s\n", ctx.FromPeerID.String(), err.Error())
+		return
+	}
+	h.handleDecrypted(ctx, data)
+}
@@ -0,0 +1,176 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	mapset "github.com/deckarep/golang-set"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Creates handler with sessions persisted in dir
+func newTestSessionHandler(t *testing.T, prvKey crypto.PrivKey, dir string) *Handler {
+	peerID, err := peer.IDFromPrivateKey(prvKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networkTopics := mapset.NewSet()
+	handler := NewHandler(nil, "moonshard", peerID, &networkTopics)
+	if err = handler.SetIdentityKey(prvKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = handler.EnableSessions(dir); err != nil {
+		t.Fatal(err)
+	}
+	return &handler
+}
+
+// Encrypts message in the session, it's delivered later
+func sendTestSessionMessage(t *testing.T, from *Handler, to *Handler, body string) *testDelivery {
+	message := &api.BaseMessage{Body: body, To: to.peerID.String(), Flag: api.FlagGenericMessage}
+	encrypted, err := from.encryptInSession(to.peerID, JSONCodec, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testDelivery{t: t, from: from, to: to, message: encrypted}
+}
+
+// testDelivery allows to deliver encrypted message later, so messages can be reordered
+type testDelivery struct {
+	t       *testing.T
+	from    *Handler
+	to      *Handler
+	message *api.RatchetMessage
+}
+
+func (d *testDelivery) deliver() string {
+	var body string
+	msg := newTestPubsubMessage(d.t, d.from.peerID, JSONCodec, d.message)
+	d.to.HandleIncomingMessage("moonshard", msg, func(textMessage TextMessage) {
+		if textMessage.Encrypted {
+			body = textMessage.Body
+		}
+	}, nil, nil)
+	return body
+}
+
+func TestSessions(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "p2chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	aliceKey, _ := newTestPeer(t)
+	bobKey, _ := newTestPeer(t)
+	alice := newTestSessionHandler(t, aliceKey, filepath.Join(tempDir, "alice"))
+	bob := newTestSessionHandler(t, bobKey, filepath.Join(tempDir, "bob"))
+	sendTestHandshake(t, alice, bob)
+	sendTestHandshake(t, bob, alice)
+
+	if body := sendTestSessionMessage(t, alice, bob, "hello").deliver(); body != "hello" {
+		t.Fatalf("initial message is not delivered: %q", body)
+	}
+	if body := sendTestSessionMessage(t, bob, alice, "hi").deliver(); body != "hi" {
+		t.Fatalf("reply is not delivered: %q", body)
+	}
+	if alice.sessions.get(bob.peerID).Current.EphemeralKey != nil {
+		t.Fatal("key agreement values are sent after the reply")
+	}
+
+	// Messages delivered out of order
+	first := sendTestSessionMessage(t, alice, bob, "first")
+	second := sendTestSessionMessage(t, alice, bob, "second")
+	if body := second.deliver(); body != "second" {
+		t.Fatalf("second message is not delivered: %q", body)
+	}
+	if body := first.deliver(); body != "first" {
+		t.Fatalf("skipped message is not delivered: %q", body)
+	}
+	if body := first.deliver(); body != "" {
+		t.Fatal("replayed message is delivered")
+	}
+
+	// Session survives restart
+	bob = newTestSessionHandler(t, bobKey, filepath.Join(tempDir, "bob"))
+	sendTestHandshake(t, alice, bob)
+	if body := sendTestSessionMessage(t, alice, bob, "after restart").deliver(); body != "after restart" {
+		t.Fatalf("message is not delivered after restart: %q", body)
+	}
+}
+
+func TestSimultaneousSessions(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "p2chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	aliceKey, _ := newTestPeer(t)
+	bobKey, _ := newTestPeer(t)
+	alice := newTestSessionHandler(t, aliceKey, filepath.Join(tempDir, "alice"))
+	bob := newTestSessionHandler(t, bobKey, filepath.Join(tempDir, "bob"))
+	sendTestHandshake(t, alice, bob)
+	sendTestHandshake(t, bob, alice)
+
+	fromAlice := sendTestSessionMessage(t, alice, bob, "from alice")
+	fromBob := sendTestSessionMessage(t, bob, alice, "from bob")
+	if fromAlice.deliver() != "from alice" || fromBob.deliver() != "from bob" {
+		t.Fatal("messages of simultaneously started sessions are not delivered")
+	}
+	for i := 0; i < 2; i++ {
+		if sendTestSessionMessage(t, alice, bob, "ping").deliver() != "ping" || sendTestSessionMessage(t, bob, alice, "pong").deliver() != "pong" {
+			t.Fatal("peers haven't agreed on the session")
+		}
+	}
+}
+
+func TestSessionStorage(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "p2chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	aliceKey, _ := newTestPeer(t)
+	bobKey, _ := newTestPeer(t)
+	alice := newTestSessionHandler(t, aliceKey, filepath.Join(tempDir, "alice"))
+	bobDir := filepath.Join(tempDir, "bob")
+	bob := newTestSessionHandler(t, bobKey, bobDir)
+	sendTestHandshake(t, alice, bob)
+	sendTestHandshake(t, bob, alice)
+	sendTestSessionMessage(t, alice, bob, "hello").deliver()
+
+	// Private keys aren't written in plaintext
+	secrets := map[string][]byte{
+		preKeysFile:                     bob.sessions.preKeys.Current.PrivateKey,
+		alice.peerID.String() + ".json": bob.sessions.get(alice.peerID).Current.PrivateKey,
+	}
+	for name, secret := range secrets {
+		data, err := ioutil.ReadFile(filepath.Join(bobDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, _ := json.Marshal(secret)
+		if bytes.Contains(data, secret) || bytes.Contains(data, encoded) {
+			t.Fatalf("%s contains private key in plaintext", name)
+		}
+	}
+
+	// Files can't be read with another identity key
+	otherKey, otherID := newTestPeer(t)
+	networkTopics := mapset.NewSet()
+	other := NewHandler(nil, "moonshard", otherID, &networkTopics)
+	if err = other.SetIdentityKey(otherKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = other.EnableSessions(bobDir); err == nil {
+		t.Fatal("prekeys are decrypted with another identity key")
+	}
+}
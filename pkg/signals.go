@@ -0,0 +1,233 @@
+package pkg
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// SignalType is the kind of ephemeral signal in the topic
+type SignalType int
+
+const (
+	SignalTypingStarted SignalType = iota + 1
+	SignalTypingStopped
+	SignalPresenceActive
+	SignalPresenceIdle
+)
+
+const (
+	// DefaultSignalInterval is the minimal interval between two equal signals sent to the same topic
+	DefaultSignalInterval = 3 * time.Second
+	// DefaultSignalTTL is how long the signal is valid if sender doesn't renew it
+	DefaultSignalTTL = 10 * time.Second
+	// maxSignalTTL limits TTL requested by remote peers
+	maxSignalTTL = 5 * time.Minute
+)
+
+var signalFlags = map[SignalType]int{
+	SignalTypingStarted:  api.FlagTypingStarted,
+	SignalTypingStopped:  api.FlagTypingStopped,
+	SignalPresenceActive: api.FlagPresenceActive,
+	SignalPresenceIdle:   api.FlagPresenceIdle,
+}
+
+// Signals which expire, mapped to the signal they turn into after expiration
+var expiringSignals = map[SignalType]SignalType{
+	SignalTypingStarted:  SignalTypingStopped,
+	SignalPresenceActive: SignalPresenceIdle,
+}
+
+// SignalEvent is emitted when peer sends signal to the topic or when its signal expires
+type SignalEvent struct {
+	Topic        string
+	FromPeerID   string
+	FromMatrixID string
+	Signal       SignalType
+	// Expired is set when the signal is not sent by the peer, but derived from expiration of previous one
+	Expired bool
+}
+
+// signalTracker rate limits outgoing signals and expires incoming ones
+type signalTracker struct {
+	mu       sync.Mutex
+	interval time.Duration
+	ttl      time.Duration
+	lastSent map[string]time.Time
+	timers   map[string]*time.Timer
+}
+
+func newSignalTracker() *signalTracker {
+	return &signalTracker{
+		interval: DefaultSignalInterval,
+		ttl:      DefaultSignalTTL,
+		lastSent: make(map[string]time.Time),
+		timers:   make(map[string]*time.Timer),
+	}
+}
+
+func signalFromFlag(flag int) SignalType {
+	for signal, signalFlag := range signalFlags {
+		if signalFlag == flag {
+			return signal
+		}
+	}
+	return 0
+}
+
+// Returns the signal which is cancelled by this one (e.g. typing stopped cancels typing started)
+func cancelledSignal(signal SignalType) SignalType {
+	for started, stopped := range expiringSignals {
+		if stopped == signal {
+			return started
+		}
+	}
+	return 0
+}
+
+func signalKey(topic string, signal SignalType) string {
+	return topic + "/" + strconv.Itoa(int(signal))
+}
+
+// Checks whether signal can be sent now and remembers the time of sending
+func (t *signalTracker) allowSend(topic string, signal SignalType) bool {
+	now := time.Now()
+	key := signalKey(topic, signal)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if lastSent, ok := t.lastSent[key]; ok && now.Sub(lastSent) < t.interval {
+		return false
+	}
+	t.lastSent[key] = now
+	if cancelled := cancelledSignal(signal); cancelled != 0 {
+		// Next "started" signal has to go through immediately after "stopped"
+		delete(t.lastSent, signalKey(topic, cancelled))
+	}
+	return true
+}
+
+// Starts (or renews) expiration timer of the incoming signal
+func (t *signalTracker) expireAfter(key string, ttl time.Duration, expire func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if timer, ok := t.timers[key]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(ttl, func() {
+		t.mu.Lock()
+		current := t.timers[key] == timer
+		if current {
+			delete(t.timers, key)
+		}
+		t.mu.Unlock()
+		if current {
+			expire()
+		}
+	})
+	t.timers[key] = timer
+}
+
+// Cancels expiration timer, returns false if there was nothing to cancel
+func (t *signalTracker) cancel(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timer, ok := t.timers[key]
+	if ok {
+		timer.Stop()
+		delete(t.timers, key)
+	}
+	return ok
+}
+
+// Sets rate limit interval and lifetime of outgoing signals
+func (h *Handler) SetSignalTiming(interval time.Duration, ttl time.Duration) {
+	h.signals.mu.Lock()
+	defer h.signals.mu.Unlock()
+	h.signals.interval = interval
+	h.signals.ttl = ttl
+}
+
+// Sends ephemeral signal to the topic. Returns false if the signal is dropped by rate limiter
+// or if there is nobody in the topic who understands signals
+func (h *Handler) SendSignal(topic string, signal SignalType) bool {
+	flag, ok := signalFlags[signal]
+	if !ok || !h.anyPeerSupports(topic, api.CapabilitySignals) {
+		return false
+	}
+	if !h.signals.allowSend(topic, signal) {
+		return false
+	}
+
+	h.signals.mu.Lock()
+	ttl := h.signals.ttl
+	h.signals.mu.Unlock()
+	signalMessage := &api.SignalMessage{
+		BaseMessage: api.BaseMessage{
+			Body:         "",
+			To:           "",
+			Flag:         flag,
+			FromMatrixID: h.matrixID,
+		},
+		TTL: int64(ttl / time.Millisecond),
+	}
+
+	h.sendMessageToTopic(topic, signalMessage)
+	return true
+}
+
+// Checks whether at least one peer in the topic has announced the capability
+func (h *Handler) anyPeerSupports(topic string, capability string) bool {
+	for _, peerID := range h.GetPeers(topic) {
+		if h.PeerSupports(peerID, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+func newSignalMessage() api.Message {
+	return &api.SignalMessage{}
+}
+
+// Getting signal, notifying the application and scheduling its expiration
+func handleSignal(h *Handler, ctx *MessageContext, message api.Message) {
+	signalMessage := message.(*api.SignalMessage)
+	signal := signalFromFlag(signalMessage.Flag)
+	if signal == 0 {
+		return // Signal from the reserved range, which we don't know yet
+	}
+
+	event := &SignalEvent{
+		Topic:        ctx.Topic,
+		FromPeerID:   ctx.FromPeerID.String(),
+		FromMatrixID: signalMessage.FromMatrixID,
+		Signal:       signal,
+	}
+	if stopped, ok := expiringSignals[signal]; ok {
+		ttl := time.Duration(signalMessage.TTL) * time.Millisecond
+		if ttl <= 0 || ttl > maxSignalTTL {
+			ttl = DefaultSignalTTL
+		}
+		h.signals.expireAfter(peerSignalKey(ctx.Topic, ctx.FromPeerID, signal), ttl, func() {
+			h.emitEvent(&SignalEvent{
+				Topic:        event.Topic,
+				FromPeerID:   event.FromPeerID,
+				FromMatrixID: event.FromMatrixID,
+				Signal:       stopped,
+				Expired:      true,
+			})
+		})
+	} else if started := cancelledSignal(signal); started != 0 {
+		h.signals.cancel(peerSignalKey(ctx.Topic, ctx.FromPeerID, started))
+	}
+	h.emitEvent(event)
+}
+
+func peerSignalKey(topic string, peerID peer.ID, signal SignalType) string {
+	return signalKey(topic, signal) + "/" + peerID.String()
+}
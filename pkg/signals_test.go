@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+func TestSignalRateLimit(t *testing.T) {
+	tracker := newSignalTracker()
+	if !tracker.allowSend("moonshard", SignalTypingStarted) {
+		t.Fatal("first signal is dropped")
+	}
+	if tracker.allowSend("moonshard", SignalTypingStarted) {
+		t.Fatal("repeated signal is not rate limited")
+	}
+	if !tracker.allowSend("random", SignalTypingStarted) {
+		t.Fatal("signal to another topic is rate limited")
+	}
+	if !tracker.allowSend("moonshard", SignalTypingStopped) {
+		t.Fatal("stop signal is dropped")
+	}
+	if !tracker.allowSend("moonshard", SignalTypingStarted) {
+		t.Fatal("signal is rate limited after it was stopped")
+	}
+}
+
+func TestSignalExpiration(t *testing.T) {
+	handler := newTestHandler(t)
+	_, fromPeerID := newTestPeer(t)
+	events := make(chan *SignalEvent, 2)
+	handler.SetEventHandler(func(event Event) {
+		if signalEvent, ok := event.(*SignalEvent); ok {
+			events <- signalEvent
+		}
+	})
+
+	message := &api.SignalMessage{
+		BaseMessage: api.BaseMessage{Flag: api.FlagTypingStarted, ID: newMessageID()},
+		TTL:         10,
+	}
+	handler.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, fromPeerID, JSONCodec, message), nil, nil, nil)
+
+	if event := <-events; event.Signal != SignalTypingStarted || event.Expired {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	select {
+	case event := <-events:
+		if event.Signal != SignalTypingStopped || !event.Expired {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("signal hasn't expired")
+	}
+}
@@ -0,0 +1,34 @@
+package pkg
+
+import (
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+// Sends reply to the message, the reply joins the thread of the message. Returns ID of the reply
+func (h *Handler) SendReply(topic string, replyTo string, body string) string {
+	message := &api.BaseMessage{
+		Body:         body,
+		To:           "",
+		Flag:         api.FlagGenericMessage,
+		FromMatrixID: h.matrixID,
+		ReplyTo:      replyTo,
+		ThreadRoot:   h.history.threadRootFor(replyTo),
+	}
+
+	h.sendTextMessage(topic, message)
+	return message.ID
+}
+
+// Returns replies to the thread root from local history, in order of their arrival
+func (h *Handler) GetThread(rootID string) []TextMessage {
+	return h.history.thread(rootID)
+}
+
+// Returns root of the thread which the message belongs to, or empty string if the message is not a reply
+func (h *Handler) GetThreadRoot(messageID string) string {
+	message, ok := h.history.get(messageID)
+	if !ok {
+		return ""
+	}
+	return message.ThreadRoot
+}
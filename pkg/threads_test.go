@@ -0,0 +1,29 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestThreads(t *testing.T) {
+	history := newMessageHistory(3)
+	author := peer.ID("author")
+
+	history.add(author, TextMessage{Topic: "moonshard", ID: "root"})
+	history.add(author, TextMessage{Topic: "moonshard", ID: "reply1", ReplyTo: "root", ThreadRoot: history.threadRootFor("root")})
+	history.add(author, TextMessage{Topic: "moonshard", ID: "reply2", ReplyTo: "reply1", ThreadRoot: history.threadRootFor("reply1")})
+
+	replies := history.thread("root")
+	if len(replies) != 2 || replies[0].ID != "reply1" || replies[1].ID != "reply2" {
+		t.Fatalf("unexpected thread %+v", replies)
+	}
+
+	// Root and the first reply are evicted
+	history.add(author, TextMessage{Topic: "moonshard", ID: "other1"})
+	history.add(author, TextMessage{Topic: "moonshard", ID: "other2"})
+	replies = history.thread("root")
+	if len(replies) != 1 || replies[0].ID != "reply2" {
+		t.Fatalf("evicted messages are still in the thread %+v", replies)
+	}
+}
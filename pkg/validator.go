@@ -0,0 +1,237 @@
+package pkg
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+const (
+	// DefaultMaxMessageSize is the limit of encoded message, larger messages are not forwarded
+	DefaultMaxMessageSize = 256 * 1024
+	// maxClockSkew is how far in the future timestamp of the message may be
+	maxClockSkew = 10 * time.Minute
+	// maxDecodedMessages is how many validated messages wait for the handler at most
+	maxDecodedMessages = 1024
+)
+
+// decodedData is the message decoded by the validator
+type decodedData struct {
+	codec  Codec
+	header *api.MessageHeader
+	// message is nil if the message is only forwarded, because its flag is unknown or it's of newer protocol
+	message api.Message
+}
+
+// decodedCache passes messages decoded by the validator to HandleIncomingMessage, so the data is decoded only once
+type decodedCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type decodedEntry struct {
+	id      string
+	data    []byte
+	decoded *decodedData
+}
+
+func newDecodedCache() *decodedCache {
+	return &decodedCache{
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Returns ID of the message, which is used by pubsub to detect duplicates
+func pubsubMessageID(msg *pubsub.Message) string {
+	return string(msg.From) + string(msg.Seqno)
+}
+
+func (c *decodedCache) put(msg *pubsub.Message, decoded *decodedData) {
+	id := pubsubMessageID(msg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[id]; ok {
+		return
+	}
+	// Messages which are never handled (e.g. the application doesn't read the subscription) are evicted oldest first
+	for c.order.Len() >= maxDecodedMessages {
+		oldest := c.order.Front()
+		delete(c.entries, oldest.Value.(*decodedEntry).id)
+		c.order.Remove(oldest)
+	}
+	c.entries[id] = c.order.PushBack(&decodedEntry{id: id, data: msg.Data, decoded: decoded})
+}
+
+// Returns message decoded by the validator and removes it from the cache, or nil if it wasn't decoded
+func (c *decodedCache) take(msg *pubsub.Message) *decodedData {
+	id := pubsubMessageID(msg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+	delete(c.entries, id)
+	c.order.Remove(element)
+	entry := element.Value.(*decodedEntry)
+	if !bytes.Equal(entry.data, msg.Data) {
+		return nil
+	}
+	return entry.decoded
+}
+
+// Subscribes to the topic and registers validator, which rejects malformed messages before they are forwarded to other peers
+func (h *Handler) JoinTopic(topic string) (*pubsub.Subscription, error) {
+	h.mu.Lock()
+	validated := h.validated[topic]
+	h.validated[topic] = true
+	h.mu.Unlock()
+
+	if !validated {
+		if err := h.pb.RegisterTopicValidator(topic, h.validateMessage); err != nil {
+			h.mu.Lock()
+			delete(h.validated, topic)
+			h.mu.Unlock()
+			return nil, err
+		}
+	}
+	subscription, err := h.pb.Subscribe(topic)
+	if err == nil {
+		h.presentInvite(topic, "")
+	}
+	return subscription, err
+}
+
+// Cancels subscription to the topic and removes its validator
+func (h *Handler) LeaveTopic(subscription *pubsub.Subscription) {
+	topic := subscription.Topic()
+	subscription.Cancel()
+
+	h.mu.Lock()
+	validated := h.validated[topic]
+	delete(h.validated, topic)
+	h.mu.Unlock()
+	if validated {
+		h.pb.UnregisterTopicValidator(topic)
+	}
+}
+
+// Sets the limit of encoded message size
+func (h *Handler) SetMaxMessageSize(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxMsgSize = size
+}
+
+// Validator for pubsub topics
+func (h *Handler) validateMessage(ctx context.Context, src peer.ID, msg *pubsub.Message) bool {
+	decoded, err := h.checkMessage(msg)
+	if err != nil {
+		log.Printf("Rejecting message forwarded by %s: %s\n", src.String(), err.Error())
+		return false
+	}
+	h.decodedMessages.put(msg, decoded)
+	return true
+}
+
+// Checks size of the message and its contents
+func (h *Handler) checkMessage(msg *pubsub.Message) (*decodedData, error) {
+	h.mu.RLock()
+	maxMsgSize := h.maxMsgSize
+	h.mu.RUnlock()
+	if len(msg.Data) > maxMsgSize {
+		return nil, fmt.Errorf("message size %d exceeds the limit", len(msg.Data))
+	}
+
+	fromPeerID, err := peer.IDFromBytes(msg.From)
+	if err != nil {
+		return nil, errors.New("malformed sender")
+	}
+	decoded, err := h.checkData(fromPeerID, msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	for _, topic := range msg.GetTopicIDs() {
+		if err = h.checkMembership(topic, fromPeerID, decoded); err != nil {
+			return nil, err
+		}
+	}
+	return decoded, nil
+}
+
+// Checks envelope, flag and sender of the encoded message and returns the decoded message
+func (h *Handler) checkData(fromPeerID peer.ID, data []byte) (*decodedData, error) {
+	codec := codecForData(data)
+	header := &api.MessageHeader{}
+	if err := codec.Unmarshal(data, header); err != nil {
+		return nil, errors.New("malformed envelope")
+	}
+	if h.retired.isRetired(fromPeerID) {
+		return nil, errors.New("sender key is rotated or revoked")
+	}
+	if mode, blocked := h.IsBlocked(fromPeerID); blocked && mode == BlockHard {
+		return nil, errors.New("sender is blocked")
+	}
+	if header.Flag < 0 {
+		return nil, fmt.Errorf("invalid flag %#x", header.Flag)
+	}
+	if header.To != "" {
+		if _, err := peer.IDB58Decode(header.To); err != nil {
+			return nil, errors.New("malformed recipient")
+		}
+	}
+
+	decoded := &decodedData{codec: codec, header: header}
+	if !isVersionHandled(header.Version, header.Flag) {
+		return decoded, nil // Format of newer protocol may differ, so the message is forwarded as is
+	}
+
+	h.mu.RLock()
+	flagHandler, ok := h.flagHandlers[header.Flag]
+	h.mu.RUnlock()
+	if !ok {
+		// Flags we don't know are forwarded only if they may be known by others:
+		// they are defined by application or by newer version of the protocol
+		if header.Flag < api.FlagUserDefined && header.Version <= api.ProtocolVersion {
+			return nil, fmt.Errorf("unknown flag %#x", header.Flag)
+		}
+		return decoded, nil
+	}
+
+	message := flagHandler.newMessage()
+	if err := codec.Unmarshal(data, message); err != nil {
+		return nil, fmt.Errorf("malformed message with flag %#x", header.Flag)
+	}
+	base := message.Base()
+	if !isVersionSupported(messageVersion(base)) {
+		return nil, fmt.Errorf("unsupported protocol version %d", base.Version)
+	}
+	if base.Timestamp > nowMillis()+int64(maxClockSkew/time.Millisecond) {
+		return nil, errors.New("timestamp is in the future")
+	}
+	if mode, blocked := h.blockMode(fromPeerID, base.FromMatrixID); blocked && mode == BlockHard {
+		return nil, fmt.Errorf("sender claims blocked Matrix ID %s", base.FromMatrixID)
+	}
+
+	// Sender is authenticated by pubsub signature, so the claimed Matrix ID must match the one we know for the peer
+	h.mu.RLock()
+	knownMatrixID, ok := h.identityMap[peer.ID(fromPeerID.String())]
+	h.mu.RUnlock()
+	if ok && base.FromMatrixID != "" && base.FromMatrixID != knownMatrixID &&
+		base.Flag != api.FlagIdentityResponse && base.Flag != api.FlagGreetingRespond {
+		return nil, fmt.Errorf("sender %s claims Matrix ID %s, but it is known as %s", fromPeerID.String(), base.FromMatrixID, knownMatrixID)
+	}
+	decoded.message = message
+	return decoded, nil
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+func TestCheckMessage(t *testing.T) {
+	handler := newTestHandler(t)
+	_, fromPeerID := newTestPeer(t)
+	handler.identityMap[peer.ID(fromPeerID.String())] = "@alice:moonshard"
+
+	valid := []*api.BaseMessage{
+		{Body: "hello", Flag: api.FlagGenericMessage},
+		{Body: "hello", Flag: api.FlagGenericMessage, FromMatrixID: "@alice:moonshard"},
+		{Flag: api.FlagUserDefined + 42},
+		{Flag: 0x999, Version: api.ProtocolVersion + 1},
+	}
+	for _, message := range valid {
+		msg := newTestPubsubMessage(t, fromPeerID, JSONCodec, message)
+		if _, err := handler.checkMessage(&msg); err != nil {
+			t.Fatalf("message %+v is rejected: %s", message, err)
+		}
+	}
+
+	invalid := []*api.BaseMessage{
+		{Body: strings.Repeat("a", DefaultMaxMessageSize), Flag: api.FlagGenericMessage},
+		{Flag: -1},
+		{Flag: 0x999},
+		{Flag: api.FlagGenericMessage, To: "not a peer"},
+		{Flag: api.FlagGenericMessage, FromMatrixID: "@mallory:moonshard"},
+		{Flag: api.FlagGenericMessage, Timestamp: nowMillis() * 2},
+	}
+	for _, message := range invalid {
+		msg := newTestPubsubMessage(t, fromPeerID, ProtobufCodec, message)
+		if _, err := handler.checkMessage(&msg); err == nil {
+			t.Fatalf("message %+v is accepted", message)
+		}
+	}
+
+	malformed := &pubsub.Message{Message: &pb.Message{From: []byte(fromPeerID), Data: []byte("{")}}
+	if _, err := handler.checkMessage(malformed); err == nil {
+		t.Fatal("malformed message is accepted")
+	}
+}
+
+func TestValidatedMessageIsDecodedOnce(t *testing.T) {
+	handler := newTestHandler(t)
+	_, fromPeerID := newTestPeer(t)
+	flag := api.FlagUserDefined + 1
+
+	decodes, received := 0, 0
+	err := handler.RegisterFlag(flag, func() api.Message {
+		decodes++
+		return &api.BaseMessage{}
+	}, func(h *Handler, ctx *MessageContext, message api.Message) {
+		received++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := newTestPubsubMessage(t, fromPeerID, ProtobufCodec, &api.BaseMessage{Flag: flag, ID: newMessageID()})
+	msg.Seqno = []byte{1}
+	if !handler.validateMessage(context.Background(), fromPeerID, &msg) {
+		t.Fatal("message is rejected")
+	}
+	handler.HandleIncomingMessage("moonshard", msg, nil, nil, nil)
+	if decodes != 1 || received != 1 {
+		t.Fatalf("message is decoded %d times and delivered %d times", decodes, received)
+	}
+
+	// Data which doesn't match the validated one is decoded again
+	if !handler.validateMessage(context.Background(), fromPeerID, &msg) {
+		t.Fatal("message is rejected")
+	}
+	forged := newTestPubsubMessage(t, fromPeerID, ProtobufCodec, &api.BaseMessage{Flag: flag, ID: newMessageID()})
+	forged.Seqno = msg.Seqno
+	handler.HandleIncomingMessage("moonshard", forged, nil, nil, nil)
+	if decodes != 3 || received != 2 {
+		t.Fatalf("message is decoded %d times and delivered %d times", decodes, received)
+	}
+}
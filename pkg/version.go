@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"errors"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+	mapset "github.com/deckarep/golang-set"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// PeerInfo is protocol version and capabilities which remote peer has announced
+type PeerInfo struct {
+	// Version is the version we speak with the peer, newer peers speak our version
+	Version      int
+	Capabilities mapset.Set
+}
+
+func newPeerInfo(version int, capabilities []string) *PeerInfo {
+	info := &PeerInfo{
+		Version:      version,
+		Capabilities: mapset.NewSet(),
+	}
+	for _, capability := range capabilities {
+		info.Capabilities.Add(capability)
+	}
+	return info
+}
+
+// Returns version of the message, treating missing version as v1
+func messageVersion(message *api.BaseMessage) int {
+	if message.Version == 0 {
+		return api.LegacyProtocolVersion
+	}
+	return message.Version
+}
+
+// Remembers version (and capabilities, if it is a handshake) of the peer
+func (h *Handler) updatePeerInfo(peerID peer.ID, message *api.BaseMessage) {
+	version := messageVersion(message)
+	if version > api.ProtocolVersion {
+		version = api.ProtocolVersion
+	}
+	isHandshake := message.Flag == api.FlagHandshake || message.Flag == api.FlagHandshakeRespond
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	info, ok := h.peerInfo[peerID]
+	if !ok || isHandshake || info.Version != version {
+		// Version has changed (node was upgraded or downgraded), so old capabilities can't be trusted anymore
+		var capabilities []string
+		if isHandshake {
+			capabilities = message.Capabilities
+		}
+		h.peerInfo[peerID] = newPeerInfo(version, capabilities)
+	}
+}
+
+// Returns protocol information about specific peer, if we have seen any message from it
+func (h *Handler) GetPeerInfo(peerID peer.ID) (PeerInfo, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	info, ok := h.peerInfo[peerID]
+	if !ok {
+		return PeerInfo{}, false
+	}
+	return PeerInfo{
+		Version:      info.Version,
+		Capabilities: info.Capabilities.Clone(),
+	}, true
+}
+
+// Checks whether specific peer has announced the capability.
+// Peers which didn't send handshake are considered as v1 nodes without any capabilities
+func (h *Handler) PeerSupports(peerID peer.ID, capability string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	info, ok := h.peerInfo[peerID]
+	if !ok {
+		return false
+	}
+	return info.Capabilities.Contains(capability)
+}
+
+// Checks whether all peers in the topic have announced the capability
+func (h *Handler) TopicSupports(topic string, capability string) bool {
+	for _, peerID := range h.GetPeers(topic) {
+		if !h.PeerSupports(peerID, capability) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks capability of the receiver of the message, which is the peer `to` if it's set, or every peer of the topic otherwise
+func (h *Handler) receiversSupport(topic string, to string, capability string) bool {
+	if to != "" {
+		toPeerID, err := peer.IDB58Decode(to)
+		return err == nil && h.PeerSupports(toPeerID, capability)
+	}
+	return h.TopicSupports(topic, capability)
+}
+
+// Returns error if receivers of the message haven't announced the capability, so the message would be lost for them
+func (h *Handler) requireSupport(topic string, to string, capability string) error {
+	if !h.receiversSupport(topic, to, capability) {
+		return errors.New("receivers in topic " + topic + " don't support " + capability)
+	}
+	return nil
+}
+
+// Checks whether we accept messages of this version
+func isVersionSupported(version int) bool {
+	return version >= api.MinProtocolVersion
+}
+
+// Checks whether we are able to handle the message of this version. Messages of newer versions are only forwarded,
+// except handshakes: newer peers learn our version from the response and speak it with us
+func isVersionHandled(version int, flag int) bool {
+	return version <= api.MaxCompatibleProtocolVersion || flag == api.FlagHandshake || flag == api.FlagHandshakeRespond
+}
+
+// Announces our protocol version and capabilities to the network
+func (h *Handler) SendHandshake() {
+	h.sendMessageToServiceTopic(h.newHandshake(api.FlagHandshake, ""))
+}
+
+func (h *Handler) sendHandshakeResponse(toPeerID string) {
+	h.sendMessageToServiceTopic(h.newHandshake(api.FlagHandshakeRespond, toPeerID))
+}
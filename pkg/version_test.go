@@ -0,0 +1,190 @@
+package pkg
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/MoonSHRD/p2chat/v2/api"
+)
+
+func TestVersionSupport(t *testing.T) {
+	cases := map[int]bool{
+		api.MinProtocolVersion - 1:           false,
+		api.LegacyProtocolVersion:            true,
+		api.ProtocolVersion:                  true,
+		api.MaxCompatibleProtocolVersion + 1: true,
+	}
+	for version, supported := range cases {
+		if isVersionSupported(version) != supported {
+			t.Fatalf("support of version %d must be %v", version, supported)
+		}
+	}
+	if messageVersion(&api.BaseMessage{}) != api.LegacyProtocolVersion {
+		t.Fatal("message without version is not treated as legacy")
+	}
+
+	// Messages of newer protocol are forwarded, but not handled
+	handler := newTestHandler(t)
+	_, fromPeerID := newTestPeer(t)
+	future := &api.BaseMessage{Flag: api.FlagGenericMessage, Version: api.MaxCompatibleProtocolVersion + 1, Body: "from the future"}
+	msg := newTestPubsubMessage(t, fromPeerID, JSONCodec, future)
+	if _, err := handler.checkMessage(&msg); err != nil {
+		t.Fatalf("message of future version is not forwarded: %v", err)
+	}
+	handler.HandleIncomingMessage("moonshard", msg, func(TextMessage) {
+		t.Fatal("message of future version is handled")
+	}, nil, nil)
+
+	// Newer peer is spoken to with our version
+	handshake := &api.HandshakeMessage{
+		BaseMessage: api.BaseMessage{
+			Flag:         api.FlagHandshakeRespond,
+			Version:      api.MaxCompatibleProtocolVersion + 1,
+			Capabilities: []string{api.CapabilityFragments, "teleportation"},
+		},
+	}
+	msg = newTestPubsubMessage(t, fromPeerID, JSONCodec, handshake)
+	if _, err := handler.checkMessage(&msg); err != nil {
+		t.Fatalf("handshake of future version is rejected: %v", err)
+	}
+	handler.HandleIncomingMessage("moonshard", msg, nil, nil, nil)
+	if info, ok := handler.GetPeerInfo(fromPeerID); !ok || info.Version != api.ProtocolVersion {
+		t.Fatalf("version is not negotiated with the newer peer: %+v", info)
+	}
+	if !handler.PeerSupports(fromPeerID, api.CapabilityFragments) {
+		t.Fatal("capabilities of the newer peer are not known")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aliceHost, alice := newTestNetworkHandler(t, ctx)
+	bobHost, bob := newTestNetworkHandler(t, ctx)
+	connectTestHosts(t, ctx, aliceHost, bobHost)
+	joinTestTopic(t, ctx, alice, "moonshard", nil)
+	joinTestTopic(t, ctx, bob, "moonshard", nil)
+	waitFor(t, "pubsub peers", func() bool {
+		return len(alice.GetPeers("moonshard")) == 1 && len(bob.GetPeers("moonshard")) == 1
+	})
+
+	if alice.PeerSupports(bobHost.ID(), api.CapabilityFragments) {
+		t.Fatal("capability is supported before the handshake")
+	}
+	alice.SendHandshake()
+	// Bob answers the handshake, so both sides learn capabilities of each other
+	waitFor(t, "handshake", func() bool {
+		return alice.PeerSupports(bobHost.ID(), api.CapabilityFragments) && bob.PeerSupports(aliceHost.ID(), api.CapabilityFragments)
+	})
+	if info, ok := alice.GetPeerInfo(bobHost.ID()); !ok || info.Version != api.ProtocolVersion {
+		t.Fatalf("version of the peer is not known: %+v", info)
+	}
+	if !alice.TopicSupports("moonshard", api.CapabilityGzip) {
+		t.Fatal("capability announced by every peer of the topic is not supported")
+	}
+	if alice.TopicSupports("moonshard", "teleportation") || alice.PeerSupports(bobHost.ID(), "teleportation") {
+		t.Fatal("capability which is not announced is supported")
+	}
+
+	// Legacy message without version resets capabilities, the peer may have been downgraded
+	legacy := &api.BaseMessage{Flag: api.FlagGenericMessage, Body: "hi"}
+	alice.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, bobHost.ID(), JSONCodec, legacy), func(TextMessage) {}, nil, nil)
+	if info, _ := alice.GetPeerInfo(bobHost.ID()); info.Version != api.LegacyProtocolVersion || alice.PeerSupports(bobHost.ID(), api.CapabilityFragments) {
+		t.Fatal("capabilities of downgraded peer are kept")
+	}
+}
+
+func TestCapabilityGating(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tempDir, err := ioutil.TempDir("", "p2chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "notes.txt")
+	if err = ioutil.WriteFile(path, []byte("notes"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	aliceHost, alice := newTestNetworkHandler(t, ctx)
+	bobHost, bob := newTestNetworkHandler(t, ctx)
+	if err = alice.EnableFileTransfer(aliceHost, filepath.Join(tempDir, "alice")); err != nil {
+		t.Fatal(err)
+	}
+	connectTestHosts(t, ctx, aliceHost, bobHost)
+	var mu sync.Mutex
+	var received []TextMessage
+	joinTestTopic(t, ctx, alice, "moonshard", nil)
+	joinTestTopic(t, ctx, bob, "moonshard", func(message TextMessage) {
+		mu.Lock()
+		received = append(received, message)
+		mu.Unlock()
+	})
+	// Messages may be delivered in any order
+	findReceived := func(id string) *TextMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		for i := range received {
+			if received[i].ID == id {
+				return &received[i]
+			}
+		}
+		return nil
+	}
+	waitFor(t, "pubsub peers", func() bool {
+		return len(alice.GetPeers("moonshard")) == 1 && len(bob.GetPeers("moonshard")) == 1
+	})
+	alice.SendHandshake()
+	waitFor(t, "handshake", func() bool {
+		return alice.PeerSupports(bobHost.ID(), api.CapabilityThreads)
+	})
+
+	rootID := alice.SendMessage("moonshard", "root")
+	if err = alice.EditMessage("moonshard", rootID, "edited root"); err != nil {
+		t.Fatal(err)
+	}
+	replyID := alice.SendReply("moonshard", rootID, "reply")
+	waitFor(t, "reply", func() bool { return findReceived(replyID) != nil })
+	if message := findReceived(replyID); message.ReplyTo != rootID {
+		t.Fatalf("reply is sent without thread %+v", message)
+	}
+
+	// Bob is downgraded to v1, which knows nothing about extensions
+	legacy := &api.BaseMessage{Flag: api.FlagGenericMessage, Body: "hi"}
+	alice.HandleIncomingMessage("moonshard", newTestPubsubMessage(t, bobHost.ID(), JSONCodec, legacy), func(TextMessage) {}, nil, nil)
+	if err = alice.EditMessage("moonshard", rootID, "edited again"); err == nil {
+		t.Fatal("edit is sent to the peer, which doesn't support edits")
+	}
+	if message, _ := alice.history.get(rootID); message.Body != "edited root" {
+		t.Fatal("edit, which is not sent, is applied locally")
+	}
+	if err = alice.React("moonshard", rootID, "👍"); err == nil {
+		t.Fatal("reaction is sent to the peer, which doesn't support reactions")
+	}
+	if _, err = alice.OfferFile("moonshard", path, ""); err == nil {
+		t.Fatal("file is offered to the peer, which doesn't support files")
+	}
+
+	// Replies and typed content fall back to plain text
+	replyID = alice.SendReply("moonshard", rootID, "another reply")
+	waitFor(t, "fallback reply", func() bool { return findReceived(replyID) != nil })
+	if message := findReceived(replyID); message.ReplyTo != "" || message.Body != "another reply" {
+		t.Fatalf("reply is not sent as plain text %+v", message)
+	}
+	if thread := alice.GetThread(rootID); len(thread) != 2 {
+		t.Fatal("reply is not kept in the local thread")
+	}
+	contentID, err := alice.SendContent("moonshard", MarkdownContent{Markdown: "**bold**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "fallback content", func() bool { return findReceived(contentID) != nil })
+	if message := findReceived(contentID); message.ContentType != "" || message.Body != "**bold**" {
+		t.Fatalf("content is not sent as plain text %+v", message)
+	}
+}